@@ -0,0 +1,190 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Recording of the serial session with the LPWAN module, for later replay
+package main
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// A capture file is plain text with one record per line, so that it can be read by eye:
+//   <RFC3339 timestamp> > <command sent to the module>
+//   <RFC3339 timestamp> < <line received from the module>
+// Lines beginning with '#' are comments.
+const (
+    captureSent = '>'
+    captureReceived = '<'
+    captureTimeFormat = "2006-01-02T15:04:05.000000000Z07:00"
+)
+
+// captureRecord is a single line of a capture file
+type captureRecord struct {
+    At time.Time
+    Direction byte
+    Line []byte
+}
+
+// sessionCapture is a capture file being recorded
+type sessionCapture struct {
+    mu sync.Mutex
+    file *os.File
+    filename string
+    bytes int64
+    maxBytes int64
+}
+
+// Begin recording if requested by the CAPTURE environment variable.  Each radio beyond
+// the first is recorded to its own file, because a replay is of a single module.
+func captureInit(r *loraRadio) *sessionCapture {
+
+    filename := os.Getenv("CAPTURE")
+    if filename == "" {
+        return nil
+    }
+    if r.index > 0 {
+        filename = filename + "." + r.id
+    }
+
+    c := &sessionCapture{}
+    c.filename = filename
+    c.maxBytes = 10 * 1024 * 1024
+
+    s := os.Getenv("CAPTURE_MAX_BYTES")
+    if s != "" {
+        i64, err := strconv.ParseInt(s, 10, 64)
+        if err == nil && i64 > 0 {
+            c.maxBytes = i64
+        }
+    }
+
+    c.mu.Lock()
+    err := c.open()
+    c.mu.Unlock()
+    if err != nil {
+        r.logf("capture: cannot open %s: %v\n", filename, err)
+        return nil
+    }
+
+    r.logf("Capturing module I/O to %s\n", filename)
+    return c
+
+}
+
+// Open the capture file for appending; must be called with the lock held
+func (c *sessionCapture) open() error {
+
+    f, err := os.OpenFile(c.filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+    if err != nil {
+        return err
+    }
+    info, err := f.Stat()
+    if err == nil {
+        c.bytes = info.Size()
+    }
+    c.file = f
+
+    // Note the start of each session, which makes it easy to find restarts
+    hdr := fmt.Sprintf("# TTGate capture opened %s\n", time.Now().UTC().Format(captureTimeFormat))
+    n, _ := c.file.WriteString(hdr)
+    c.bytes += int64(n)
+
+    return nil
+
+}
+
+// Record a line sent to or received from the module.  We write synchronously and
+// unbuffered, because the most interesting captures are those that end in an exit.
+func (c *sessionCapture) Line(direction byte, line []byte) {
+
+    if c == nil {
+        return
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if c.file == nil {
+        return
+    }
+
+    // Keep the capture from filling the disk by rolling over to a single backup
+    if c.bytes >= c.maxBytes {
+        c.file.Close()
+        c.file = nil
+        os.Rename(c.filename, c.filename + ".1")
+        if c.open() != nil {
+            return
+        }
+    }
+
+    rec := fmt.Sprintf("%s %c %s\n", time.Now().UTC().Format(captureTimeFormat), direction, line)
+    n, err := c.file.WriteString(rec)
+    if err != nil {
+        go fmt.Printf("capture: write error %v\n", err)
+    }
+    c.bytes += int64(n)
+
+}
+
+// Load all records from a capture file
+func captureLoad(filename string) (records []captureRecord, err error) {
+
+    f, err := os.Open(filename)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    scanner := bufio.NewScanner(f)
+    lineno := 0
+    for scanner.Scan() {
+        lineno++
+        text := scanner.Text()
+        if text == "" || strings.HasPrefix(text, "#") {
+            continue
+        }
+        rec, err := captureParse(text)
+        if err != nil {
+            return nil, fmt.Errorf("%s:%d: %v", filename, lineno, err)
+        }
+        records = append(records, rec)
+    }
+
+    return records, scanner.Err()
+
+}
+
+// Parse a single capture file record
+func captureParse(text string) (rec captureRecord, err error) {
+
+    fields := strings.SplitN(text, " ", 3)
+    if len(fields) < 2 || len(fields[1]) != 1 {
+        return rec, errors.New("malformed record")
+    }
+
+    rec.At, err = time.Parse(captureTimeFormat, fields[0])
+    if err != nil {
+        return rec, err
+    }
+
+    rec.Direction = fields[1][0]
+    if rec.Direction != captureSent && rec.Direction != captureReceived {
+        return rec, errors.New("unknown direction")
+    }
+
+    if len(fields) == 3 {
+        rec.Line = []byte(fields[2])
+    }
+
+    return rec, nil
+
+}
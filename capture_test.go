@@ -0,0 +1,191 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+// Create a directory for capture files, which the caller removes
+func captureTestDir(t *testing.T) string {
+    dir, err := ioutil.TempDir("", "ttgate-capture")
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    return dir
+}
+
+// Begin capturing to a file, as configured by the environment
+func captureTestStart(t *testing.T, filename string, maxBytes int) (*loraRadio, *sessionCapture) {
+    os.Setenv("CAPTURE", filename)
+    os.Setenv("CAPTURE_MAX_BYTES", fmt.Sprintf("%d", maxBytes))
+    defer os.Unsetenv("CAPTURE")
+    defer os.Unsetenv("CAPTURE_MAX_BYTES")
+    r := newLoraRadio("test", 0)
+    r.capture = captureInit(r)
+    if r.capture == nil {
+        t.Fatalf("not capturing to %s", filename)
+    }
+    return r, r.capture
+}
+
+// Stop capturing, as though we'd exited
+func captureTestStop(c *sessionCapture) {
+    c.mu.Lock()
+    c.file.Close()
+    c.file = nil
+    c.mu.Unlock()
+}
+
+// Records are a timestamp, a direction and a line that is kept just as it was, spaces and all
+func TestCaptureParse(t *testing.T) {
+
+    at := time.Date(2017, 3, 31, 16, 21, 17, 528002000, time.UTC)
+    tests := []struct {
+        text string
+        direction byte
+        line string
+        bad bool
+    }{
+        {"2017-03-31T16:21:17.528002000Z > sys get ver", captureSent, "sys get ver", false},
+        {"2017-03-31T16:21:17.528002000Z < RN2483 1.0.1 Dec 15 2015 09:38:09", captureReceived, "RN2483 1.0.1 Dec 15 2015 09:38:09", false},
+        {"2017-03-31T16:21:17.528002000Z < radio_rx  48656C6C6F", captureReceived, "radio_rx  48656C6C6F", false},
+        {"2017-03-31T16:21:17.528002000Z < ", captureReceived, "", false},
+        {"2017-03-31T16:21:17.528002000Z <", captureReceived, "", false},
+        {"2017-03-31T16:21:17.528002000Z", 0, "", true},
+        {"2017-03-31T16:21:17.528002000Z >> sys get ver", 0, "", true},
+        {"2017-03-31T16:21:17.528002000Z = sys get ver", 0, "", true},
+        {"2017-03-31 16:21:17 > sys get ver", 0, "", true},
+        {"yesterday > sys get ver", 0, "", true},
+    }
+
+    for _, test := range tests {
+        rec, err := captureParse(test.text)
+        if test.bad {
+            if err == nil {
+                t.Errorf("%q: parsed as %c %q", test.text, rec.Direction, rec.Line)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("%q: %v", test.text, err)
+            continue
+        }
+        if !rec.At.Equal(at) || rec.Direction != test.direction || string(rec.Line) != test.line {
+            t.Errorf("%q: parsed as %s %c %q", test.text, rec.At, rec.Direction, rec.Line)
+        }
+    }
+
+}
+
+// A capture file is loaded without its comments and blank lines, and a bad record is reported by its line number
+func TestCaptureLoad(t *testing.T) {
+
+    dir := captureTestDir(t)
+    defer os.RemoveAll(dir)
+
+    good := filepath.Join(dir, "good")
+    ioutil.WriteFile(good, []byte("# TTGate capture opened 2017-03-31T16:21:17.000000000Z\n" +
+        "2017-03-31T16:21:17.100000000Z > sys get ver\n" +
+        "\n" +
+        "2017-03-31T16:21:17.200000000Z < RN2483 1.0.1 Dec 15 2015 09:38:09\n" +
+        "# TTGate capture opened 2017-03-31T16:22:00.000000000Z\n" +
+        "2017-03-31T16:22:00.100000000Z > sys get hweui\n"), 0644)
+    records, err := captureLoad(good)
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    want := []string{"> sys get ver", "< RN2483 1.0.1 Dec 15 2015 09:38:09", "> sys get hweui"}
+    if len(records) != len(want) {
+        t.Fatalf("%d records, want %d", len(records), len(want))
+    }
+    for i, rec := range records {
+        if fmt.Sprintf("%c %s", rec.Direction, rec.Line) != want[i] {
+            t.Errorf("record %d is %c %s, want %s", i, rec.Direction, rec.Line, want[i])
+        }
+    }
+    if records[1].At.Sub(records[0].At) != 100 * time.Millisecond {
+        t.Errorf("records %s apart", records[1].At.Sub(records[0].At))
+    }
+
+    bad := filepath.Join(dir, "bad")
+    ioutil.WriteFile(bad, []byte("# TTGate capture opened 2017-03-31T16:21:17.000000000Z\n" +
+        "2017-03-31T16:21:17.100000000Z > sys get ver\n" +
+        "2017-03-31T16:21:17.200000000Z ? RN2483\n"), 0644)
+    records, err = captureLoad(bad)
+    if err == nil || records != nil || !strings.HasPrefix(err.Error(), bad + ":3: ") {
+        t.Errorf("loaded %d records with %v", len(records), err)
+    }
+
+    _, err = captureLoad(filepath.Join(dir, "missing"))
+    if err == nil {
+        t.Errorf("loaded a missing file")
+    }
+
+}
+
+// Once a capture reaches its maximum size it rolls over to a single backup, so that between the two
+// files the most recent records are kept, in order, and each file loads on its own
+func TestCaptureRollover(t *testing.T) {
+
+    dir := captureTestDir(t)
+    defer os.RemoveAll(dir)
+    filename := filepath.Join(dir, "capture")
+
+    r, c := captureTestStart(t, filename, 1000)
+    lines := 100
+    for i := 0; i < lines; i++ {
+        r.trace(i % 2 == 0, []byte(fmt.Sprintf("line %d", i)))
+    }
+    captureTestStop(c)
+
+    backup, err := captureLoad(filename + ".1")
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    current, err := captureLoad(filename)
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    records := append(backup, current...)
+    if len(backup) == 0 || len(current) == 0 || len(records) >= lines {
+        t.Fatalf("%d records in the backup and %d in the capture", len(backup), len(current))
+    }
+    for i, rec := range records {
+        n := lines - len(records) + i
+        direction := byte(captureReceived)
+        if n % 2 == 0 {
+            direction = captureSent
+        }
+        if string(rec.Line) != fmt.Sprintf("line %d", n) || rec.Direction != direction {
+            t.Fatalf("record %d is %c %s, want line %d", i, rec.Direction, rec.Line, n)
+        }
+        if i > 0 && rec.At.Before(records[i-1].At) {
+            t.Fatalf("record %d is out of order", i)
+        }
+    }
+
+    // Neither file grew much past the maximum, and each begins by noting that it was opened
+    for _, name := range []string{filename, filename + ".1"} {
+        contents, err := ioutil.ReadFile(name)
+        if err != nil {
+            t.Fatalf("%v", err)
+        }
+        if len(contents) > 1100 || !strings.HasPrefix(string(contents), "# TTGate capture opened ") {
+            t.Errorf("%s is %d bytes beginning %q", name, len(contents), strings.SplitN(string(contents), "\n", 2)[0])
+        }
+    }
+
+    // Without a capture, nothing is recorded
+    var none *sessionCapture
+    none.Line(captureSent, []byte("sys get ver"))
+
+}
@@ -0,0 +1,163 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Configuration of the emulated Microchip RN2483/RN2903, for integration testing and demos
+package main
+
+import (
+    "encoding/binary"
+    "fmt"
+    "os"
+    "strconv"
+    "time"
+    "github.com/golang/protobuf/proto"
+    "github.com/safecast/ttproto/golang"
+    "github.com/Safecast/TTGate/lpwan"
+)
+
+// Open the emulator specified by the EMULATE environment variable, if any, returning
+// the emulator and the options by which the radio's controller should talk to it
+func ioOpenEmulator(r *loraRadio) (e *lpwan.Emulator, options []lpwan.Option) {
+
+    model := getenvList("EMULATE", r.index)
+    if model == "" {
+        return nil, nil
+    }
+    e = lpwan.NewEmulator(model)
+
+    // Each module has its own EUI
+    if r.index > 0 {
+        e.SetHWEUI(fmt.Sprintf("%s%02X", e.HWEUI()[:14], r.index))
+    }
+
+    // Optionally speed up emulated time, which is handy for demos of the watchdogs, and
+    // have the controller keep pace rather than letting the module settle in real time
+    s := os.Getenv("EMULATE_TIME_SCALE")
+    if s != "" {
+        f, err := strconv.ParseFloat(s, 64)
+        if err == nil && f > 0 {
+            e.SetTimeScale(f)
+            options = append(options, lpwan.WithTimeScale(f))
+        }
+    }
+
+    // Optionally emulate different firmware
+    s = os.Getenv("EMULATE_VERSION")
+    if s != "" {
+        e.SetVersion(s)
+    }
+
+    // Optionally start out in a failure mode that we've seen in the field
+    switch os.Getenv("EMULATE_FAULT") {
+    case "wedge":
+        e.Wedge(true)
+    case "stall":
+        e.StallReceive(true)
+    case "busy":
+        e.BusyStorm(1000)
+    }
+
+    // Optionally generate synthetic traffic
+    s = os.Getenv("EMULATE_RX_SECONDS")
+    if s != "" {
+        i, err := strconv.Atoi(s)
+        if err == nil && i > 0 {
+            go emulatorTraffic(e, time.Duration(i) * time.Second, getenvInt("EMULATE_BATCH", 1))
+        }
+    }
+
+    // Optionally generate LoRaWAN uplinks from a device with the specified DevAddr, in hex
+    s = os.Getenv("EMULATE_LORAWAN_DEVADDR")
+    if s != "" {
+        devAddr, err := strconv.ParseUint(s, 16, 32)
+        if err == nil {
+            go emulatorLoRaWANTraffic(e, time.Duration(getenvInt("EMULATE_LORAWAN_SECONDS", 30)) * time.Second, uint32(devAddr))
+        }
+    }
+
+    r.logf("Emulating %s\n", e.Model())
+
+    // Either talk to it through a pseudo-terminal so that the serial path is exercised, or in-process
+    if os.Getenv("EMULATE_PTY") != "" {
+        path, err := e.ServePty()
+        if err != nil {
+            r.logf("emulator: cannot create pty: %v\n", err)
+            return nil, nil
+        }
+        r.logf("Emulator attached to %s\n", path)
+        return e, append(options, lpwan.WithSerialPort(path))
+    }
+
+    return e, append(options, lpwan.WithTransport(e))
+
+}
+
+// Periodically generate synthetic Safecast measurements, so that the display has something to show.
+// Several may be batched into each transmission, as newer device firmware does to save airtime.
+func emulatorTraffic(e *lpwan.Emulator, interval time.Duration, batch int) {
+    deviceID := uint32(random(10000, 20000))
+    for {
+        time.Sleep(interval)
+        pbs := [][]byte{}
+        for i := 0; i < batch; i++ {
+            msg := &ttproto.Telecast{}
+            msg.DeviceId = proto.Uint32(deviceID)
+            msg.Lnd_7318U = proto.Uint32(uint32(random(20, 40)))
+            msg.CapturedAt = proto.String(time.Now().UTC().Add(time.Duration(i - batch + 1) * interval / time.Duration(batch)).Format(time.RFC3339))
+            data, err := proto.Marshal(msg)
+            if err == nil {
+                pbs = append(pbs, data)
+            }
+        }
+        frame, err := encodePBArray(pbs...)
+        if err != nil {
+            go fmt.Printf("emulator: %v\n", err)
+            continue
+        }
+        e.Receive(frame)
+    }
+}
+
+// Periodically generate unconfirmed LoRaWAN uplinks, as a neighboring LoRaWAN device would.  If the
+// device is one of the ABP devices that we decode ourselves, its uplinks are properly encrypted
+// compact Safecast measurements, or Cayenne LPP if EMULATE_LORAWAN_LPP is set.  Otherwise they
+// can't be verified by a network server, which doesn't know the device, but they exercise forwarding.
+func emulatorLoRaWANTraffic(e *lpwan.Emulator, interval time.Duration, devAddr uint32) {
+    deviceID := uint32(random(20000, 30000))
+    fcnt := uint32(0)
+    for {
+        time.Sleep(interval)
+        frame := []byte{lorawanUnconfirmedUp << 5, 0, 0, 0, 0, 0, 0, 0, 1}
+        binary.LittleEndian.PutUint32(frame[1:5], devAddr)
+        binary.LittleEndian.PutUint16(frame[6:8], uint16(fcnt))
+        session := lorawanSessionFind(devAddr)
+        if session == nil {
+            for i := 0; i < 8; i++ {
+                frame = append(frame, byte(random(0, 255)))
+            }
+            frame = append(frame, 0, 0, 0, 0)
+        } else if os.Getenv("EMULATE_LORAWAN_LPP") != "" {
+            // Temperature on channel 1, humidity on channel 2, and an analog input on channel 3
+            temp := uint16(random(150, 300))
+            payload := []byte{1, 103, byte(temp >> 8), byte(temp), 2, 104, byte(random(60, 160)), 3, 2, 0x01, byte(random(0, 255))}
+            frame = append(frame, lorawanCrypt(session.AppSKey, 0, devAddr, fcnt, payload)...)
+            b0 := lorawanBlock(0x49, 0, devAddr, fcnt, byte(len(frame)))
+            frame = append(frame, aesCMAC(session.NwkSKey, append(b0, frame...))[:4]...)
+        } else {
+            payload := make([]byte, 1 + compactRecordLength)
+            payload[0] = buffFormatCompact
+            binary.BigEndian.PutUint32(payload[1:], deviceID)
+            binary.BigEndian.PutUint32(payload[5:], uint32(time.Now().Unix()))
+            binary.BigEndian.PutUint16(payload[9:], uint16(random(20, 40)))
+            binary.BigEndian.PutUint16(payload[11:], compactAbsent)
+            binary.BigEndian.PutUint16(payload[13:], compactAbsent)
+            binary.BigEndian.PutUint16(payload[15:], compactAbsentTemp)
+            frame = append(frame, lorawanCrypt(session.AppSKey, 0, devAddr, fcnt, payload)...)
+            b0 := lorawanBlock(0x49, 0, devAddr, fcnt, byte(len(frame)))
+            frame = append(frame, aesCMAC(session.NwkSKey, append(b0, frame...))[:4]...)
+        }
+        e.Receive(frame)
+        fcnt++
+    }
+}
@@ -0,0 +1,197 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Decoding of the frames that devices send over the air
+package main
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+    "github.com/golang/protobuf/proto"
+    "github.com/safecast/ttproto/golang"
+)
+
+// Kinds of frame errors, each of which is counted in stats
+const (
+    frameErrEmpty = "empty"                     // The module reported a frame with no payload
+    frameErrBadHex = "bad_hex"                  // The module's hex was garbled
+    frameErrOddHex = "odd_hex"                  // The module's hex was cut short in the middle of a byte
+    frameErrTruncated = "truncated"             // Too short to hold its header
+    frameErrLengthOverflow = "length_overflow"  // A payload length runs past the end of the frame
+    frameErrProtobuf = "protobuf"               // A payload isn't a Telecast protocol buffer
+    frameErrMalformed = "malformed"             // A payload in one of the other formats couldn't be parsed
+    frameErrUnknownFormat = "unknown_format"    // Not a format we know, such as a neighbor's LoRaWAN packet
+)
+
+// frameError describes why a received frame couldn't be decoded
+type frameError struct {
+    Kind string
+    Detail string
+}
+
+// Error describes the error
+func (e *frameError) Error() string {
+    return e.Kind + ": " + e.Detail
+}
+
+// frameMessage is a Telecast message decoded from a frame, along with the protocol buffer that it was decoded from
+// or, for formats other than PB_ARRAY, to which it was normalized
+type frameMessage struct {
+    Msg *ttproto.Telecast
+    PB []byte
+}
+
+// frameDecoder decodes the body of a frame, which follows its format byte, into the Telecast messages that it carries
+type frameDecoder func(body []byte) ([]frameMessage, error)
+
+// frameFormat is a registered format
+type frameFormat struct {
+    Name string
+    Decode frameDecoder
+}
+
+// Statics
+var frameErrorsMutex sync.Mutex
+var frameErrors = map[string]uint32{}
+var frameFormats = map[byte]frameFormat{}
+
+// Register the protocol buffer format, which every device speaks
+func init() {
+    registerFrameDecoder(buffFormatPBArray, "pb_array", decodePBArray)
+}
+
+// Register the decoder for a format.  Decoders are registered at init time, before any frame is received.
+func registerFrameDecoder(format byte, name string, decoder frameDecoder) {
+    _, present := frameFormats[format]
+    if present {
+        panic(fmt.Sprintf("frame format %d registered twice", format))
+    }
+    frameFormats[format] = frameFormat{Name: name, Decode: decoder}
+}
+
+// Decode a frame received over the air into the Telecast messages that it carries.  Frames come
+// from anything within earshot that happens to be on our channel, so nothing about them is trusted.
+func decodeFrame(buf []byte) (msgs []frameMessage, err error) {
+
+    if len(buf) < 1 {
+        return nil, &frameError{frameErrTruncated, "empty frame"}
+    }
+
+    f, present := frameFormats[buf[0]]
+    if !present {
+        return nil, &frameError{frameErrUnknownFormat, fmt.Sprintf("format %d", buf[0])}
+    }
+
+    msgs, err = f.Decode(buf[1:])
+    if err != nil {
+        return nil, err
+    }
+    if len(msgs) == 0 {
+        return nil, &frameError{frameErrTruncated, f.Name + " frame with no messages"}
+    }
+    return msgs, nil
+
+}
+
+// Decode the body of a PB_ARRAY frame
+func decodePBArray(body []byte) (msgs []frameMessage, err error) {
+
+    // The header is the count of protocol buffers, and then the length of each
+    if len(body) < 1 {
+        return nil, &frameError{frameErrTruncated, "no count"}
+    }
+    count := int(body[0])
+    if count == 0 {
+        return nil, &frameError{frameErrTruncated, "no protocol buffers"}
+    }
+    lengthArrayOffset := 1
+    payloadOffset := lengthArrayOffset + count
+    if len(body) < payloadOffset {
+        return nil, &frameError{frameErrTruncated, fmt.Sprintf("%d lengths in %d bytes", count, len(body))}
+    }
+
+    // The protocol buffers are packed one after another, in the order of their lengths
+    for i := 0; i < count; i++ {
+        length := int(body[lengthArrayOffset+i])
+        if payloadOffset + length > len(body) {
+            return nil, &frameError{frameErrLengthOverflow, fmt.Sprintf("%d bytes at %d of %d", length, payloadOffset, len(body))}
+        }
+        pb := body[payloadOffset:payloadOffset+length]
+        msg := &ttproto.Telecast{}
+        err = proto.Unmarshal(pb, msg)
+        if err != nil {
+            return nil, &frameError{frameErrProtobuf, fmt.Sprintf("protocol buffer %d: %v", i, err)}
+        }
+        msgs = append(msgs, frameMessage{Msg: msg, PB: pb})
+        payloadOffset += length
+    }
+    return msgs, nil
+
+}
+
+// Normalize a message decoded from a format other than PB_ARRAY, by encoding the protocol buffer
+// with which it is displayed, forwarded and logged just as if the device had sent it that way
+func newFrameMessage(msg *ttproto.Telecast) (frameMessage, error) {
+    if msg.DeviceId == nil || *msg.DeviceId == 0 {
+        return frameMessage{}, &frameError{frameErrMalformed, "no device_id"}
+    }
+    pb, err := proto.Marshal(msg)
+    if err != nil {
+        return frameMessage{}, &frameError{frameErrProtobuf, err.Error()}
+    }
+    if len(pb) > 255 {
+        return frameMessage{}, &frameError{frameErrMalformed, fmt.Sprintf("%d-byte message is too long to forward", len(pb))}
+    }
+    return frameMessage{Msg: msg, PB: pb}, nil
+}
+
+// Encode protocol buffers as a PB_ARRAY frame, whose count and lengths are single bytes
+func encodePBArray(pbs ...[]byte) ([]byte, error) {
+    if len(pbs) > 255 {
+        return nil, fmt.Errorf("%d protocol buffers is too many for one frame", len(pbs))
+    }
+    frame := []byte{buffFormatPBArray, byte(len(pbs))}
+    for _, pb := range pbs {
+        if len(pb) > 255 {
+            return nil, fmt.Errorf("%d-byte protocol buffer is too long for a frame", len(pb))
+        }
+        frame = append(frame, byte(len(pb)))
+    }
+    for _, pb := range pbs {
+        frame = append(frame, pb...)
+    }
+    return frame, nil
+}
+
+// Count a frame that couldn't be decoded
+func frameErrorCount(err error) {
+    kind := frameErrUnknownFormat
+    fe, isFrameError := err.(*frameError)
+    if isFrameError {
+        kind = fe.Kind
+    }
+    frameErrorsMutex.Lock()
+    frameErrors[kind]++
+    frameErrorsMutex.Unlock()
+}
+
+// Describe how many frames couldn't be decoded, by kind of error
+func cmdGetFrameErrorStats() string {
+    frameErrorsMutex.Lock()
+    defer frameErrorsMutex.Unlock()
+    kinds := []string{}
+    for kind := range frameErrors {
+        kinds = append(kinds, kind)
+    }
+    sort.Strings(kinds)
+    s := ""
+    for _, kind := range kinds {
+        if s != "" {
+            s += ","
+        }
+        s += fmt.Sprintf("%s:%d", kind, frameErrors[kind])
+    }
+    return s
+}
@@ -0,0 +1,364 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+    "encoding/binary"
+    "encoding/hex"
+    "fmt"
+    "reflect"
+    "strings"
+    "testing"
+    "github.com/golang/protobuf/proto"
+    "github.com/safecast/ttproto/golang"
+    "github.com/Safecast/TTGate/lpwan"
+)
+
+// The kinds of error that a frame may be counted as
+var frameErrKinds = map[string]bool{
+    frameErrEmpty: true,
+    frameErrBadHex: true,
+    frameErrOddHex: true,
+    frameErrTruncated: true,
+    frameErrLengthOverflow: true,
+    frameErrProtobuf: true,
+    frameErrMalformed: true,
+    frameErrUnknownFormat: true,
+}
+
+// Decode a frame as reported by the module, in hex, the way that the radio does
+func decodeHexFrame(text []byte) ([]frameMessage, error) {
+    buf, err := hex.DecodeString(string(text))
+    if err != nil {
+        return nil, &frameError{frameErrBadHex, err.Error()}
+    }
+    return decodeFrame(buf)
+}
+
+// A valid PB_ARRAY frame carrying a single message
+func testPBArrayFrame(t testing.TB) []byte {
+    pb, err := proto.Marshal(&ttproto.Telecast{DeviceId: proto.Uint32(1234), Lnd_7318U: proto.Uint32(31)})
+    if err != nil {
+        t.Fatalf("marshal: %v", err)
+    }
+    frame, err := encodePBArray(pb)
+    if err != nil {
+        t.Fatalf("encode: %v", err)
+    }
+    return frame
+}
+
+// A valid compact frame carrying a single record
+func testCompactFrame() []byte {
+    frame := make([]byte, 1 + compactRecordLength)
+    frame[0] = buffFormatCompact
+    binary.BigEndian.PutUint32(frame[1:], 1234)
+    binary.BigEndian.PutUint32(frame[5:], 1500000000)
+    binary.BigEndian.PutUint16(frame[9:], 31)
+    binary.BigEndian.PutUint16(frame[11:], compactAbsent)
+    binary.BigEndian.PutUint16(frame[13:], compactAbsent)
+    binary.BigEndian.PutUint16(frame[15:], compactAbsentTemp)
+    return frame
+}
+
+// Check that a frame either decodes into messages with device IDs or fails with a known kind of error
+func checkDecodedFrame(t *testing.T, msgs []frameMessage, err error) {
+    if err != nil {
+        fe, isFrameError := err.(*frameError)
+        if !isFrameError {
+            t.Fatalf("%T error: %v", err, err)
+        }
+        if !frameErrKinds[fe.Kind] {
+            t.Fatalf("unknown kind of error: %v", fe)
+        }
+        if msgs != nil {
+            t.Fatalf("messages along with error %v", fe)
+        }
+        return
+    }
+    if len(msgs) == 0 {
+        t.Fatalf("no messages and no error")
+    }
+    for _, m := range msgs {
+        if m.Msg == nil || len(m.PB) > 255 {
+            t.Fatalf("message %v with %d-byte protocol buffer", m.Msg, len(m.PB))
+        }
+    }
+}
+
+// A compact frame carrying a record with every field, and one with every field absent
+func testCompactFrameSentinels() []byte {
+    frame := []byte{buffFormatCompact}
+    record := make([]byte, compactRecordLength)
+    binary.BigEndian.PutUint32(record[0:], 1234)
+    binary.BigEndian.PutUint32(record[4:], 1500000000)
+    binary.BigEndian.PutUint16(record[8:], 31)
+    binary.BigEndian.PutUint16(record[10:], 12)
+    binary.BigEndian.PutUint16(record[12:], 4100)
+    binary.BigEndian.PutUint16(record[14:], uint16(0x10000 - 1250))
+    frame = append(frame, record...)
+    binary.BigEndian.PutUint32(record[0:], 5678)
+    binary.BigEndian.PutUint32(record[4:], 0)
+    binary.BigEndian.PutUint16(record[8:], compactAbsent)
+    binary.BigEndian.PutUint16(record[10:], compactAbsent)
+    binary.BigEndian.PutUint16(record[12:], compactAbsent)
+    binary.BigEndian.PutUint16(record[14:], compactAbsentTemp)
+    return append(frame, record...)
+}
+
+// A CBOR frame carrying a map with unsigned and negative integers, half and single precision floats, and a string
+func testCBORFrame() []byte {
+    frame := []byte{buffFormatCBOR, 0xa6}
+    frame = append(frame, 0x69)
+    frame = append(frame, "device_id"...)
+    frame = append(frame, 0x19, 0x04, 0xd2)
+    frame = append(frame, 0x69)
+    frame = append(frame, "lnd_7318u"...)
+    frame = append(frame, 0x18, 0x1f)
+    frame = append(frame, 0x68)
+    frame = append(frame, "altitude"...)
+    frame = append(frame, 0x38, 0x09)
+    frame = append(frame, 0x68)
+    frame = append(frame, "env_temp"...)
+    frame = append(frame, 0xf9, 0xbe, 0x00)
+    frame = append(frame, 0x6b)
+    frame = append(frame, "bat_voltage"...)
+    frame = append(frame, 0xfa, 0x40, 0x83, 0x33, 0x33)
+    frame = append(frame, 0x6b)
+    frame = append(frame, "captured_at"...)
+    frame = append(frame, 0x74)
+    return append(frame, "2017-07-14T02:40:00Z"...)
+}
+
+// Describe the fields in which two messages differ
+func telecastDiffs(got *ttproto.Telecast, want *ttproto.Telecast) (diffs []string) {
+    g := reflect.ValueOf(got).Elem()
+    w := reflect.ValueOf(want).Elem()
+    for i := 0; i < g.NumField(); i++ {
+        name := g.Type().Field(i).Name
+        if strings.HasPrefix(name, "XXX_") {
+            continue
+        }
+        gf, wf := g.Field(i), w.Field(i)
+        if !reflect.DeepEqual(gf.Interface(), wf.Interface()) {
+            diffs = append(diffs, fmt.Sprintf("%s is %s, want %s", name, telecastField(gf), telecastField(wf)))
+        }
+    }
+    return diffs
+}
+
+// Describe a field, which is nil if absent
+func telecastField(v reflect.Value) string {
+    if v.Kind() == reflect.Ptr {
+        if v.IsNil() {
+            return "absent"
+        }
+        v = v.Elem()
+    }
+    return fmt.Sprintf("%v", v.Interface())
+}
+
+// Frames decode as expected, and fail with the expected kind of error
+func TestDecodeFrame(t *testing.T) {
+
+    tests := []struct {
+        name string
+        frame []byte
+        kind string
+        messages int
+        want []*ttproto.Telecast
+    }{
+        {"pb_array", testPBArrayFrame(t), "", 1, []*ttproto.Telecast{
+            {DeviceId: proto.Uint32(1234), Lnd_7318U: proto.Uint32(31)},
+        }},
+        {"cbor", testCBORFrame(), "", 1, []*ttproto.Telecast{
+            {DeviceId: proto.Uint32(1234), Lnd_7318U: proto.Uint32(31), Altitude: proto.Int32(-10), EnvTemp: proto.Float32(-1.5),
+                BatVoltage: proto.Float32(4.1), CapturedAt: proto.String("2017-07-14T02:40:00Z")},
+        }},
+        {"compact", testCompactFrame(), "", 1, []*ttproto.Telecast{
+            {DeviceId: proto.Uint32(1234), Lnd_7318U: proto.Uint32(31), CapturedAt: proto.String("2017-07-14T02:40:00Z")},
+        }},
+        {"compact sentinels", testCompactFrameSentinels(), "", 2, []*ttproto.Telecast{
+            {DeviceId: proto.Uint32(1234), Lnd_7318U: proto.Uint32(31), Lnd_7128Ec: proto.Uint32(12), BatVoltage: proto.Float32(4.1),
+                EnvTemp: proto.Float32(-12.5), CapturedAt: proto.String("2017-07-14T02:40:00Z")},
+            {DeviceId: proto.Uint32(5678)},
+        }},
+        {"json object", append([]byte{buffFormatJSON}, ` {"device_id":1234,"lnd_7318u":31,"bat_voltage":4.1,"captured_at":"2017-07-14T02:40:00Z","unknown":1} `...), "", 1, []*ttproto.Telecast{
+            {DeviceId: proto.Uint32(1234), Lnd_7318U: proto.Uint32(31), BatVoltage: proto.Float32(4.1), CapturedAt: proto.String("2017-07-14T02:40:00Z")},
+        }},
+        {"json array", append([]byte{buffFormatJSON}, `[{"device_id":1234},{"device_id":5678,"lnd_7128ec":12,"env_temp":-12.5}]`...), "", 2, []*ttproto.Telecast{
+            {DeviceId: proto.Uint32(1234)},
+            {DeviceId: proto.Uint32(5678), Lnd_7128Ec: proto.Uint32(12), EnvTemp: proto.Float32(-12.5)},
+        }},
+        {"empty", []byte{}, frameErrTruncated, 0, nil},
+        {"no count", []byte{buffFormatPBArray}, frameErrTruncated, 0, nil},
+        {"missing lengths", []byte{buffFormatPBArray, 3, 1}, frameErrTruncated, 0, nil},
+        {"length overflow", []byte{buffFormatPBArray, 1, 10, 0x18}, frameErrLengthOverflow, 0, nil},
+        {"bad protobuf", []byte{buffFormatPBArray, 1, 2, 0xff, 0xff}, frameErrProtobuf, 0, nil},
+        {"json without device", append([]byte{buffFormatJSON}, `{"lnd_7318u":31}`...), frameErrMalformed, 0, nil},
+        {"compact partial record", testCompactFrameSentinels()[:1 + compactRecordLength + 3], frameErrLengthOverflow, 0, nil},
+        {"cbor trailing bytes", append(testCBORFrame(), 0x00), frameErrMalformed, 0, nil},
+        {"lorawan", []byte{0x40, 0x04, 0x03, 0x02, 0x01, 0x80, 0x01, 0x00, 0x01, 0xa6, 0x94, 0x64, 0x26, 0x15, 0xd6, 0xc3, 0xb5, 0x82}, frameErrUnknownFormat, 0, nil},
+    }
+
+    for _, test := range tests {
+        msgs, err := decodeFrame(test.frame)
+        kind := ""
+        fe, isFrameError := err.(*frameError)
+        if isFrameError {
+            kind = fe.Kind
+        } else if err != nil {
+            kind = err.Error()
+        }
+        if kind != test.kind || len(msgs) != test.messages {
+            t.Errorf("%s: %d messages with error %q, want %d with %q", test.name, len(msgs), kind, test.messages, test.kind)
+            continue
+        }
+
+        // Each message is as expected, as is the protocol buffer that it's forwarded as
+        for i := 0; i < len(msgs) && i < len(test.want); i++ {
+            for _, diff := range telecastDiffs(msgs[i].Msg, test.want[i]) {
+                t.Errorf("%s: message %d: %s", test.name, i, diff)
+            }
+            forwarded := &ttproto.Telecast{}
+            err = proto.Unmarshal(msgs[i].PB, forwarded)
+            if err != nil {
+                t.Errorf("%s: message %d: %v", test.name, i, err)
+                continue
+            }
+            for _, diff := range telecastDiffs(forwarded, test.want[i]) {
+                t.Errorf("%s: message %d forwarded with %s", test.name, i, diff)
+            }
+        }
+    }
+
+}
+
+// A PB_ARRAY frame's count and lengths are single bytes, so more or longer protocol buffers can't be encoded
+func TestEncodePBArray(t *testing.T) {
+
+    tests := []struct {
+        count int
+        length int
+        ok bool
+    }{
+        {0, 0, true},
+        {1, 255, true},
+        {255, 1, true},
+        {1, 256, false},
+        {256, 1, false},
+    }
+
+    for _, test := range tests {
+        pbs := make([][]byte, test.count)
+        for i := range pbs {
+            pbs[i] = make([]byte, test.length)
+        }
+        frame, err := encodePBArray(pbs...)
+        if (err == nil) != test.ok {
+            t.Errorf("%d of %d bytes: error %v", test.count, test.length, err)
+            continue
+        }
+        if err == nil && (len(frame) != 2 + test.count * (1 + test.length) || int(frame[1]) != test.count) {
+            t.Errorf("%d of %d bytes: %d-byte frame", test.count, test.length, len(frame))
+        }
+    }
+
+}
+
+// Only the first message in a frame that calls for a reply is given one
+func TestFrameReplyAllowed(t *testing.T) {
+
+    allowed := ttproto.Telecast_ALLOWED
+    ping := ttproto.Telecast_TTGATEPING
+    replying := &ttproto.Telecast{DeviceId: proto.Uint32(1), ReplyType: &allowed}
+    quiet := &ttproto.Telecast{DeviceId: proto.Uint32(1)}
+    pinging := &ttproto.Telecast{DeviceId: proto.Uint32(1), DeviceType: &ping}
+    pingback := &ttproto.Telecast{DeviceId: proto.Uint32(1), DeviceType: &ping, Message: proto.String("ping")}
+
+    tests := []struct {
+        name string
+        msgs []*ttproto.Telecast
+        want []bool
+    }{
+        {"none", []*ttproto.Telecast{quiet, quiet}, []bool{false, false}},
+        {"one", []*ttproto.Telecast{quiet, replying}, []bool{false, true}},
+        {"several", []*ttproto.Telecast{replying, quiet, replying, replying}, []bool{true, false, false, false}},
+        {"ping", []*ttproto.Telecast{pinging, replying}, []bool{true, false}},
+        {"pingback", []*ttproto.Telecast{pingback, replying}, []bool{false, true}},
+    }
+
+    for _, test := range tests {
+        msgs := []frameMessage{}
+        for _, msg := range test.msgs {
+            msgs = append(msgs, frameMessage{Msg: msg})
+        }
+        got, any := frameReplyAllowed(msgs)
+        anyWanted := false
+        for i := range got {
+            anyWanted = anyWanted || test.want[i]
+            if got[i] != test.want[i] {
+                t.Errorf("%s: reply allowed %v, want %v", test.name, got, test.want)
+                break
+            }
+        }
+        if any != anyWanted {
+            t.Errorf("%s: any reply allowed %v", test.name, any)
+        }
+    }
+
+}
+
+// Each kind of error receiving a frame is counted as its own kind of frame error
+func TestReceiveErrorCount(t *testing.T) {
+
+    for lpwanKind, kind := range receiveErrorKinds {
+        frameErrorsMutex.Lock()
+        before := frameErrors[kind]
+        frameErrorsMutex.Unlock()
+        receiveErrorCount(&lpwan.ReceiveError{Kind: lpwanKind, Detail: "test"})
+        frameErrorsMutex.Lock()
+        after := frameErrors[kind]
+        frameErrorsMutex.Unlock()
+        if !frameErrKinds[kind] || after != before + 1 {
+            t.Errorf("%s counted as %s %d times", lpwanKind, kind, after - before)
+        }
+    }
+
+}
+
+// No frame, however malformed, panics the decoder or fails with an error that can't be counted
+func FuzzDecodeFrame(f *testing.F) {
+
+    valid := testPBArrayFrame(f)
+    f.Add(valid)
+    f.Add([]byte(hex.EncodeToString(valid)))
+    f.Add(append([]byte{buffFormatPBArray, 2, byte(len(valid) - 3), byte(len(valid) - 3)}, append(valid[3:], valid[3:]...)...))
+    f.Add(append([]byte{buffFormatJSON}, `{"device_id":1234,"lnd_7318u":31}`...))
+    f.Add(testCompactFrame())
+    f.Add([]byte{buffFormatCBOR, 0xa1, 0x69, 'd', 'e', 'v', 'i', 'c', 'e', '_', 'i', 'd', 0x19, 0x04, 0xd2})
+
+    // Short and odd-length frames
+    f.Add([]byte{})
+    f.Add([]byte{buffFormatPBArray})
+    f.Add([]byte{buffFormatPBArray, 255})
+    f.Add([]byte{buffFormatPBArray, 1, 200, 0x18})
+    f.Add([]byte("000101"))
+    f.Add([]byte("0001011"))
+    f.Add([]byte("0G"))
+
+    // LoRaWAN frames, which are another format entirely
+    f.Add([]byte{0x40, 0x04, 0x03, 0x02, 0x01, 0x80, 0x01, 0x00, 0x01, 0xa6, 0x94, 0x64, 0x26, 0x15, 0xd6, 0xc3, 0xb5, 0x82})
+    f.Add([]byte{0x80, 0x12, 0x34, 0x56, 0x78, 0x00, 0x00, 0x00, 0x02, 0x01, 0x02, 0x03, 0x04})
+    f.Add([]byte("40040302018001000155B6"))
+
+    f.Fuzz(func(t *testing.T, frame []byte) {
+        msgs, err := decodeFrame(frame)
+        checkDecodedFrame(t, msgs, err)
+        msgs, err = decodeHexFrame(frame)
+        checkDecodedFrame(t, msgs, err)
+    })
+
+}
@@ -0,0 +1,256 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// CBOR frames (RFC 7049), for sensor nodes that already speak it
+package main
+
+import (
+    "encoding/binary"
+    "encoding/json"
+    "fmt"
+    "math"
+    "github.com/safecast/ttproto/golang"
+)
+
+// Limit on nesting, so that a hostile frame can't exhaust the stack
+const cborMaxDepth = 16
+
+// Register the format
+func init() {
+    registerFrameDecoder(buffFormatCBOR, "cbor", decodeCBORFrame)
+}
+
+// Decode the body of a CBOR frame, which is either a single map or an array of maps whose keys
+// are named as the fields of Telecast's JSON are.  The maps are converted to JSON and decoded
+// exactly as JSON frames are, so that the two formats can't disagree.
+func decodeCBORFrame(body []byte) (msgs []frameMessage, err error) {
+
+    d := &cborDecoder{buf: body}
+    item, err := d.item(0)
+    if err != nil {
+        return nil, err
+    }
+    if d.pos != len(body) {
+        return nil, &frameError{frameErrMalformed, fmt.Sprintf("cbor: %d bytes after the item", len(body) - d.pos)}
+    }
+
+    items, isArray := item.([]interface{})
+    if !isArray {
+        items = []interface{}{item}
+    }
+    telecasts := []*ttproto.Telecast{}
+    for _, item := range items {
+        _, isMap := item.(map[string]interface{})
+        if !isMap {
+            return nil, &frameError{frameErrMalformed, "cbor: message isn't a map"}
+        }
+        js, err := json.Marshal(item)
+        if err != nil {
+            return nil, &frameError{frameErrMalformed, "cbor: " + err.Error()}
+        }
+        msg := &ttproto.Telecast{}
+        err = json.Unmarshal(js, msg)
+        if err != nil {
+            return nil, &frameError{frameErrMalformed, "cbor: " + err.Error()}
+        }
+        telecasts = append(telecasts, msg)
+    }
+
+    return normalizeTelecasts(telecasts)
+
+}
+
+// A decoder of the subset of CBOR that sensor nodes need: integers, floats, strings, arrays,
+// maps with string keys, booleans and null.  Indefinite lengths aren't supported, and tags are ignored.
+type cborDecoder struct {
+    buf []byte
+    pos int
+}
+
+// Report a frame that ended too soon
+func (d *cborDecoder) truncated() error {
+    return &frameError{frameErrTruncated, fmt.Sprintf("cbor: ends at %d", len(d.buf))}
+}
+
+// Take the next n bytes
+func (d *cborDecoder) take(n uint64) ([]byte, error) {
+    if n > uint64(len(d.buf) - d.pos) {
+        return nil, d.truncated()
+    }
+    b := d.buf[d.pos:d.pos+int(n)]
+    d.pos += int(n)
+    return b, nil
+}
+
+// Get the argument that follows an initial byte
+func (d *cborDecoder) argument(info byte) (uint64, error) {
+    switch {
+    case info < 24:
+        return uint64(info), nil
+    case info == 24:
+        b, err := d.take(1)
+        if err != nil {
+            return 0, err
+        }
+        return uint64(b[0]), nil
+    case info == 25:
+        b, err := d.take(2)
+        if err != nil {
+            return 0, err
+        }
+        return uint64(binary.BigEndian.Uint16(b)), nil
+    case info == 26:
+        b, err := d.take(4)
+        if err != nil {
+            return 0, err
+        }
+        return uint64(binary.BigEndian.Uint32(b)), nil
+    case info == 27:
+        b, err := d.take(8)
+        if err != nil {
+            return 0, err
+        }
+        return binary.BigEndian.Uint64(b), nil
+    }
+    return 0, &frameError{frameErrMalformed, fmt.Sprintf("cbor: unsupported length %d at %d", info, d.pos)}
+}
+
+// Decode the next item
+func (d *cborDecoder) item(depth int) (interface{}, error) {
+
+    if depth > cborMaxDepth {
+        return nil, &frameError{frameErrMalformed, "cbor: nested too deeply"}
+    }
+    b, err := d.take(1)
+    if err != nil {
+        return nil, err
+    }
+    major := b[0] >> 5
+    info := b[0] & 0x1f
+
+    // Simple values and floats carry their value in place of the argument
+    if major == 7 {
+        switch info {
+        case 20:
+            return false, nil
+        case 21:
+            return true, nil
+        case 22, 23:
+            return nil, nil
+        case 25:
+            b, err := d.take(2)
+            if err != nil {
+                return nil, err
+            }
+            return cborHalfFloat(binary.BigEndian.Uint16(b)), nil
+        case 26:
+            b, err := d.take(4)
+            if err != nil {
+                return nil, err
+            }
+            return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+        case 27:
+            b, err := d.take(8)
+            if err != nil {
+                return nil, err
+            }
+            return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+        }
+        return nil, &frameError{frameErrMalformed, fmt.Sprintf("cbor: unsupported simple value %d", info)}
+    }
+
+    arg, err := d.argument(info)
+    if err != nil {
+        return nil, err
+    }
+
+    switch major {
+
+    case 0:
+        return arg, nil
+
+    case 1:
+        if arg > math.MaxInt64 {
+            return nil, &frameError{frameErrMalformed, "cbor: negative integer out of range"}
+        }
+        return -1 - int64(arg), nil
+
+    case 2:
+        return d.take(arg)
+
+    case 3:
+        s, err := d.take(arg)
+        if err != nil {
+            return nil, err
+        }
+        return string(s), nil
+
+    case 4:
+        // Every item takes at least a byte, which bounds what a hostile count can make us allocate
+        if arg > uint64(len(d.buf) - d.pos) {
+            return nil, d.truncated()
+        }
+        items := make([]interface{}, 0, int(arg))
+        for i := uint64(0); i < arg; i++ {
+            item, err := d.item(depth+1)
+            if err != nil {
+                return nil, err
+            }
+            items = append(items, item)
+        }
+        return items, nil
+
+    case 5:
+        if arg > uint64(len(d.buf) - d.pos) / 2 {
+            return nil, d.truncated()
+        }
+        m := map[string]interface{}{}
+        for i := uint64(0); i < arg; i++ {
+            key, err := d.item(depth+1)
+            if err != nil {
+                return nil, err
+            }
+            name, isString := key.(string)
+            if !isString {
+                return nil, &frameError{frameErrMalformed, "cbor: map key isn't a string"}
+            }
+            value, err := d.item(depth+1)
+            if err != nil {
+                return nil, err
+            }
+            m[name] = value
+        }
+        return m, nil
+
+    case 6:
+        return d.item(depth+1)
+
+    }
+
+    return nil, &frameError{frameErrMalformed, fmt.Sprintf("cbor: major type %d", major)}
+
+}
+
+// Convert an IEEE 754 half-precision float
+func cborHalfFloat(h uint16) float64 {
+    exp := int(h >> 10) & 0x1f
+    mant := float64(h & 0x3ff)
+    var f float64
+    switch exp {
+    case 0:
+        f = math.Ldexp(mant, -24)
+    case 31:
+        if mant == 0 {
+            f = math.Inf(1)
+        } else {
+            f = math.NaN()
+        }
+    default:
+        f = math.Ldexp(mant + 1024, exp - 25)
+    }
+    if h & 0x8000 != 0 {
+        f = -f
+    }
+    return f
+}
@@ -0,0 +1,72 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Compact fixed binary frames, for sensor nodes too small to encode protocol buffers
+package main
+
+import (
+    "encoding/binary"
+    "fmt"
+    "time"
+    "github.com/golang/protobuf/proto"
+    "github.com/safecast/ttproto/golang"
+)
+
+// Each record is big-endian and laid out as:
+//   0  uint32  device_id
+//   4  uint32  captured_at, in seconds since 1970-01-01 UTC, or 0 if the device doesn't know the time
+//   8  uint16  lnd_7318u, in CPM, or 0xFFFF if not present
+//  10  uint16  lnd_7128ec, in CPM, or 0xFFFF if not present
+//  12  uint16  bat_voltage, in millivolts, or 0xFFFF if not present
+//  14  int16   env_temp, in hundredths of a degree C, or 0x7FFF if not present
+const compactRecordLength = 16
+const compactAbsent = 0xFFFF
+const compactAbsentTemp = 0x7FFF
+
+// Register the format
+func init() {
+    registerFrameDecoder(buffFormatCompact, "compact", decodeCompactFrame)
+}
+
+// Decode the body of a compact frame, which is one or more fixed-length records back to back
+func decodeCompactFrame(body []byte) (msgs []frameMessage, err error) {
+
+    if len(body) < compactRecordLength {
+        return nil, &frameError{frameErrTruncated, fmt.Sprintf("%d bytes is less than a record", len(body))}
+    }
+    if len(body) % compactRecordLength != 0 {
+        return nil, &frameError{frameErrLengthOverflow, fmt.Sprintf("%d bytes isn't a whole number of records", len(body))}
+    }
+
+    telecasts := []*ttproto.Telecast{}
+    for offset := 0; offset < len(body); offset += compactRecordLength {
+        rec := body[offset:offset+compactRecordLength]
+        msg := &ttproto.Telecast{}
+        msg.DeviceId = proto.Uint32(binary.BigEndian.Uint32(rec[0:]))
+        capturedAt := binary.BigEndian.Uint32(rec[4:])
+        if capturedAt != 0 {
+            msg.CapturedAt = proto.String(time.Unix(int64(capturedAt), 0).UTC().Format(time.RFC3339))
+        }
+        cpm := binary.BigEndian.Uint16(rec[8:])
+        if cpm != compactAbsent {
+            msg.Lnd_7318U = proto.Uint32(uint32(cpm))
+        }
+        cpm = binary.BigEndian.Uint16(rec[10:])
+        if cpm != compactAbsent {
+            msg.Lnd_7128Ec = proto.Uint32(uint32(cpm))
+        }
+        mv := binary.BigEndian.Uint16(rec[12:])
+        if mv != compactAbsent {
+            msg.BatVoltage = proto.Float32(float32(mv) / 1000)
+        }
+        temp := int16(binary.BigEndian.Uint16(rec[14:]))
+        if temp != compactAbsentTemp {
+            msg.EnvTemp = proto.Float32(float32(temp) / 100)
+        }
+        telecasts = append(telecasts, msg)
+    }
+
+    return normalizeTelecasts(telecasts)
+
+}
@@ -0,0 +1,58 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// JSON text frames, for debug devices and for prototyping sensors whose fields aren't yet in ttproto
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "github.com/safecast/ttproto/golang"
+)
+
+// Register the format
+func init() {
+    registerFrameDecoder(buffFormatJSON, "json", decodeJSONFrame)
+}
+
+// Decode the body of a JSON frame, which is either a single object or an array of objects whose
+// fields are named as they are in Telecast's JSON, such as {"device_id":123,"lnd_7318u":31}.
+// Fields that Telecast doesn't have are ignored.
+func decodeJSONFrame(body []byte) (msgs []frameMessage, err error) {
+
+    body = bytes.TrimSpace(body)
+    if len(body) == 0 {
+        return nil, &frameError{frameErrTruncated, "no json"}
+    }
+
+    telecasts := []*ttproto.Telecast{}
+    if body[0] == '[' {
+        err = json.Unmarshal(body, &telecasts)
+    } else {
+        msg := &ttproto.Telecast{}
+        err = json.Unmarshal(body, msg)
+        telecasts = append(telecasts, msg)
+    }
+    if err != nil {
+        return nil, &frameError{frameErrMalformed, "json: " + err.Error()}
+    }
+
+    return normalizeTelecasts(telecasts)
+
+}
+
+// Normalize the messages decoded from a frame
+func normalizeTelecasts(telecasts []*ttproto.Telecast) (msgs []frameMessage, err error) {
+    for _, msg := range telecasts {
+        if msg == nil {
+            return nil, &frameError{frameErrMalformed, "null message"}
+        }
+        m, err := newFrameMessage(msg)
+        if err != nil {
+            return nil, err
+        }
+        msgs = append(msgs, m)
+    }
+    return msgs, nil
+}
@@ -0,0 +1,370 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Semtech UDP packet-forwarder protocol (GWMP), as an alternative radio frontend
+package main
+
+import (
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "math/rand"
+    "net"
+    "os"
+    "strings"
+    "sync"
+    "time"
+    "github.com/Safecast/TTGate/lpwan"
+)
+
+// GWMP protocol version and packet identifiers, as defined by Semtech's PROTOCOL.TXT
+const (
+    gwmpVersion byte = 2
+    gwmpPushData byte = 0
+    gwmpPushAck byte = 1
+    gwmpPullData byte = 2
+    gwmpPullResp byte = 3
+    gwmpPullAck byte = 4
+    gwmpTxAck byte = 5
+)
+
+// gwmpRxpk describes a packet received by the concentrator
+type gwmpRxpk struct {
+    Time        string          `json:"time,omitempty"`
+    Tmst        uint32          `json:"tmst"`
+    Chan        uint8           `json:"chan"`
+    Rfch        uint8           `json:"rfch"`
+    Freq        float64         `json:"freq"`
+    Stat        int8            `json:"stat"`
+    Modu        string          `json:"modu"`
+    Datr        string          `json:"datr"`
+    Codr        string          `json:"codr,omitempty"`
+    Rssi        int32           `json:"rssi"`
+    Lsnr        float32         `json:"lsnr"`
+    Size        uint16          `json:"size"`
+    Data        string          `json:"data"`
+}
+
+// gwmpTxpk describes a packet to be transmitted by the concentrator
+type gwmpTxpk struct {
+    Imme        bool            `json:"imme,omitempty"`
+    Tmst        uint32          `json:"tmst,omitempty"`
+    Freq        float64         `json:"freq"`
+    Rfch        uint8           `json:"rfch"`
+    Powe        int             `json:"powe"`
+    Modu        string          `json:"modu"`
+    Datr        string          `json:"datr"`
+    Codr        string          `json:"codr"`
+    Ipol        bool            `json:"ipol"`
+    Size        uint16          `json:"size"`
+    Data        string          `json:"data"`
+}
+
+// Payloads of the JSON-bearing packets
+type gwmpPushDataPayload struct {
+    Rxpk        []gwmpRxpk      `json:"rxpk,omitempty"`
+}
+type gwmpPullRespPayload struct {
+    Txpk        gwmpTxpk        `json:"txpk"`
+}
+type gwmpTxAckPayload struct {
+    TxpkAck     struct {
+        Error   string          `json:"error"`
+    }                           `json:"txpk_ack"`
+}
+
+// gwmpPacket is a decoded GWMP datagram
+type gwmpPacket struct {
+    Token uint16
+    ID byte
+    EUI []byte
+    Body []byte
+}
+
+// Errors returned when decoding GWMP datagrams
+var errGwmpShort = errors.New("gwmp: packet too short")
+var errGwmpVersion = errors.New("gwmp: unsupported protocol version")
+
+// Decode a GWMP datagram
+func gwmpDecode(buf []byte) (pkt gwmpPacket, err error) {
+
+    if len(buf) < 4 {
+        return pkt, errGwmpShort
+    }
+    if buf[0] != gwmpVersion {
+        return pkt, errGwmpVersion
+    }
+    pkt.Token = binary.BigEndian.Uint16(buf[1:3])
+    pkt.ID = buf[3]
+
+    // Packets sent by the gateway carry its EUI
+    switch pkt.ID {
+    case gwmpPushData, gwmpPullData, gwmpTxAck:
+        if len(buf) < 12 {
+            return pkt, errGwmpShort
+        }
+        pkt.EUI = buf[4:12]
+        pkt.Body = buf[12:]
+    default:
+        pkt.Body = buf[4:]
+    }
+
+    return pkt, nil
+
+}
+
+// Encode a GWMP datagram
+func gwmpEncode(pkt gwmpPacket) []byte {
+    buf := []byte{gwmpVersion, 0, 0, pkt.ID}
+    binary.BigEndian.PutUint16(buf[1:3], pkt.Token)
+    buf = append(buf, pkt.EUI...)
+    return append(buf, pkt.Body...)
+}
+
+// Statics
+var gwmpConn *net.UDPConn
+var gwmpMutex sync.Mutex
+var gwmpPullAddr *net.UDPAddr
+var gwmpLastRxpk *gwmpRxpk
+var gwmpRadio *loraRadio
+var gwmpPower int
+
+// Determine whether or not a packet forwarder is being used as the radio frontend
+func gwmpEnabled() bool {
+    return os.Getenv("GWMP_LISTEN") != ""
+}
+
+// Initialize the packet forwarder frontend, which takes the place of the Microchip module
+func gwmpInit() {
+
+    // The packet forwarder is our only radio.  Its outbound queue is drained by us rather
+    // than by the state machine, which isn't used.
+    gwmpRadio = newLoraRadio("gwmp", 0)
+    region, err := lpwan.RegionSelect(getenvList("REGION", 0), OurCountryCode, "")
+    if err != nil {
+        go fmt.Printf("*** Ignoring REGION: %v\n", err)
+    }
+    gwmpRadio.region = region
+    gwmpPower = gwmpTxPower(gwmpRadio)
+    gwmpRadio.duty = lpwan.NewDutyLedger(gwmpRadio.region)
+    gwmpRadio.outboundQueue = make(chan outboundCommand, 100) // Don't exhibit backpressure for a long time
+    radios = append(radios, gwmpRadio)
+
+    addr, err := net.ResolveUDPAddr("udp", os.Getenv("GWMP_LISTEN"))
+    if err != nil {
+        go fmt.Printf("gwmp: cannot resolve %s: %v\n", os.Getenv("GWMP_LISTEN"), err)
+        return
+    }
+    conn, err := net.ListenUDP("udp", addr)
+    if err != nil {
+        go fmt.Printf("gwmp: cannot listen on %s: %v\n", addr, err)
+        return
+    }
+    gwmpConn = conn
+
+    go fmt.Printf("Listening for packet forwarder on %s\n", addr)
+
+    go gwmpInboundMain()
+    go gwmpOutboundMain()
+
+}
+
+// Process datagrams from the packet forwarder
+func gwmpInboundMain() {
+
+    buf := make([]byte, 65536)
+    for {
+
+        n, addr, err := gwmpConn.ReadFromUDP(buf)
+        if err != nil {
+            go fmt.Printf("gwmp: read error %v\n", err)
+            continue
+        }
+
+        pkt, err := gwmpDecode(buf[:n])
+        if err != nil {
+            go fmt.Printf("%v\n", err)
+            continue
+        }
+
+        // The gateway's EUI is the closest thing we have to the module's hweui
+        if pkt.EUI != nil {
+            gwmpRadio.statsMutex.Lock()
+            if gwmpRadio.hweui == "" {
+                gwmpRadio.hweui = strings.ToUpper(hex.EncodeToString(pkt.EUI))
+            }
+            gwmpRadio.statsMutex.Unlock()
+        }
+
+        switch pkt.ID {
+
+        case gwmpPullData:
+            // Remember where to send downlinks, because that's the whole point of PULL_DATA
+            gwmpMutex.Lock()
+            gwmpPullAddr = addr
+            gwmpMutex.Unlock()
+            gwmpConn.WriteToUDP(gwmpEncode(gwmpPacket{Token: pkt.Token, ID: gwmpPullAck}), addr)
+
+        case gwmpPushData:
+            gwmpConn.WriteToUDP(gwmpEncode(gwmpPacket{Token: pkt.Token, ID: gwmpPushAck}), addr)
+            var payload gwmpPushDataPayload
+            err := json.Unmarshal(pkt.Body, &payload)
+            if err != nil {
+                go fmt.Printf("gwmp: bad PUSH_DATA: %v\n", err)
+                continue
+            }
+            for i := range payload.Rxpk {
+                gwmpProcessRxpk(payload.Rxpk[i])
+            }
+
+        case gwmpTxAck:
+            var payload gwmpTxAckPayload
+            if len(pkt.Body) != 0 && json.Unmarshal(pkt.Body, &payload) == nil {
+                if payload.TxpkAck.Error != "" && payload.TxpkAck.Error != "NONE" {
+                    go fmt.Printf("gwmp: downlink rejected: %s\n", payload.TxpkAck.Error)
+                }
+            }
+
+        }
+
+    }
+
+}
+
+// Process a single packet received by the concentrator
+func gwmpProcessRxpk(rxpk gwmpRxpk) {
+
+    data, meta, ok := gwmpRxpkFrame(rxpk)
+    if !ok {
+        return
+    }
+
+    go fmt.Printf("gwmp: rxpk %.4fMHz %s rssi %d snr %.1f\n", rxpk.Freq, rxpk.Datr, rxpk.Rssi, rxpk.Lsnr)
+
+    // Remember the channel so that downlinks go out where the device is listening
+    gwmpMutex.Lock()
+    gwmpLastRxpk = meta.Rxpk
+    gwmpMutex.Unlock()
+
+    // Process it exactly as though it had been received by the Microchip module
+    cmdProcessReceived(data, meta)
+
+    // Let the device know if the service is down, just as the state machine would
+    gwmpRadio.notifyIfServiceDown()
+
+}
+
+// Get the frame carried by a packet received by the concentrator, along with how it was received
+func gwmpRxpkFrame(rxpk gwmpRxpk) (data []byte, meta rxMetadata, ok bool) {
+
+    // Only LoRa packets with a good (or no) CRC are of interest
+    if rxpk.Stat < 0 || rxpk.Modu != "LORA" {
+        return nil, meta, false
+    }
+
+    // Some forwarders omit the base64 padding
+    data, err := base64.StdEncoding.DecodeString(rxpk.Data)
+    if err != nil {
+        data, err = base64.RawStdEncoding.DecodeString(rxpk.Data)
+    }
+    if err != nil || len(data) == 0 {
+        go fmt.Printf("gwmp: bad rxpk data: %s\n", rxpk.Data)
+        return nil, meta, false
+    }
+
+    meta = rxMetadata{Snr: rxpk.Lsnr, Rssi: rxpk.Rssi, Radio: gwmpRadio, ReceivedAt: time.Now(),
+        Freq: int(rxpk.Freq * 1000000 + 0.5), Datr: rxpk.Datr, Codr: rxpk.Codr, Rxpk: &rxpk}
+    return data, meta, true
+
+}
+
+// Transmit downlinks from the outbound queue as PULL_RESP packets
+func gwmpOutboundMain() {
+
+    for ocmd := range gwmpRadio.outboundQueue {
+
+        gwmpMutex.Lock()
+        addr := gwmpPullAddr
+        rxpk := gwmpLastRxpk
+        gwmpMutex.Unlock()
+
+        if addr == nil || (rxpk == nil && ocmd.Txpk == nil) {
+            go fmt.Printf("gwmp: no packet forwarder to send downlink to\n")
+            continue
+        }
+
+        txpk := gwmpDownlinkTxpk(ocmd, rxpk)
+
+        // The concentrator is just as bound by duty cycle as the module.  Unlike the module we
+        // can't sensibly defer, because by then the device will no longer be listening.
+        sf, bw := 12, 125
+        cr := 5
+        fmt.Sscanf(txpk.Datr, "SF%dBW%d", &sf, &bw)
+        fmt.Sscanf(txpk.Codr, "4/%d", &cr)
+        freq := int(txpk.Freq * 1000000 + 0.5)
+        airtime := lpwan.Airtime(len(ocmd.Command), sf, bw, cr, 8, true)
+        ok, _ := gwmpRadio.duty.Allowed(freq, airtime)
+        if !ok {
+            go fmt.Printf("gwmp: not transmitting %d bytes: duty cycle budget exhausted\n", len(ocmd.Command))
+            continue
+        }
+
+        body, err := json.Marshal(gwmpPullRespPayload{Txpk: txpk})
+        if err != nil {
+            continue
+        }
+        pkt := gwmpPacket{Token: uint16(rand.Intn(65536)), ID: gwmpPullResp, Body: body}
+        _, err = gwmpConn.WriteToUDP(gwmpEncode(pkt), addr)
+        if err != nil {
+            go fmt.Printf("gwmp: write error %v\n", err)
+            continue
+        }
+
+        gwmpRadio.duty.Record(freq, airtime)
+
+        go fmt.Printf("gwmp: txpk %.4fMHz %s (%d bytes)\n", txpk.Freq, txpk.Datr, txpk.Size)
+
+    }
+
+}
+
+// Describe how a downlink is to be transmitted by the concentrator
+func gwmpDownlinkTxpk(ocmd outboundCommand, rxpk *gwmpRxpk) gwmpTxpk {
+
+    // A LoRaWAN network server has already said exactly how its downlink is to be sent, in
+    // terms of the concentrator's own clock, and so it is passed through as it is.  Otherwise
+    // transmit immediately on the channel on which we last heard a device, which is how the
+    // Microchip module behaves when it sends right after a receive.
+    txpk := gwmpTxpk{}
+    if ocmd.Txpk != nil {
+        txpk = *ocmd.Txpk
+    } else {
+        txpk.Imme = true
+        txpk.Freq = rxpk.Freq
+        txpk.Rfch = 0
+        txpk.Powe = gwmpPower
+        txpk.Modu = "LORA"
+        txpk.Datr = rxpk.Datr
+        txpk.Codr = rxpk.Codr
+    }
+    if txpk.Codr == "" {
+        txpk.Codr = "4/5"
+    }
+    txpk.Size = uint16(len(ocmd.Command))
+    txpk.Data = base64.StdEncoding.EncodeToString(ocmd.Command)
+    return txpk
+
+}
+
+// Transmit power for downlinks, in dBm, being what the module would be set up with in the region
+func gwmpTxPower(r *loraRadio) int {
+    dbm, err := lpwan.RegionTxPower(r.region, r.loraParam(r.region, "pwr"))
+    if err != nil {
+        go fmt.Printf("*** Ignoring %v\n", err)
+    }
+    return dbm
+}
@@ -0,0 +1,255 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+    "bytes"
+    "encoding/base64"
+    "encoding/json"
+    "os"
+    "reflect"
+    "testing"
+)
+
+// The gateway EUI used in the datagrams below
+const testGatewayEUI = "AA555A0000000101"
+
+// A PUSH_DATA body with two packets, laid out as in Semtech's PROTOCOL.TXT: the uplink published with
+// the lora-packet library, and a packet whose CRC failed
+const testPushDataBody = `{"rxpk":[` +
+    `{"time":"2013-03-31T16:21:17.528002Z","tmst":3512348611,"chan":2,"rfch":0,"freq":866.349812,"stat":1,"modu":"LORA","datr":"SF7BW125","codr":"4/6","rssi":-35,"lsnr":5.1,"size":17,"data":"QPF9vkkAAgABlUN4disR/w0="},` +
+    `{"time":"2013-03-31T16:21:17.530974Z","tmst":3512348514,"chan":0,"rfch":1,"freq":868.1,"stat":-1,"modu":"LORA","datr":"SF12BW125","codr":"4/5","rssi":-120,"lsnr":-19.5,"size":4,"data":"3q2+7w=="}]}`
+
+// A PUSH_DATA body that carries nothing but the gateway's status, as sent every 30 seconds
+const testPushDataStatusBody = `{"stat":{"time":"2014-01-12 08:59:28 GMT","lati":46.24000,"long":3.25230,"alti":145,"rxnb":2,"rxok":2,"rxfw":2,"ackr":100.0,"dwnb":2,"txnb":2}}`
+
+// The PULL_RESP body of PROTOCOL.TXT, whose data is without base64 padding
+const testPullRespBody = `{"txpk":{"imme":true,"freq":864.123456,"rfch":0,"powe":14,"modu":"LORA","datr":"SF11BW125","codr":"4/6","ipol":false,"size":32,"data":"H3P3N2i9qc4yt7rK7ldqoeCVJGBybzPY5h1Dd7P7p8v"}}`
+
+// Datagrams of each kind decode into their parts, and encode back into exactly what was received
+func TestGwmpDecodeEncode(t *testing.T) {
+
+    eui := mustHex(t, testGatewayEUI)
+    tests := []struct {
+        name string
+        datagram []byte
+        token uint16
+        id byte
+        eui []byte
+        body string
+    }{
+        {"PUSH_DATA", append(append(mustHex(t, "02A1B200"), eui...), testPushDataBody...), 0xA1B2, gwmpPushData, eui, testPushDataBody},
+        {"PUSH_DATA status", append(append(mustHex(t, "0201C300"), eui...), testPushDataStatusBody...), 0x01C3, gwmpPushData, eui, testPushDataStatusBody},
+        {"PUSH_ACK", mustHex(t, "02A1B201"), 0xA1B2, gwmpPushAck, nil, ""},
+        {"PULL_DATA", append(mustHex(t, "02C3D402"), eui...), 0xC3D4, gwmpPullData, eui, ""},
+        {"PULL_RESP", append(mustHex(t, "02E5F603"), testPullRespBody...), 0xE5F6, gwmpPullResp, nil, testPullRespBody},
+        {"PULL_ACK", mustHex(t, "02C3D404"), 0xC3D4, gwmpPullAck, nil, ""},
+        {"TX_ACK", append(append(mustHex(t, "02E5F605"), eui...), `{"txpk_ack":{"error":"COLLISION_PACKET"}}`...), 0xE5F6, gwmpTxAck, eui, `{"txpk_ack":{"error":"COLLISION_PACKET"}}`},
+        {"TX_ACK without error", append(mustHex(t, "02E5F605"), eui...), 0xE5F6, gwmpTxAck, eui, ""},
+    }
+
+    for _, test := range tests {
+        pkt, err := gwmpDecode(test.datagram)
+        if err != nil {
+            t.Errorf("%s: %v", test.name, err)
+            continue
+        }
+        if pkt.Token != test.token || pkt.ID != test.id || !bytes.Equal(pkt.EUI, test.eui) || string(pkt.Body) != test.body {
+            t.Errorf("%s: decoded as token %04X id %d eui %X body %q", test.name, pkt.Token, pkt.ID, pkt.EUI, pkt.Body)
+        }
+        if !bytes.Equal(gwmpEncode(pkt), test.datagram) {
+            t.Errorf("%s: encoded as %X, want %X", test.name, gwmpEncode(pkt), test.datagram)
+        }
+    }
+
+    // Anything shorter than its header, or of another version, is refused
+    bad := []struct {
+        name string
+        datagram []byte
+        err error
+    }{
+        {"empty", []byte{}, errGwmpShort},
+        {"no identifier", mustHex(t, "02A1B2"), errGwmpShort},
+        {"PUSH_DATA without EUI", mustHex(t, "02A1B200AA555A"), errGwmpShort},
+        {"PULL_DATA without EUI", mustHex(t, "02C3D402"), errGwmpShort},
+        {"version 1", append(mustHex(t, "01A1B200"), eui...), errGwmpVersion},
+    }
+    for _, test := range bad {
+        _, err := gwmpDecode(test.datagram)
+        if err != test.err {
+            t.Errorf("%s: %v, want %v", test.name, err, test.err)
+        }
+    }
+
+}
+
+// Packets received by the concentrator are processed as though the module had received them, and
+// the JSON that describes them is forwarded to a network server just as it arrived
+func TestGwmpRxpk(t *testing.T) {
+
+    var payload gwmpPushDataPayload
+    err := json.Unmarshal([]byte(testPushDataBody), &payload)
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    body, err := json.Marshal(payload)
+    if err != nil || string(body) != testPushDataBody {
+        t.Fatalf("marshalled as %s with %v", body, err)
+    }
+    if len(payload.Rxpk) != 2 {
+        t.Fatalf("%d rxpk", len(payload.Rxpk))
+    }
+
+    data, meta, ok := gwmpRxpkFrame(payload.Rxpk[0])
+    if !ok {
+        t.Fatalf("rxpk not received")
+    }
+    if !bytes.Equal(data, mustHex(t, "40F17DBE4900020001954378762B11FF0D")) {
+        t.Errorf("data %X", data)
+    }
+    if meta.Freq != 866349812 || meta.Datr != "SF7BW125" || meta.Codr != "4/6" || meta.Rssi != -35 || meta.Snr != 5.1 {
+        t.Errorf("received with %+v", meta)
+    }
+    if meta.Rxpk == nil || !reflect.DeepEqual(*meta.Rxpk, payload.Rxpk[0]) {
+        t.Errorf("rxpk %+v, want %+v", meta.Rxpk, payload.Rxpk[0])
+    }
+
+    // Packets that failed their CRC, that aren't LoRa, or whose data is bad are dropped, but padding is optional
+    rxpk := payload.Rxpk[0]
+    rxpk.Data = "QPF9vkkAAgABlUN4disR/w0"
+    data, _, ok = gwmpRxpkFrame(rxpk)
+    if !ok || !bytes.Equal(data, mustHex(t, "40F17DBE4900020001954378762B11FF0D")) {
+        t.Errorf("unpadded data received as %X", data)
+    }
+    _, _, ok = gwmpRxpkFrame(payload.Rxpk[1])
+    if ok {
+        t.Errorf("received despite a failed CRC")
+    }
+    rxpk = payload.Rxpk[0]
+    rxpk.Modu = "FSK"
+    _, _, ok = gwmpRxpkFrame(rxpk)
+    if ok {
+        t.Errorf("received FSK")
+    }
+    rxpk = payload.Rxpk[0]
+    rxpk.Data = "!!"
+    _, _, ok = gwmpRxpkFrame(rxpk)
+    if ok {
+        t.Errorf("received bad data")
+    }
+
+    // A status report has no packets at all
+    payload = gwmpPushDataPayload{}
+    err = json.Unmarshal([]byte(testPushDataStatusBody), &payload)
+    if err != nil || len(payload.Rxpk) != 0 {
+        t.Errorf("status decoded as %+v with %v", payload, err)
+    }
+
+}
+
+// Downlinks from a network server go out just as it described them, and our own replies go out
+// on the channel of the device with the region's power, in PULL_RESP datagrams that decode into
+// just what was sent
+func TestGwmpTxpk(t *testing.T) {
+
+    defer func(power int) {
+        gwmpPower = power
+    }(gwmpPower)
+
+    var resp gwmpPullRespPayload
+    err := json.Unmarshal([]byte(testPullRespBody), &resp)
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    data, err := base64.RawStdEncoding.DecodeString(resp.Txpk.Data)
+    if err != nil || len(data) != 32 {
+        t.Fatalf("data %X with %v", data, err)
+    }
+
+    var push gwmpPushDataPayload
+    err = json.Unmarshal([]byte(testPushDataBody), &push)
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    rxpk := push.Rxpk[0]
+    noCodr := rxpk
+    noCodr.Codr = ""
+
+    reply := []byte{0x01, 0x02, 0x03}
+    tests := []struct {
+        name string
+        region string
+        ocmd outboundCommand
+        rxpk *gwmpRxpk
+        want gwmpTxpk
+    }{
+        {"network server", "eu", outboundCommand{Command: data, Txpk: &resp.Txpk}, nil, gwmpTxpk{Imme: true, Freq: 864.123456, Powe: 14,
+            Modu: "LORA", Datr: "SF11BW125", Codr: "4/6", Size: 32, Data: base64.StdEncoding.EncodeToString(data)}},
+        {"eu reply", "eu", outboundCommand{Command: reply}, &rxpk, gwmpTxpk{Imme: true, Freq: 866.349812, Powe: 15,
+            Modu: "LORA", Datr: "SF7BW125", Codr: "4/6", Size: 3, Data: "AQID"}},
+        {"us reply", "us", outboundCommand{Command: reply}, &rxpk, gwmpTxpk{Imme: true, Freq: 866.349812, Powe: 20,
+            Modu: "LORA", Datr: "SF7BW125", Codr: "4/6", Size: 3, Data: "AQID"}},
+        {"kr920 reply without coding rate", "kr920", outboundCommand{Command: reply}, &noCodr, gwmpTxpk{Imme: true, Freq: 866.349812, Powe: 14,
+            Modu: "LORA", Datr: "SF7BW125", Codr: "4/5", Size: 3, Data: "AQID"}},
+    }
+
+    for _, test := range tests {
+        r := newLoraRadio("gwmp", 0)
+        r.region = test.region
+        gwmpPower = gwmpTxPower(r)
+        txpk := gwmpDownlinkTxpk(test.ocmd, test.rxpk)
+        if txpk != test.want {
+            t.Errorf("%s: %+v, want %+v", test.name, txpk, test.want)
+            continue
+        }
+
+        // Which is what the packet forwarder gets
+        body, err := json.Marshal(gwmpPullRespPayload{Txpk: txpk})
+        if err != nil {
+            t.Fatalf("%s: %v", test.name, err)
+        }
+        pkt, err := gwmpDecode(gwmpEncode(gwmpPacket{Token: 0x1234, ID: gwmpPullResp, Body: body}))
+        if err != nil || pkt.ID != gwmpPullResp || pkt.Token != 0x1234 {
+            t.Fatalf("%s: decoded as %+v with %v", test.name, pkt, err)
+        }
+        var sent gwmpPullRespPayload
+        err = json.Unmarshal(pkt.Body, &sent)
+        if err != nil || sent.Txpk != test.want {
+            t.Errorf("%s: sent %+v with %v", test.name, sent.Txpk, err)
+        }
+    }
+
+}
+
+// Downlinks are transmitted at the power that the module would be set up with, which may be configured
+func TestGwmpTxPower(t *testing.T) {
+
+    tests := []struct {
+        region string
+        configured string
+        want int
+    }{
+        {"eu", "", 15},
+        {"us", "", 20},
+        {"as923", "", 14},
+        {"kr920", "", 14},
+        {"eu", "14", 14},
+        {"eu", "27", 15},
+        {"us", "27", 27},
+        {"", "", 14},
+    }
+
+    defer os.Unsetenv("LORA_PWR")
+    for _, test := range tests {
+        os.Setenv("LORA_PWR", test.configured)
+        r := newLoraRadio("gwmp", 0)
+        r.region = test.region
+        dbm := gwmpTxPower(r)
+        if dbm != test.want {
+            t.Errorf("%q pwr %q: %ddBm, want %ddBm", test.region, test.configured, dbm, test.want)
+        }
+    }
+
+}
@@ -0,0 +1,223 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Recognition of the LoRaWAN frames that our radios hear alongside Telecast messages
+package main
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "sort"
+    "sync"
+)
+
+// LoRaWAN message types, being the top three bits of the MHDR
+const (
+    lorawanJoinRequest byte = 0
+    lorawanJoinAccept byte = 1
+    lorawanUnconfirmedUp byte = 2
+    lorawanUnconfirmedDown byte = 3
+    lorawanConfirmedUp byte = 4
+    lorawanConfirmedDown byte = 5
+    lorawanRejoinRequest byte = 6
+    lorawanProprietary byte = 7
+)
+
+// Names of the message types, as logged and reported in stats
+var lorawanMTypeNames = [8]string{"join_request", "join_accept", "unconfirmed_up", "unconfirmed_down", "confirmed_up", "confirmed_down", "rejoin_request", "proprietary"}
+
+// lorawanFrame is a LoRaWAN PHYPayload, parsed as far as is possible without keys
+type lorawanFrame struct {
+    MType byte
+    PHYPayload []byte
+
+    // Data frames
+    DevAddr uint32
+    FCtrl byte
+    FCnt uint16
+    FOpts []byte
+    FPort int               // -1 if there's no FPort
+    FRMPayload []byte
+
+    // Join requests
+    JoinEUI uint64
+    DevEUI uint64
+    DevNonce uint16
+
+    MIC []byte
+}
+
+// Errors returned when parsing
+var errLorawanShort = errors.New("lorawan: frame too short")
+var errLorawanMHDR = errors.New("lorawan: not a LoRaWAN R1 MHDR")
+var errLorawanLength = errors.New("lorawan: wrong length for message type")
+var errLorawanFOpts = errors.New("lorawan: FOpts runs past the end of the frame")
+
+// Statics
+var lorawanStatsMutex sync.Mutex
+var lorawanStats = map[string]uint32{}
+
+// Parse a PHYPayload.  Anything can be heard on our channel, so this is strict about what it
+// accepts in order to tell LoRaWAN apart from noise: the MHDR's RFU bits must be clear, the
+// major version must be R1, and the length must be right for the message type.
+func lorawanParse(buf []byte) (f *lorawanFrame, err error) {
+
+    if len(buf) < 5 {
+        return nil, errLorawanShort
+    }
+    mhdr := buf[0]
+    if mhdr & 0x1f != 0 {
+        return nil, errLorawanMHDR
+    }
+    f = &lorawanFrame{MType: mhdr >> 5, PHYPayload: buf, FPort: -1}
+    f.MIC = buf[len(buf)-4:]
+
+    switch f.MType {
+
+    case lorawanJoinRequest:
+        if len(buf) != 23 {
+            return nil, errLorawanLength
+        }
+        f.JoinEUI = binary.LittleEndian.Uint64(buf[1:9])
+        f.DevEUI = binary.LittleEndian.Uint64(buf[9:17])
+        f.DevNonce = binary.LittleEndian.Uint16(buf[17:19])
+
+    case lorawanJoinAccept:
+        // Encrypted in its entirety, so there's nothing more to be had from it
+        if len(buf) != 17 && len(buf) != 33 {
+            return nil, errLorawanLength
+        }
+
+    case lorawanRejoinRequest:
+        if len(buf) != 19 && len(buf) != 24 {
+            return nil, errLorawanLength
+        }
+
+    case lorawanUnconfirmedUp, lorawanUnconfirmedDown, lorawanConfirmedUp, lorawanConfirmedDown:
+        // MHDR, the FHDR's DevAddr, FCtrl and FCnt, and the MIC
+        if len(buf) < 12 {
+            return nil, errLorawanShort
+        }
+        f.DevAddr = binary.LittleEndian.Uint32(buf[1:5])
+        f.FCtrl = buf[5]
+        f.FCnt = binary.LittleEndian.Uint16(buf[6:8])
+        foptsEnd := 8 + int(f.FCtrl & 0x0f)
+        if foptsEnd > len(buf) - 4 {
+            return nil, errLorawanFOpts
+        }
+        f.FOpts = buf[8:foptsEnd]
+        rest := buf[foptsEnd:len(buf)-4]
+        if len(rest) > 0 {
+            f.FPort = int(rest[0])
+            f.FRMPayload = rest[1:]
+            if f.FPort == 0 && len(f.FOpts) != 0 {
+                return nil, errLorawanFOpts
+            }
+        }
+
+    default:
+        // Proprietary frames have no structure by which to tell them from noise
+        return nil, errLorawanMHDR
+
+    }
+
+    return f, nil
+
+}
+
+// Determine whether the frame was sent by a device, rather than by another gateway
+func (f *lorawanFrame) uplink() bool {
+    switch f.MType {
+    case lorawanJoinRequest, lorawanUnconfirmedUp, lorawanConfirmedUp, lorawanRejoinRequest:
+        return true
+    }
+    return false
+}
+
+// Determine whether the frame is a data frame, which has an FHDR
+func (f *lorawanFrame) data() bool {
+    switch f.MType {
+    case lorawanUnconfirmedUp, lorawanUnconfirmedDown, lorawanConfirmedUp, lorawanConfirmedDown:
+        return true
+    }
+    return false
+}
+
+// String describes the frame
+func (f *lorawanFrame) String() string {
+    switch {
+    case f.MType == lorawanJoinRequest:
+        return fmt.Sprintf("%s DevEUI %016X JoinEUI %016X", lorawanMTypeNames[f.MType], f.DevEUI, f.JoinEUI)
+    case f.data():
+        s := fmt.Sprintf("%s DevAddr %08X FCnt %d", lorawanMTypeNames[f.MType], f.DevAddr, f.FCnt)
+        if f.FPort >= 0 {
+            s += fmt.Sprintf(" FPort %d (%d bytes)", f.FPort, len(f.FRMPayload))
+        }
+        return s
+    }
+    return lorawanMTypeNames[f.MType]
+}
+
+// Process a frame that isn't a Telecast message if it's LoRaWAN, returning false if it isn't
+func lorawanProcessReceived(buf []byte, meta rxMetadata) bool {
+
+    // A payload that has already been unwrapped from LoRaWAN isn't LoRaWAN again
+    if meta.Device != "" {
+        return false
+    }
+    f, err := lorawanParse(buf)
+    if err != nil {
+        return false
+    }
+    lorawanCount(lorawanMTypeNames[f.MType])
+
+    // Downlinks are from other gateways, and are of no interest to us
+    if !f.uplink() {
+        if verboseDebug {
+            go fmt.Printf("LoRaWAN %s, from another gateway\n", f)
+        }
+        return true
+    }
+
+    go fmt.Printf("LoRaWAN %s rssi %d snr %.1f\n", f, meta.Rssi, meta.Snr)
+
+    // Our own devices are decoded here, and everyone else's are the network server's business
+    if lorawanProcessSession(f, meta) {
+        return true
+    }
+
+    // Forward it to the network server, remembering which radio can reply to the device
+    lorawanRoute(f, meta.Radio)
+    lorawanForward(f, meta)
+
+    return true
+
+}
+
+// Count something that happened to a LoRaWAN frame
+func lorawanCount(what string) {
+    lorawanStatsMutex.Lock()
+    lorawanStats[what]++
+    lorawanStatsMutex.Unlock()
+}
+
+// Describe how many LoRaWAN frames of each kind have been heard and forwarded
+func cmdGetLoRaWANStats() string {
+    lorawanStatsMutex.Lock()
+    defer lorawanStatsMutex.Unlock()
+    kinds := []string{}
+    for kind := range lorawanStats {
+        kinds = append(kinds, kind)
+    }
+    sort.Strings(kinds)
+    s := ""
+    for _, kind := range kinds {
+        if s != "" {
+            s += ","
+        }
+        s += fmt.Sprintf("%s:%d", kind, lorawanStats[kind])
+    }
+    return s
+}
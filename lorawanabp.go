@@ -0,0 +1,260 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Activation-by-personalization sessions of LoRaWAN devices that we decode ourselves,
+// for deployments that have a few LoRaWAN sensors but no network server
+package main
+
+import (
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/subtle"
+    "encoding/binary"
+    "encoding/hex"
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// LoRaWAN 1.0 devices may skip this many frame counts, such as for frames that we didn't hear
+const lorawanMaxFCntGap = 16384
+
+// lorawanSession is a device's ABP session
+type lorawanSession struct {
+    DevAddr uint32
+    NwkSKey []byte
+    AppSKey []byte
+    fcntUp uint32           // The last frame count that we accepted
+    seen bool               // False until we've accepted a frame
+}
+
+// Statics
+var lorawanSessionsMutex sync.Mutex
+var lorawanSessions = map[uint32]*lorawanSession{}
+var lorawanFCntRelaxed bool
+
+// Load the sessions from LORAWAN_ABP, a comma-separated list of DevAddr:NwkSKey:AppSKey in hex.
+// ABP devices often start counting frames from zero again when they restart, which is rejected
+// as a replay unless LORAWAN_FCNT_RELAXED is set.
+func lorawanSessionsInit() {
+    s := os.Getenv("LORAWAN_ABP")
+    if s == "" {
+        return
+    }
+    for _, entry := range strings.Split(s, ",") {
+        session, err := lorawanSessionParse(strings.TrimSpace(entry))
+        if err != nil {
+            go fmt.Printf("Ignoring LORAWAN_ABP entry %s: %v\n", entry, err)
+            continue
+        }
+        lorawanSessions[session.DevAddr] = session
+    }
+    lorawanFCntRelaxed = getenvInt("LORAWAN_FCNT_RELAXED", 0) != 0
+    go fmt.Printf("Decoding LoRaWAN for %d ABP devices\n", len(lorawanSessions))
+}
+
+// Parse a session of the form DevAddr:NwkSKey:AppSKey
+func lorawanSessionParse(entry string) (*lorawanSession, error) {
+    fields := strings.Split(entry, ":")
+    if len(fields) != 3 {
+        return nil, fmt.Errorf("must be DevAddr:NwkSKey:AppSKey")
+    }
+    devAddr, err := strconv.ParseUint(fields[0], 16, 32)
+    if err != nil {
+        return nil, fmt.Errorf("bad DevAddr: %v", err)
+    }
+    session := &lorawanSession{DevAddr: uint32(devAddr)}
+    session.NwkSKey, err = hex.DecodeString(fields[1])
+    if err != nil || len(session.NwkSKey) != 16 {
+        return nil, fmt.Errorf("NwkSKey must be 32 hex digits")
+    }
+    session.AppSKey, err = hex.DecodeString(fields[2])
+    if err != nil || len(session.AppSKey) != 16 {
+        return nil, fmt.Errorf("AppSKey must be 32 hex digits")
+    }
+    return session, nil
+}
+
+// Find the session of a device, if it's one of ours
+func lorawanSessionFind(devAddr uint32) *lorawanSession {
+    lorawanSessionsMutex.Lock()
+    defer lorawanSessionsMutex.Unlock()
+    return lorawanSessions[devAddr]
+}
+
+// Process an uplink from one of our own ABP devices, returning false if it isn't one of ours.
+// Its application payload is processed just as a Telecast frame would be, except that it can't
+// be replied to because the device only listens for LoRaWAN downlinks.
+func lorawanProcessSession(f *lorawanFrame, meta rxMetadata) bool {
+
+    if !f.data() {
+        return false
+    }
+    session := lorawanSessionFind(f.DevAddr)
+    if session == nil {
+        return false
+    }
+
+    // Verify the frame under the session's lock, so that its counter can't go backward
+    lorawanSessionsMutex.Lock()
+    fcnt, err := session.accept(f)
+    lorawanSessionsMutex.Unlock()
+    if err != nil {
+        go fmt.Printf("LoRaWAN %08X: %v\n", f.DevAddr, err)
+        return true
+    }
+
+    // Frames on port 0 carry only MAC commands, which are of no interest to us
+    if f.FPort <= 0 || len(f.FRMPayload) == 0 {
+        return true
+    }
+    payload := lorawanCrypt(session.AppSKey, 0, f.DevAddr, fcnt, f.FRMPayload)
+    lorawanCount("decrypted")
+    if verboseDebug {
+        go fmt.Printf("LoRaWAN %08X FCnt %d payload %X\n", f.DevAddr, fcnt, payload)
+    }
+
+    meta.Radio = nil
+    meta.Device = fmt.Sprintf("%08X", f.DevAddr)
+    cmdProcessReceived(payload, meta)
+    return true
+
+}
+
+// Verify a frame's MIC and frame count, returning its full 32-bit frame count if it's acceptable.
+// Must be called with the sessions locked.
+func (s *lorawanSession) accept(f *lorawanFrame) (uint32, error) {
+
+    // Only the low 16 bits of the frame count are sent, and so the full count is the nearest
+    // that's after the last that we accepted.  If that doesn't verify it may be that the device
+    // has restarted its count.
+    candidates := []uint32{uint32(f.FCnt)}
+    if s.seen {
+        fcnt := s.fcntUp & 0xffff0000 | uint32(f.FCnt)
+        if fcnt <= s.fcntUp {
+            fcnt += 0x10000
+        }
+        candidates = []uint32{fcnt, uint32(f.FCnt)}
+    }
+
+    for _, fcnt := range candidates {
+        if !lorawanMICValid(s.NwkSKey, f, fcnt) {
+            continue
+        }
+        switch {
+        case !s.seen:
+        case fcnt > s.fcntUp && fcnt - s.fcntUp <= lorawanMaxFCntGap:
+        case lorawanFCntRelaxed:
+            go fmt.Printf("LoRaWAN %08X: frame count restarted at %d\n", f.DevAddr, fcnt)
+        default:
+            lorawanCount("fcnt_rejected")
+            return 0, fmt.Errorf("frame count %d isn't after %d", fcnt, s.fcntUp)
+        }
+        s.fcntUp = fcnt
+        s.seen = true
+        return fcnt, nil
+    }
+
+    lorawanCount("mic_failed")
+    return 0, fmt.Errorf("MIC doesn't verify")
+
+}
+
+// Determine whether an uplink's MIC is that computed with the specified key and frame count
+func lorawanMICValid(key []byte, f *lorawanFrame, fcnt uint32) bool {
+    msg := f.PHYPayload[:len(f.PHYPayload)-4]
+    b0 := lorawanBlock(0x49, 0, f.DevAddr, fcnt, byte(len(msg)))
+    mac := aesCMAC(key, append(b0, msg...))
+    return subtle.ConstantTimeCompare(mac[:4], f.MIC) == 1
+}
+
+// Build one of the blocks that the MIC and the encryption of FRMPayload are computed with
+func lorawanBlock(kind byte, dir byte, devAddr uint32, fcnt uint32, last byte) []byte {
+    b := make([]byte, 16)
+    b[0] = kind
+    b[5] = dir
+    binary.LittleEndian.PutUint32(b[6:10], devAddr)
+    binary.LittleEndian.PutUint32(b[10:14], fcnt)
+    b[15] = last
+    return b
+}
+
+// Encrypt or decrypt FRMPayload, which are the same operation, in the direction that's
+// 0 for uplinks and 1 for downlinks
+func lorawanCrypt(key []byte, dir byte, devAddr uint32, fcnt uint32, payload []byte) []byte {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil
+    }
+    out := make([]byte, len(payload))
+    s := make([]byte, 16)
+    for i := 0; i < len(payload); i += 16 {
+        block.Encrypt(s, lorawanBlock(0x01, dir, devAddr, fcnt, byte(i/16 + 1)))
+        for j := 0; j < 16 && i+j < len(payload); j++ {
+            out[i+j] = payload[i+j] ^ s[j]
+        }
+    }
+    return out
+}
+
+// Compute the AES-CMAC of a message, as defined by RFC 4493
+func aesCMAC(key []byte, msg []byte) []byte {
+
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return make([]byte, 16)
+    }
+
+    // Derive the subkeys
+    k1 := make([]byte, 16)
+    block.Encrypt(k1, k1)
+    k1 = cmacDouble(k1)
+    k2 := cmacDouble(k1)
+
+    // The last block is XOR'ed with one subkey if it's complete, and padded and XOR'ed with the other if not
+    n := (len(msg) + 15) / 16
+    last := make([]byte, 16)
+    if n > 0 && len(msg) % 16 == 0 {
+        copy(last, msg[(n-1)*16:])
+        for i := range last {
+            last[i] ^= k1[i]
+        }
+    } else {
+        if n == 0 {
+            n = 1
+        }
+        rest := msg[(n-1)*16:]
+        copy(last, rest)
+        last[len(rest)] = 0x80
+        for i := range last {
+            last[i] ^= k2[i]
+        }
+    }
+
+    mac := make([]byte, 16)
+    cbc := cipher.NewCBCEncrypter(block, mac)
+    if n > 1 {
+        prefix := make([]byte, (n-1)*16)
+        cbc.CryptBlocks(prefix, msg[:(n-1)*16])
+    }
+    cbc.CryptBlocks(mac, last)
+    return mac
+
+}
+
+// Multiply a CMAC subkey by x in GF(2^128)
+func cmacDouble(b []byte) []byte {
+    d := make([]byte, 16)
+    carry := byte(0)
+    for i := 15; i >= 0; i-- {
+        d[i] = b[i] << 1 | carry
+        carry = b[i] >> 7
+    }
+    if carry != 0 {
+        d[15] ^= 0x87
+    }
+    return d
+}
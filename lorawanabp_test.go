@@ -0,0 +1,162 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "encoding/hex"
+    "testing"
+)
+
+// Decode hex that is known to be good
+func mustHex(t *testing.T, s string) []byte {
+    b, err := hex.DecodeString(s)
+    if err != nil {
+        t.Fatalf("%s: %v", s, err)
+    }
+    return b
+}
+
+// Build an uplink from a session's device with the specified full frame count, of which only the low 16 bits are sent
+func testUplink(t *testing.T, s *lorawanSession, nwkSKey []byte, fcnt uint32, payload []byte) *lorawanFrame {
+    msg := []byte{0x40, 0, 0, 0, 0, 0x00, 0, 0, 0x01}
+    binary.LittleEndian.PutUint32(msg[1:], s.DevAddr)
+    binary.LittleEndian.PutUint16(msg[6:], uint16(fcnt))
+    msg = append(msg, lorawanCrypt(s.AppSKey, 0, s.DevAddr, fcnt, payload)...)
+    b0 := lorawanBlock(0x49, 0, s.DevAddr, fcnt, byte(len(msg)))
+    msg = append(msg, aesCMAC(nwkSKey, append(b0, msg...))[:4]...)
+    f, err := lorawanParse(msg)
+    if err != nil {
+        t.Fatalf("parse: %v", err)
+    }
+    return f
+}
+
+// The AES-CMAC examples of RFC 4493
+func TestAESCMAC(t *testing.T) {
+
+    key := mustHex(t, "2b7e151628aed2a6abf7158809cf4f3c")
+    msg := mustHex(t, "6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e5130c81c46a35ce411e5fbc1191a0a52eff69f2445df4f9b17ad2b417be66c3710")
+
+    tests := []struct {
+        length int
+        mac string
+    }{
+        {0, "bb1d6929e95937287fa37d129b756746"},
+        {16, "070a16b46b4d4144f79bdd9dd04a287c"},
+        {40, "dfa66747de9ae63030ca32611497c827"},
+        {64, "51f0bebf7e3b9d92fc49741779363cfe"},
+    }
+    for _, test := range tests {
+        mac := aesCMAC(key, msg[:test.length])
+        if hex.EncodeToString(mac) != test.mac {
+            t.Errorf("%d bytes: %x, want %s", test.length, mac, test.mac)
+        }
+    }
+
+    // As are the subkeys
+    l := mustHex(t, "7df76b0c1ab899b33e42f047b91b546f")
+    k1 := cmacDouble(l)
+    k2 := cmacDouble(k1)
+    if hex.EncodeToString(k1) != "fbeed618357133667c85e08f7236a8de" || hex.EncodeToString(k2) != "f7ddac306ae266ccf90bc11ee46d513b" {
+        t.Errorf("subkeys %x and %x", k1, k2)
+    }
+
+}
+
+// The uplink published with the lora-packet library, which is unconfirmed data from 49BE7DF1 with FCnt 2 on FPort 1
+func TestLoRaWANPublishedUplink(t *testing.T) {
+
+    nwkSKey := mustHex(t, "44024241ed4ce9a68c6a8bc055233fd3")
+    appSKey := mustHex(t, "ec925802ae430ca77fd3dd73cb2cc588")
+    f, err := lorawanParse(mustHex(t, "40F17DBE4900020001954378762B11FF0D"))
+    if err != nil {
+        t.Fatalf("parse: %v", err)
+    }
+    if f.DevAddr != 0x49BE7DF1 || f.FCnt != 2 || f.FPort != 1 {
+        t.Fatalf("parsed as %s", f)
+    }
+
+    tests := []struct {
+        name string
+        key []byte
+        fcnt uint32
+        valid bool
+    }{
+        {"published", nwkSKey, 2, true},
+        {"wrong fcnt", nwkSKey, 3, false},
+        {"wrong upper fcnt", nwkSKey, 0x10002, false},
+        {"wrong key", appSKey, 2, false},
+    }
+    for _, test := range tests {
+        if lorawanMICValid(test.key, f, test.fcnt) != test.valid {
+            t.Errorf("%s: MIC valid %v, want %v", test.name, !test.valid, test.valid)
+        }
+    }
+
+    // FRMPayload is "test", and encrypting it again gives what was sent
+    payload := lorawanCrypt(appSKey, 0, f.DevAddr, 2, f.FRMPayload)
+    if string(payload) != "test" {
+        t.Fatalf("decrypted %q, want \"test\"", payload)
+    }
+    if !bytes.Equal(lorawanCrypt(appSKey, 0, f.DevAddr, 2, payload), f.FRMPayload) {
+        t.Fatalf("encryption isn't its own inverse")
+    }
+
+    // A longer payload uses the same keystream for its first block, and a fresh one for each block after
+    long := lorawanCrypt(appSKey, 0, f.DevAddr, 2, append([]byte("test"), make([]byte, 36)...))
+    if !bytes.Equal(long[:4], f.FRMPayload) || bytes.Equal(long[4:16], long[20:32]) || bytes.Equal(long[20:32], long[36:]) {
+        t.Fatalf("keystream %x", long)
+    }
+
+}
+
+// Frame counts must keep advancing, across the rollover of the 16 bits that are sent, by no more than
+// the maximum gap, unless relaxed to let devices restart their counts
+func TestLoRaWANAccept(t *testing.T) {
+
+    type uplink struct {
+        fcnt uint32
+        ok bool
+    }
+    tests := []struct {
+        name string
+        relaxed bool
+        uplinks []uplink
+    }{
+        {"in order", false, []uplink{{1, true}, {2, true}, {7, true}}},
+        {"rollover", false, []uplink{{0xfffe, true}, {0xffff, true}, {0x10000, true}, {0x10003, true}}},
+        {"rollover across gap", false, []uplink{{0xfff0, true}, {0x10005, true}}},
+        {"replay", false, []uplink{{5, true}, {5, false}, {4, false}, {6, true}}},
+        {"largest gap", false, []uplink{{5, true}, {5 + lorawanMaxFCntGap, true}}},
+        {"too large a gap", false, []uplink{{5, true}, {6 + lorawanMaxFCntGap, false}, {6, true}}},
+        {"restart", false, []uplink{{100, true}, {1, false}, {101, true}}},
+        {"relaxed restart", true, []uplink{{100, true}, {1, true}, {2, true}}},
+        {"relaxed gap", true, []uplink{{5, true}, {6 + lorawanMaxFCntGap, true}}},
+    }
+
+    defer func(relaxed bool) {
+        lorawanFCntRelaxed = relaxed
+    }(lorawanFCntRelaxed)
+    for _, test := range tests {
+        lorawanFCntRelaxed = test.relaxed
+        s := &lorawanSession{DevAddr: 0x26011BDA, NwkSKey: mustHex(t, "2b7e151628aed2a6abf7158809cf4f3c"), AppSKey: mustHex(t, "3c4fcf098815f7aba6d2ae2816157e2b")}
+        for i, u := range test.uplinks {
+            fcnt, err := s.accept(testUplink(t, s, s.NwkSKey, u.fcnt, []byte{0x01}))
+            if (err == nil) != u.ok || (err == nil && fcnt != u.fcnt) {
+                t.Errorf("%s: uplink %d with FCnt %d accepted as %d with %v", test.name, i, u.fcnt, fcnt, err)
+            }
+        }
+    }
+
+    // Nothing is accepted without the right key
+    s := &lorawanSession{DevAddr: 0x26011BDA, NwkSKey: mustHex(t, "2b7e151628aed2a6abf7158809cf4f3c"), AppSKey: mustHex(t, "3c4fcf098815f7aba6d2ae2816157e2b")}
+    _, err := s.accept(testUplink(t, s, s.AppSKey, 1, []byte{0x01}))
+    if err == nil || s.seen {
+        t.Fatalf("accepted with the wrong key")
+    }
+
+}
@@ -0,0 +1,293 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Forwarding of LoRaWAN frames to a network server, as a Semtech UDP packet forwarder would,
+// so that the gateway serves LoRaWAN devices as well as Safecast's own
+package main
+
+import (
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "math/rand"
+    "net"
+    "os"
+    "sync"
+    "time"
+    "github.com/Safecast/TTGate/lpwan"
+)
+
+// How often we let the network server know that we're still here to take downlinks
+const lorawanKeepalive = 10 * time.Second
+
+// Downlinks scheduled further ahead than this can't be meant for a device that we just heard
+const lorawanMaxSchedule = 30 * time.Second
+
+// How far ahead of its time a downlink is enqueued by default.  Before the module transmits it,
+// it may take a "radio rxstop", up to four "radio set"s to tune for it, and the "radio tx"
+// itself, each of which is a round trip of 20-25ms over the serial port.
+const lorawanDefaultTxLead = 150 * time.Millisecond
+
+// Statics
+var lorawanConn *net.UDPConn
+var lorawanEpoch = time.Now()
+var lorawanTxLead time.Duration
+var lorawanRouteMutex sync.Mutex
+var lorawanRoutes = map[uint32]*loraRadio{}
+var lorawanLastRadio *loraRadio
+
+// Begin forwarding to the network server at LORAWAN_SERVER (host:port), if one is configured
+func lorawanForwarderInit() {
+
+    server := os.Getenv("LORAWAN_SERVER")
+    if server == "" {
+        return
+    }
+    addr, err := net.ResolveUDPAddr("udp", server)
+    if err != nil {
+        go fmt.Printf("lorawan: cannot resolve %s: %v\n", server, err)
+        return
+    }
+    conn, err := net.DialUDP("udp", nil, addr)
+    if err != nil {
+        go fmt.Printf("lorawan: cannot reach %s: %v\n", addr, err)
+        return
+    }
+    lorawanConn = conn
+
+    // The Microchip module can only be told to transmit now, and so a downlink that's due at a
+    // particular time is enqueued early enough for the module to be tuned and given the command
+    lorawanTxLead = getenvMs("LORAWAN_TX_LEAD_MS", lorawanDefaultTxLead)
+
+    go fmt.Printf("Forwarding LoRaWAN to network server at %s\n", addr)
+
+    go lorawanInboundMain()
+    go lorawanKeepaliveMain()
+
+}
+
+// Get the gateway's EUI as the network server knows it, which is LORAWAN_GATEWAY_EUI
+// or else the primary radio's, or nil if that isn't yet known
+func lorawanGatewayEUI() []byte {
+    s := os.Getenv("LORAWAN_GATEWAY_EUI")
+    if s == "" {
+        r := primaryRadio()
+        if r != nil {
+            s, _ = r.identity()
+        }
+    }
+    eui, err := hex.DecodeString(s)
+    if err != nil || len(eui) != 8 {
+        return nil
+    }
+    return eui
+}
+
+// Get the concentrator-style timestamp of a moment, in microseconds, with which the
+// network server schedules its downlinks relative to the uplinks that we forward
+func lorawanTmst(t time.Time) uint32 {
+    return uint32(t.Sub(lorawanEpoch) / time.Microsecond)
+}
+
+// Remember which radio heard a device, so that its downlinks go out through the same radio
+func lorawanRoute(f *lorawanFrame, r *loraRadio) {
+    if r == nil {
+        return
+    }
+    lorawanRouteMutex.Lock()
+    if f.data() {
+        lorawanRoutes[f.DevAddr] = r
+    }
+    lorawanLastRadio = r
+    lorawanRouteMutex.Unlock()
+}
+
+// Find the radio through which to send a downlink.  Join accepts are encrypted in their
+// entirety, so they go out through whichever radio last heard an uplink.
+func lorawanRadioFor(f *lorawanFrame) *loraRadio {
+    lorawanRouteMutex.Lock()
+    defer lorawanRouteMutex.Unlock()
+    if f != nil && f.data() {
+        r, present := lorawanRoutes[f.DevAddr]
+        if present {
+            return r
+        }
+    }
+    if lorawanLastRadio != nil {
+        return lorawanLastRadio
+    }
+    return primaryRadio()
+}
+
+// Forward an uplink, with how it was received, to the network server
+func lorawanForward(f *lorawanFrame, meta rxMetadata) {
+
+    if lorawanConn == nil {
+        return
+    }
+    eui := lorawanGatewayEUI()
+    if eui == nil {
+        go fmt.Printf("lorawan: not forwarding until the gateway's EUI is known\n")
+        return
+    }
+
+    // A packet forwarder has already described it in the network server's terms
+    rxpk := gwmpRxpk{}
+    if meta.Rxpk != nil {
+        rxpk = *meta.Rxpk
+    } else {
+        receivedAt := meta.ReceivedAt
+        if receivedAt.IsZero() {
+            receivedAt = time.Now()
+        }
+        rxpk.Time = receivedAt.UTC().Format(time.RFC3339Nano)
+        rxpk.Tmst = lorawanTmst(receivedAt)
+        rxpk.Freq = float64(meta.Freq) / 1000000
+        rxpk.Stat = 1
+        rxpk.Modu = "LORA"
+        rxpk.Datr = meta.Datr
+        rxpk.Codr = meta.Codr
+        rxpk.Rssi = meta.Rssi
+        if meta.Snr != invalidSNR {
+            rxpk.Lsnr = meta.Snr
+        }
+    }
+    rxpk.Size = uint16(len(f.PHYPayload))
+    rxpk.Data = base64.StdEncoding.EncodeToString(f.PHYPayload)
+
+    body, err := json.Marshal(gwmpPushDataPayload{Rxpk: []gwmpRxpk{rxpk}})
+    if err != nil {
+        return
+    }
+    pkt := gwmpPacket{Token: uint16(rand.Intn(65536)), ID: gwmpPushData, EUI: eui, Body: body}
+    _, err = lorawanConn.Write(gwmpEncode(pkt))
+    if err != nil {
+        go fmt.Printf("lorawan: write error %v\n", err)
+        return
+    }
+    lorawanCount("forwarded")
+
+}
+
+// Periodically tell the network server where to send downlinks
+func lorawanKeepaliveMain() {
+    for {
+        eui := lorawanGatewayEUI()
+        if eui != nil {
+            lorawanConn.Write(gwmpEncode(gwmpPacket{Token: uint16(rand.Intn(65536)), ID: gwmpPullData, EUI: eui}))
+        }
+        time.Sleep(lorawanKeepalive)
+    }
+}
+
+// Process datagrams from the network server
+func lorawanInboundMain() {
+
+    buf := make([]byte, 65536)
+    for {
+
+        n, err := lorawanConn.Read(buf)
+        if err != nil {
+            // Such as when the server isn't listening, which is reported on every read
+            go fmt.Printf("lorawan: read error %v\n", err)
+            time.Sleep(lorawanKeepalive)
+            continue
+        }
+
+        pkt, err := gwmpDecode(buf[:n])
+        if err != nil {
+            go fmt.Printf("lorawan: %v\n", err)
+            continue
+        }
+
+        if pkt.ID != gwmpPullResp {
+            continue
+        }
+        var payload gwmpPullRespPayload
+        err = json.Unmarshal(pkt.Body, &payload)
+        if err != nil {
+            go fmt.Printf("lorawan: bad PULL_RESP: %v\n", err)
+            continue
+        }
+
+        // Let the server know whether or not we could schedule it
+        var ack gwmpTxAckPayload
+        ack.TxpkAck.Error = lorawanDownlink(payload.Txpk)
+        body, err := json.Marshal(ack)
+        if err != nil {
+            continue
+        }
+        lorawanConn.Write(gwmpEncode(gwmpPacket{Token: pkt.Token, ID: gwmpTxAck, EUI: lorawanGatewayEUI(), Body: body}))
+
+    }
+
+}
+
+// Schedule a downlink for transmission, returning the TX_ACK error that describes the outcome
+func lorawanDownlink(txpk gwmpTxpk) string {
+
+    data, err := base64.StdEncoding.DecodeString(txpk.Data)
+    if err != nil {
+        data, err = base64.RawStdEncoding.DecodeString(txpk.Data)
+    }
+    if err != nil || len(data) == 0 {
+        go fmt.Printf("lorawan: bad txpk data: %s\n", txpk.Data)
+        return "PAYLOAD_INVALID"
+    }
+    f, _ := lorawanParse(data)
+    r := lorawanRadioFor(f)
+    if r == nil {
+        return "TX_FREQ"
+    }
+
+    // A packet forwarder schedules by its own clock, which is what the server was given
+    if r.ctl == nil {
+        var ocmd outboundCommand
+        ocmd.Command = data
+        ocmd.QueuedAt = time.Now()
+        ocmd.Txpk = &txpk
+        r.outboundQueue <- ocmd
+        lorawanCount("downlinks")
+        return "NONE"
+    }
+
+    // The module can't be made to transmit until its receive ends unless it can stop it,
+    // which may be most of a minute away
+    if !r.ctl.CanStopReceive() {
+        go fmt.Printf("lorawan: %s cannot stop its receive for a downlink\n", r.id)
+        lorawanCount("too_late")
+        return "TOO_LATE"
+    }
+
+    // Otherwise the time is relative to our own timestamps, and it's pointless to transmit late
+    delay := time.Duration(0)
+    deadline := time.Time{}
+    if !txpk.Imme {
+        until := time.Duration(int32(txpk.Tmst - lorawanTmst(time.Now()))) * time.Microsecond
+        if until < 0 {
+            go fmt.Printf("lorawan: downlink is %dms too late\n", -until / time.Millisecond)
+            lorawanCount("too_late")
+            return "TOO_LATE"
+        }
+        if until > lorawanMaxSchedule {
+            lorawanCount("too_early")
+            return "TOO_EARLY"
+        }
+        delay = until - lorawanTxLead
+        if delay < 0 {
+            delay = 0
+        }
+        deadline = time.Now().Add(until)
+    }
+
+    tx := lpwan.TxParams{Frequency: int(txpk.Freq * 1000000 + 0.5), DataRate: txpk.Datr, InvertIQ: txpk.Ipol}
+    go fmt.Printf("lorawan: downlink of %d bytes at %.4fMHz %s in %dms\n", len(data), txpk.Freq, txpk.Datr, delay / time.Millisecond)
+    time.AfterFunc(delay, func() {
+        r.ctl.EnqueueWith(data, tx, deadline)
+    })
+    lorawanCount("downlinks")
+    return "NONE"
+
+}
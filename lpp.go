@@ -0,0 +1,226 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Cayenne Low Power Payload, as spoken by many off-the-shelf LoRaWAN sensors
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "os"
+    "strconv"
+    "time"
+)
+
+// The device type under which LPP devices are displayed
+const lppDeviceType = "LPP"
+
+// LPP data types, with the size of each and the resolution of its values
+type lppType struct {
+    name string
+    size int
+    scale float64           // Divisor of the raw value
+    signed bool
+    values int              // Values of size/values bytes each, such as x, y and z
+}
+var lppTypes = map[byte]lppType{
+    0: {"digital_in", 1, 1, false, 1},
+    1: {"digital_out", 1, 1, false, 1},
+    2: {"analog_in", 2, 100, true, 1},
+    3: {"analog_out", 2, 100, true, 1},
+    101: {"illuminance", 2, 1, false, 1},
+    102: {"presence", 1, 1, false, 1},
+    103: {"temperature", 2, 10, true, 1},
+    104: {"humidity", 1, 2, false, 1},
+    113: {"accelerometer", 6, 1000, true, 3},
+    115: {"barometer", 2, 10, false, 1},
+    134: {"gyrometer", 6, 100, true, 3},
+    136: {"gps", 9, 0, true, 3},
+}
+
+// lppReading is a single value, or set of values, from one of a device's channels
+type lppReading struct {
+    Channel byte `json:"channel"`
+    Type string `json:"type"`
+    Values []float64 `json:"values"`
+}
+
+// lppUpload is what we post to LPP_URL for each frame received from an LPP device
+type lppUpload struct {
+    DeviceID string `json:"device_id"`
+    GatewayID string `json:"gateway_id,omitempty"`
+    ReceivedAt string `json:"received_at"`
+    Snr float32 `json:"snr,omitempty"`
+    Rssi int32 `json:"rssi,omitempty"`
+    Readings []lppReading `json:"readings"`
+}
+
+// Decode an LPP payload, which is a sequence of channel, type and value.  LPP has no header by
+// which to recognize it, so the whole payload must decode for it to be taken as LPP.
+func lppDecode(buf []byte) (readings []lppReading, err error) {
+
+    for i := 0; i < len(buf); {
+
+        if i + 2 > len(buf) {
+            return nil, fmt.Errorf("lpp: truncated at %d", i)
+        }
+        channel := buf[i]
+        t, known := lppTypes[buf[i+1]]
+        if !known {
+            return nil, fmt.Errorf("lpp: unknown type %d", buf[i+1])
+        }
+        i += 2
+        if i + t.size > len(buf) {
+            return nil, fmt.Errorf("lpp: %s truncated", t.name)
+        }
+
+        // Values are big-endian, and GPS is three 3-byte values with resolutions of their own
+        reading := lppReading{Channel: channel, Type: t.name}
+        width := t.size / t.values
+        for v := 0; v < t.values; v++ {
+            raw := int64(0)
+            for _, b := range buf[i+v*width:i+(v+1)*width] {
+                raw = raw << 8 | int64(b)
+            }
+            if t.signed && raw & (1 << uint(width*8-1)) != 0 {
+                raw -= 1 << uint(width*8)
+            }
+            scale := t.scale
+            if t.name == "gps" {
+                scale = 10000
+                if v == 2 {
+                    scale = 100
+                }
+            }
+            reading.Values = append(reading.Values, float64(raw) / scale)
+        }
+        readings = append(readings, reading)
+        i += t.size
+
+    }
+
+    if len(readings) == 0 {
+        return nil, fmt.Errorf("lpp: empty")
+    }
+    return readings, nil
+
+}
+
+// Process a payload from a device whose identity we know from how it was sent, such as a LoRaWAN
+// device's DevAddr, if it's LPP, returning false if it isn't
+func lppProcessReceived(buf []byte, meta rxMetadata) bool {
+
+    readings, err := lppDecode(buf)
+    if err != nil {
+        return false
+    }
+
+    go lppLocallyDisplay(readings, meta)
+    go lppForward(readings, meta)
+
+    return true
+
+}
+
+// Record the readings for display on local HDMI via embedded browser
+func lppLocallyDisplay(readings []lppReading, meta rxMetadata) {
+
+    var dev seenDevice
+    dev.DeviceID = meta.Device
+    dev.DeviceNo, _ = strconv.ParseUint(meta.Device, 16, 64)
+    dev.DeviceType = lppDeviceType
+    dev.captured = time.Now()
+    dev.CapturedAtLocal = dev.captured.In(OurTimezone).Format("Mon 3:04pm")
+    if meta.Snr != invalidSNR {
+        dev.snr = meta.Snr
+        dev.SNR = fmt.Sprintf("%ddB", int32(meta.Snr))
+    }
+    if meta.Rssi != 0 {
+        dev.RSSI = fmt.Sprintf("%ddBm", meta.Rssi)
+    }
+
+    // The readings that correspond to those of Safecast devices are shown as theirs are, and
+    // everything is also shown by channel, because a device may have several of a kind
+    dev.Readings = map[string]string{}
+    for _, r := range readings {
+        v := r.Values
+        value := ""
+        switch r.Type {
+        case "temperature":
+            value = localizedTemp(float32(v[0]))
+            dev.EnvTemp = value
+        case "humidity":
+            value = fmt.Sprintf("%.1f%%", v[0])
+            dev.EnvHumid = value
+        case "barometer":
+            value = fmt.Sprintf("%.1fhPa", v[0])
+            dev.EnvPress = fmt.Sprintf("%.0f", v[0])
+        case "gps":
+            value = fmt.Sprintf("%.4f,%.4f,%.0fm", v[0], v[1], v[2])
+            dev.Latitude = fmt.Sprintf("%.2f", v[0])
+            dev.Longitude = fmt.Sprintf("%.2f", v[1])
+            dev.Altitude = fmt.Sprintf("%.0fm", v[2])
+        case "illuminance":
+            value = fmt.Sprintf("%.0flux", v[0])
+        case "accelerometer":
+            value = fmt.Sprintf("%.3f,%.3f,%.3fG", v[0], v[1], v[2])
+        case "gyrometer":
+            value = fmt.Sprintf("%.2f,%.2f,%.2fdeg/s", v[0], v[1], v[2])
+        default:
+            value = strconv.FormatFloat(v[0], 'f', -1, 64)
+        }
+        dev.Readings[fmt.Sprintf("%s_%d", r.Type, r.Channel)] = value
+    }
+
+    seenDevicesMutex.Lock()
+    totalMessagesReceived = totalMessagesReceived + 1
+    recordSeenDevice(&dev, meta)
+    seenDevicesMutex.Unlock()
+
+    go fmt.Printf("\n%s %s: %d LPP readings\n\n", dev.CapturedAtLocal, dev.DeviceID, len(readings))
+
+}
+
+// Forward the readings to LPP_URL, if one is configured
+func lppForward(readings []lppReading, meta rxMetadata) {
+
+    url := os.Getenv("LPP_URL")
+    if url == "" {
+        return
+    }
+
+    msg := lppUpload{}
+    msg.DeviceID = meta.Device
+    msg.GatewayID, _ = cmdGetGatewayInfo()
+    msg.ReceivedAt = nowInUTC()
+    if meta.Snr != invalidSNR {
+        msg.Snr = meta.Snr
+    }
+    msg.Rssi = meta.Rssi
+    msg.Readings = readings
+
+    msgJSON, _ := json.Marshal(msg)
+    req, err := http.NewRequest("POST", url, bytes.NewBuffer(msgJSON))
+    if err != nil {
+        go fmt.Printf("*** Error uploading to %s %s\n\n", url, err)
+        return
+    }
+    req.Header.Set("User-Agent", "TTGATE")
+    req.Header.Set("Content-Type", "application/json")
+    httpclient := &http.Client{
+        Timeout: time.Second * 15,
+    }
+    resp, err := httpclient.Do(req)
+    if err != nil {
+        go fmt.Printf("*** Error uploading to %s %s\n\n", url, err)
+        return
+    }
+    resp.Body.Close()
+    if resp.StatusCode / 100 != 2 {
+        go fmt.Printf("*** Error uploading to %s: %s\n\n", url, resp.Status)
+    }
+
+}
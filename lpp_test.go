@@ -0,0 +1,87 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+    "math"
+    "testing"
+)
+
+// Payloads decode into the readings given by the examples of the Cayenne LPP documentation, and
+// anything truncated or of an unknown type is an error rather than a partial decode
+func TestLPPDecode(t *testing.T) {
+
+    tests := []struct {
+        name string
+        payload string
+        want []lppReading
+    }{
+        {"two temperatures", "03670110056700FF", []lppReading{
+            {3, "temperature", []float64{27.2}},
+            {5, "temperature", []float64{25.5}},
+        }},
+        {"negative temperature and accelerometer", "0167FFD7067104D2FB2E0000", []lppReading{
+            {1, "temperature", []float64{-4.1}},
+            {6, "accelerometer", []float64{1.234, -1.234, 0}},
+        }},
+        {"gps", "018806765FF2960A0003E8", []lppReading{
+            {1, "gps", []float64{42.3519, -87.9094, 10}},
+        }},
+        {"gps southern and western, below sea level", "0288FA02C4FE299CFFFF38", []lppReading{
+            {2, "gps", []float64{-39.2508, -12.0420, -2}},
+        }},
+        {"analog input", "0202012C0402FF38", []lppReading{
+            {2, "analog_in", []float64{3}},
+            {4, "analog_in", []float64{-2}},
+        }},
+        {"several channels", "03670110018806765FF2960A0003E80502012C06680A07650190", []lppReading{
+            {3, "temperature", []float64{27.2}},
+            {1, "gps", []float64{42.3519, -87.9094, 10}},
+            {5, "analog_in", []float64{3}},
+            {6, "humidity", []float64{5}},
+            {7, "illuminance", []float64{400}},
+        }},
+        {"empty", "", nil},
+        {"channel only", "03", nil},
+        {"truncated temperature", "036701", nil},
+        {"truncated gps", "018806765FF2960A0003", nil},
+        {"truncated after a reading", "0367011005", nil},
+        {"truncated value after a reading", "036701100567", nil},
+        {"unknown type", "03FE0110", nil},
+        {"unknown type after a reading", "03670110057A00FF", nil},
+    }
+
+    for _, test := range tests {
+        readings, err := lppDecode(mustHex(t, test.payload))
+        if test.want == nil {
+            if err == nil || readings != nil {
+                t.Errorf("%s: decoded as %v with error %v", test.name, readings, err)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("%s: %v", test.name, err)
+            continue
+        }
+        if len(readings) != len(test.want) {
+            t.Errorf("%s: %v, want %v", test.name, readings, test.want)
+            continue
+        }
+        for i, r := range readings {
+            w := test.want[i]
+            if r.Channel != w.Channel || r.Type != w.Type || len(r.Values) != len(w.Values) {
+                t.Errorf("%s: reading %d is %v, want %v", test.name, i, r, w)
+                continue
+            }
+            for v := range r.Values {
+                if math.Abs(r.Values[v] - w.Values[v]) > 1e-9 {
+                    t.Errorf("%s: reading %d is %v, want %v", test.name, i, r.Values, w.Values)
+                    break
+                }
+            }
+        }
+    }
+
+}
@@ -0,0 +1,424 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Package lpwan drives a Microchip RN2483 or RN2903 as a raw LoRa radio: it resets and
+// configures the module for its region, keeps it receiving, hands whatever it hears to the
+// caller, and transmits whatever the caller enqueues, recovering from the many ways in which
+// the module may misbehave.  A program that drives several modules creates a Controller for each.
+package lpwan
+
+import (
+    "fmt"
+    "sync"
+    "time"
+    "github.com/tarm/serial"
+)
+
+// Controller is everything we know about a single LPWAN module: how we talk to it,
+// the state of its state machine, and the messages waiting to be transmitted by it.
+type Controller struct {
+
+    // Configuration
+    serialPort string
+    serialConfig serial.Config
+    portsInUse func() map[string]bool
+    verbose bool
+    timeScale float64
+    configuredRegion string
+    configuredScan *ScanPlan
+    country func() string
+    paramLookup func(region string, name string) string
+    logger func(format string, args ...interface{})
+    trace func(sent bool, line []byte)
+    onReceive func(frame []byte, meta Metadata)
+    onReceiveError func(err error)
+    onStateChange func(from State, to State)
+    onReadyToTransmit func()
+    onModuleLost func()
+
+    // I/O
+    ioMutex sync.Mutex
+    transport Transport
+    opener func() (Transport, error)
+    transportOpened bool
+    reopenBackoff time.Duration
+    reset ResetStrategy
+    replyWatchdogEnabled bool
+    replyWatchdogTickCount int
+
+    // Command processing
+    outboundQueue chan outboundCommand
+    deferredOutbound *outboundCommand
+    duty *DutyLedger
+    transmitFreq int
+    transmitAirtime time.Duration
+    busyCount int
+    watchdog1mCount int
+    recovery RecoveryPolicy
+    ladder recoveryLadder
+
+    // Event loop
+    events chan controllerEvent
+    timerGeneration int
+    timerAction func()
+    delaying bool
+    lastCommand string
+    retries int
+    history *history
+
+    // State machine, whose identity and stats are also read by other goroutines under the mutex
+    statsMutex sync.Mutex
+    currentState State
+    receivedMessage []byte
+    receivedMeta Metadata
+    noPktRssi bool
+    hweui string
+    region string
+    frequency string
+    regionCommandNumber int
+    firmware Firmware
+    setupCommands []string
+    settings map[string]string
+    receiveStartedAt time.Time
+    receiveAcked bool
+    rxStopOutstanding bool
+    receivedAt time.Time
+    tuneCommands []string
+    afterTune func()
+    restoreCommands []string
+    crcErrors uint32
+    scan *ScanPlan
+    scanCommands []string
+}
+
+// Metadata describes how a frame was received
+type Metadata struct {
+    SNR float32         // InvalidSNR if unknown
+    RSSI int32          // Zero if unknown
+    ReceivedAt time.Time
+    Frequency int       // In Hz, or zero if unknown
+    DataRate string     // Such as "SF7BW125"
+    CodingRate string   // Such as "4/5"
+}
+
+// InvalidSNR is the SNR of a frame whose SNR is unknown
+const InvalidSNR float32 = 123.456
+
+// Kinds of receive errors
+const (
+    ReceiveErrEmpty = "empty"               // The module reported a frame with no payload
+    ReceiveErrBadHex = "bad_hex"            // The module's hex was garbled
+    ReceiveErrOddLength = "odd_length"      // The module's hex was cut short in the middle of a byte
+)
+
+// ReceiveError is passed to OnReceiveError to describe why something that the module received
+// couldn't be passed on as a frame
+type ReceiveError struct {
+    Kind string
+    Detail string
+}
+
+// Error describes the error
+func (e *ReceiveError) Error() string {
+    return e.Kind + ": " + e.Detail
+}
+
+// An outbound command waiting to be transmitted, and when it was enqueued
+type outboundCommand struct {
+    Command []byte
+    QueuedAt time.Time
+    Deadline time.Time  // Zero unless it must go out at a particular time
+    Tx *TxParams        // Nil to transmit as we receive
+}
+
+// Determine whether an outbound command that must go out at a particular time can no longer do so
+func (ocmd *outboundCommand) missedDeadline() bool {
+    return !ocmd.Deadline.IsZero() && time.Now().After(ocmd.Deadline)
+}
+
+// Option configures a Controller
+type Option func(c *Controller)
+
+// WithSerialPort sets the serial port to which the module is attached.  If it is empty or
+// "auto", the module is found by probing the ports on which it is commonly found.
+func WithSerialPort(port string) Option {
+    return func(c *Controller) {
+        c.serialPort = port
+    }
+}
+
+// WithSerialConfig sets the speed, framing and parity of the serial port, whose name is ignored
+func WithSerialConfig(config serial.Config) Option {
+    return func(c *Controller) {
+        c.serialConfig = config
+    }
+}
+
+// WithPortsInUse provides the serial ports that are spoken for by other controllers, so
+// that they aren't disturbed when detecting which port this module is attached to
+func WithPortsInUse(f func() map[string]bool) Option {
+    return func(c *Controller) {
+        c.portsInUse = f
+    }
+}
+
+// WithTransport talks to the module through an already-open transport rather than a serial
+// port, such as an Emulator or a MemTransport.  If the transport fails, the serial port is
+// opened in its place.
+func WithTransport(t Transport) Option {
+    return func(c *Controller) {
+        c.transport = t
+    }
+}
+
+// WithReset sets the way in which the module is reset, which is by "sys reset" by default
+func WithReset(reset ResetStrategy) Option {
+    return func(c *Controller) {
+        c.reset = reset
+    }
+}
+
+// WithRegion sets the region in which we're operating, such as "eu" or "as923".  If it isn't
+// set, the region is selected by country or else by the band of the module.
+func WithRegion(region string) Option {
+    return func(c *Controller) {
+        c.configuredRegion = region
+    }
+}
+
+// WithCountry provides the ISO 3166 code of the country in which we find ourselves, which
+// is asked for whenever the module is reset because it may not be known right away
+func WithCountry(f func() string) Option {
+    return func(c *Controller) {
+        c.country = f
+    }
+}
+
+// WithFrequency sets the frequency on which we listen and reply, in Hz
+func WithFrequency(freq string) Option {
+    return func(c *Controller) {
+        c.frequency = freq
+    }
+}
+
+// WithParams provides the values of "radio set" parameters such as "sf" and "pwr" for the
+// region in which we're operating, returning the empty string to use the default
+func WithParams(f func(region string, name string) string) Option {
+    return func(c *Controller) {
+        c.paramLookup = f
+    }
+}
+
+// WithRecoveryPolicy sets how we recover a module that has stopped behaving
+func WithRecoveryPolicy(p RecoveryPolicy) Option {
+    return func(c *Controller) {
+        c.recovery = p
+    }
+}
+
+// WithScanPlan rotates the receiver through a plan of channels, provided that every one of
+// them is legal in the region in which we find ourselves
+func WithScanPlan(p *ScanPlan) Option {
+    return func(c *Controller) {
+        c.configuredScan = p
+    }
+}
+
+// WithTimeScale scales the delays with which we let the module settle and the timeouts with
+// which we await its replies, such as to keep pace with an Emulator whose time is sped up
+func WithTimeScale(scale float64) Option {
+    return func(c *Controller) {
+        c.timeScale = scale
+    }
+}
+
+// WithLogger sets where debug output goes, which is stdout by default
+func WithLogger(f func(format string, args ...interface{})) Option {
+    return func(c *Controller) {
+        c.logger = f
+    }
+}
+
+// WithVerbose logs everything that is read from the serial port
+func WithVerbose(verbose bool) Option {
+    return func(c *Controller) {
+        c.verbose = verbose
+    }
+}
+
+// WithHistorySize sets the number of entries kept in the controller's history
+func WithHistorySize(size int) Option {
+    return func(c *Controller) {
+        c.history = newHistory(size)
+    }
+}
+
+// WithTrace is called with every line sent to or received from the module, such as to record the session
+func WithTrace(f func(sent bool, line []byte)) Option {
+    return func(c *Controller) {
+        c.trace = f
+    }
+}
+
+// OnReceive is called with each frame received, along with how it was received.  It is called
+// from the controller's event loop, which means that a reply enqueued before it returns will be
+// transmitted before we resume receiving.
+func OnReceive(f func(frame []byte, meta Metadata)) Option {
+    return func(c *Controller) {
+        c.onReceive = f
+    }
+}
+
+// OnReceiveError is called from the controller's event loop with a *ReceiveError when the module
+// received something that it couldn't pass on, such as a line of garbled hex
+func OnReceiveError(f func(err error)) Option {
+    return func(c *Controller) {
+        c.onReceiveError = f
+    }
+}
+
+// OnStateChange is called from the controller's event loop whenever its state changes, and must not block
+func OnStateChange(f func(from State, to State)) Option {
+    return func(c *Controller) {
+        c.onStateChange = f
+    }
+}
+
+// OnReadyToTransmit is called from the controller's event loop just before it checks for
+// something to transmit, which is a chance to enqueue something at the last moment
+func OnReadyToTransmit(f func()) Option {
+    return func(c *Controller) {
+        c.onReadyToTransmit = f
+    }
+}
+
+// OnModuleLost is called when every other level of recovery has failed, such as to restart the
+// whole program.  If it returns, we start again at the bottom of the recovery ladder.
+func OnModuleLost(f func()) Option {
+    return func(c *Controller) {
+        c.onModuleLost = f
+    }
+}
+
+// New creates a controller, which doesn't touch the module until it is started
+func New(options ...Option) *Controller {
+    c := &Controller{}
+    c.serialConfig = serial.Config{Baud: 57600, Size: 8, Parity: serial.ParityNone, StopBits: serial.Stop1} // The module's default
+    c.outboundQueue = make(chan outboundCommand, 100) // Don't exhibit backpressure for a long time
+    c.events = make(chan controllerEvent, 100)
+    c.recovery = DefaultRecoveryPolicy()
+    c.timeScale = 1
+    c.opener = c.openSerial
+    c.history = newHistory(DefaultHistorySize)
+    for _, option := range options {
+        option(c)
+    }
+    if c.reset == nil {
+        c.reset = SoftwareReset(DefaultResetSettle)
+    }
+    sr, isSoftware := c.reset.(*softwareReset)
+    if isSoftware {
+        sr.controller = c
+    }
+    return c
+}
+
+// Start opens the module and begins processing, which continues in the background
+func (c *Controller) Start() {
+    c.logf("LPWAN reset: %s\n", c.reset)
+    c.ioInit()
+    go c.run()
+    go c.watchdogMain()
+}
+
+// Enqueue a frame to be transmitted.  This may be called from any goroutine.
+func (c *Controller) Enqueue(frame []byte) {
+    var ocmd outboundCommand
+    ocmd.Command = frame
+    ocmd.QueuedAt = time.Now()
+    c.outboundQueue <- ocmd
+    c.notify(eventOutbound)
+}
+
+// HoldChannel stays on the channel to which we're tuned if we're scanning, such as when
+// a device that we've just heard may be sent a reply
+func (c *Controller) HoldChannel() {
+    c.scanPlan().hold()
+}
+
+// HWEUI returns the module's EUI, once it is known
+func (c *Controller) HWEUI() string {
+    c.statsMutex.Lock()
+    defer c.statsMutex.Unlock()
+    return c.hweui
+}
+
+// Region returns the region in which we're operating, once it is known
+func (c *Controller) Region() string {
+    c.statsMutex.Lock()
+    defer c.statsMutex.Unlock()
+    return c.region
+}
+
+// CanStopReceive reports whether the module's firmware can stop a receive in progress.  Without
+// that, a transmission waits for the receive to end, and so can't be made at a particular time.
+func (c *Controller) CanStopReceive() bool {
+    return c.Firmware().supports(capabilityRxStop)
+}
+
+// Firmware returns the module's firmware, once it is known
+func (c *Controller) Firmware() Firmware {
+    c.statsMutex.Lock()
+    defer c.statsMutex.Unlock()
+    return c.firmware
+}
+
+// CRCErrors returns the number of packets that have been received with bad CRCs
+func (c *Controller) CRCErrors() uint32 {
+    c.statsMutex.Lock()
+    defer c.statsMutex.Unlock()
+    return c.crcErrors
+}
+
+// ChannelStats describes how many packets have been received on each channel, if we're scanning
+func (c *Controller) ChannelStats() string {
+    scan := c.scanPlan()
+    if scan == nil {
+        return ""
+    }
+    return scan.Stats()
+}
+
+// Get the scan plan that is in effect, if any
+func (c *Controller) scanPlan() *ScanPlan {
+    c.statsMutex.Lock()
+    defer c.statsMutex.Unlock()
+    return c.scan
+}
+
+// DutyCycleStats describes the remaining duty-cycle budget of each band that has been used
+func (c *Controller) DutyCycleStats() string {
+    c.statsMutex.Lock()
+    duty := c.duty
+    c.statsMutex.Unlock()
+    return duty.Stats()
+}
+
+// SerialPort returns the name of the serial port that is currently open, if any
+func (c *Controller) SerialPort() string {
+    st, isSerial := c.getTransport().(*serialTransport)
+    if isSerial {
+        return st.name
+    }
+    return ""
+}
+
+// Print debug output
+func (c *Controller) logf(format string, args ...interface{}) {
+    if c.logger != nil {
+        c.logger(format, args...)
+        return
+    }
+    go fmt.Printf(format, args...)
+}
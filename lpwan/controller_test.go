@@ -0,0 +1,144 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package lpwan
+
+import (
+    "bytes"
+    "strings"
+    "testing"
+    "time"
+)
+
+// How long to allow for the module to be configured from reset, which takes a while
+// because the state machine lets the module settle between the initialization commands
+const configureTimeout = 20 * time.Second
+
+// The scale of the controller's time, which lets the module settle for a twentieth of the
+// time that it would in the field: a fair bit longer than the emulator needs
+const testTimeScale = 0.05
+
+// A controller under test, along with what it has told us
+type testController struct {
+    *Controller
+    states chan State
+    received chan receivedFrame
+    traced chan string
+}
+
+// A frame handed to OnReceive
+type receivedFrame struct {
+    frame []byte
+    meta Metadata
+}
+
+// Create a controller that reports what it does on channels, so that a test may wait on it
+func newTestController(options ...Option) *testController {
+    tc := &testController{}
+    tc.states = make(chan State, 1000)
+    tc.received = make(chan receivedFrame, 100)
+    tc.traced = make(chan string, 1000)
+    options = append([]Option{WithLogger(quietLogger), WithTimeScale(testTimeScale)}, options...)
+    options = append(options,
+        OnStateChange(func(from State, to State) {
+            select {
+            case tc.states <- to:
+            default:
+            }
+        }),
+        OnReceive(func(frame []byte, meta Metadata) {
+            select {
+            case tc.received <- receivedFrame{frame, meta}:
+            default:
+            }
+        }),
+        WithTrace(func(sent bool, line []byte) {
+            prefix := "recv "
+            if sent {
+                prefix = "send "
+            }
+            select {
+            case tc.traced <- prefix + string(line):
+            default:
+            }
+        }))
+    tc.Controller = New(options...)
+    return tc
+}
+
+// Wait for the controller to enter a state
+func (tc *testController) awaitState(t *testing.T, want State, timeout time.Duration) {
+    t.Helper()
+    deadline := time.After(timeout)
+    for {
+        select {
+        case s := <-tc.states:
+            if s == want {
+                return
+            }
+        case <-deadline:
+            t.Fatalf("never entered %s", want)
+        }
+    }
+}
+
+// Wait for a line to be sent or received, as in "send radio rx 0" or "recv radio_tx_ok"
+func (tc *testController) awaitTrace(t *testing.T, prefix string, timeout time.Duration) string {
+    t.Helper()
+    deadline := time.After(timeout)
+    for {
+        select {
+        case line := <-tc.traced:
+            if strings.HasPrefix(line, prefix) {
+                return line
+            }
+        case <-deadline:
+            t.Fatalf("never saw %q", prefix)
+        }
+    }
+}
+
+// Wait for a frame to be received
+func (tc *testController) awaitReceive(t *testing.T, timeout time.Duration) receivedFrame {
+    t.Helper()
+    select {
+    case r := <-tc.received:
+        return r
+    case <-time.After(timeout):
+        t.Fatalf("nothing received")
+    }
+    return receivedFrame{}
+}
+
+// Drive an emulated module from reset, through receiving a frame, to transmitting one
+func TestEmulatorResetReceiveTransmit(t *testing.T) {
+    t.Parallel()
+
+    e := NewEmulator("RN2483")
+    e.SetTimeScale(0.01)
+    defer e.Close()
+    tc := newTestController(WithTransport(e), WithReset(EmulatorReset(e)))
+    tc.Start()
+
+    tc.awaitState(t, cmdStateLPWanRCVRPL, configureTimeout)
+    if tc.HWEUI() != e.HWEUI() {
+        t.Fatalf("HWEUI %q, want %q", tc.HWEUI(), e.HWEUI())
+    }
+    if tc.Region() == "" {
+        t.Fatalf("no region selected")
+    }
+
+    payload := []byte("hello")
+    e.Receive(payload)
+    r := tc.awaitReceive(t, 30 * time.Second)
+    if !bytes.Equal(r.frame, payload) {
+        t.Fatalf("received %q, want %q", r.frame, payload)
+    }
+
+    tc.Enqueue([]byte{0x01, 0x02, 0x03})
+    tc.awaitTrace(t, "send radio tx 010203", 30 * time.Second)
+    tc.awaitTrace(t, "recv radio_tx_ok", 30 * time.Second)
+    tc.awaitState(t, cmdStateLPWanRCVRPL, 30 * time.Second)
+
+}
@@ -0,0 +1,129 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Detection of which serial port the LPWAN module is attached to
+package lpwan
+
+import (
+    "bytes"
+    "io"
+    "path/filepath"
+    "strings"
+    "time"
+    "github.com/tarm/serial"
+)
+
+// Ports on which the module is commonly found: the Raspberry Pi's UART under its various
+// names, then USB serial adapters and USB CDC devices such as LoRa sticks.
+var serialCandidates = []string{
+    "/dev/serial0",
+    "/dev/ttyS0",
+    "/dev/ttyAMA0",
+    "/dev/ttyUSB*",
+    "/dev/ttyACM*",
+}
+
+// Where we looked for the module before we were able to detect it
+const serialLegacyPort = "/dev/ttyS0"
+
+// How long we wait for a module to reply to a probe
+const serialProbeTimeout = 2 * time.Second
+
+// Determine whether the port should be found by probing, rather than having been configured
+func serialAutoDetect(port string) bool {
+    return port == "" || strings.ToLower(port) == "auto"
+}
+
+// Find the port to which a module is attached by asking each candidate for its version,
+// skipping those that are already in use by other radios.  Each is probed with the
+// configuration of the template.
+func serialDetect(template serial.Config, inUse map[string]bool) (port string, version string) {
+
+    seen := map[string]bool{}
+    for name := range inUse {
+        real, err := filepath.EvalSymlinks(name)
+        if err == nil {
+            seen[real] = true
+        }
+    }
+    for _, pattern := range serialCandidates {
+        matches, _ := filepath.Glob(pattern)
+        for _, candidate := range matches {
+
+            // Don't probe the same device twice under different names
+            real, err := filepath.EvalSymlinks(candidate)
+            if err != nil || seen[real] {
+                continue
+            }
+            seen[real] = true
+
+            config := template
+            config.Name = candidate
+            version, ok := serialProbe(config)
+            if ok {
+                return candidate, version
+            }
+
+        }
+    }
+
+    return "", ""
+
+}
+
+// Probe a port for a module, returning its version banner if found
+func serialProbe(config serial.Config) (version string, ok bool) {
+
+    config.ReadTimeout = 500 * time.Millisecond
+    p, err := serial.OpenPort(&config)
+    if err != nil {
+        return "", false
+    }
+    defer p.Close()
+
+    p.Flush()
+    _, err = p.Write([]byte("sys get ver\r\n"))
+    if err != nil {
+        return "", false
+    }
+
+    buf := make([]byte, serialReadBufsize)
+    framer := newLineFramer(maxLineLength)
+    deadline := time.Now().Add(serialProbeTimeout)
+    for time.Now().Before(deadline) {
+        n, err := p.Read(buf)
+        if err != nil && err != io.EOF {
+            return "", false
+        }
+        for _, line := range framer.Write(buf[:n]) {
+            if bytes.HasPrefix(line, []byte("RN2483")) || bytes.HasPrefix(line, []byte("RN2903")) {
+                return string(line), true
+            }
+        }
+    }
+
+    return "", false
+
+}
+
+// Open the controller's serial port to the module, detecting it if it wasn't explicitly configured
+func (c *Controller) serialOpen(inUse map[string]bool) (*serialTransport, error) {
+
+    port := c.serialPort
+    if serialAutoDetect(port) {
+        found, version := serialDetect(c.serialConfig, inUse)
+        if found != "" {
+            c.logf("Found %s on %s\n", version, found)
+            port = found
+        } else {
+            // It may simply be wedged, in which case a reset will bring it back
+            port = serialLegacyPort
+        }
+    }
+
+    config := c.serialConfig
+    config.Name = port
+    return newSerialTransport(config, c.verbose)
+
+}
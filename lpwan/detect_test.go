@@ -0,0 +1,35 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package lpwan
+
+import (
+    "testing"
+    "github.com/tarm/serial"
+)
+
+// Probing a port finds each firmware's banner, from which its capabilities are known
+func TestSerialProbe(t *testing.T) {
+
+    for _, test := range firmwareBanners {
+        e := NewEmulator(test.model)
+        e.SetVersion(test.banner)
+        path, err := e.ServePty()
+        if err != nil {
+            e.Close()
+            t.Skipf("no pty: %v", err)
+        }
+        version, ok := serialProbe(serial.Config{Name: path, Baud: 57600})
+        e.Close()
+        if !ok || version != test.banner {
+            t.Errorf("%s: probe found %q", test.banner, version)
+            continue
+        }
+        fw, _ := parseFirmwareVersion(version)
+        if fw.supports(capabilityRxStop) != test.rxStop || fw.supports(capabilityPktRssi) != test.pktRssi {
+            t.Errorf("%s: capabilities of %s are wrong", test.banner, fw)
+        }
+    }
+
+}
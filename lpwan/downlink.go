@@ -0,0 +1,150 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Transmissions on a channel other than the one on which we receive, such as LoRaWAN downlinks
+package lpwan
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// TxParams describes how a frame is to be transmitted when that differs from how we receive
+type TxParams struct {
+    Frequency int         // In Hz
+    DataRate string       // Such as "SF9BW125"
+    InvertIQ bool         // As LoRaWAN downlinks are, so that other gateways don't hear them
+}
+
+// Settings that the module has when it comes out of reset, which we restore if we change them
+// without having set them ourselves
+var moduleDefaults = map[string]string{"sf": "sf12", "bw": "125", "cr": "4/5", "iqi": "off"}
+
+// EnqueueWith enqueues a frame to be transmitted with the specified parameters, after which
+// the radio is put back as it was.  If the deadline isn't zero, the frame is dropped rather than
+// transmitted after it.  This may be called from any goroutine.
+func (c *Controller) EnqueueWith(frame []byte, tx TxParams, deadline time.Time) {
+    var ocmd outboundCommand
+    ocmd.Command = frame
+    ocmd.QueuedAt = time.Now()
+    ocmd.Deadline = deadline
+    ocmd.Tx = &tx
+    c.outboundQueue <- ocmd
+    c.notify(eventOutbound)
+}
+
+// Get the radio's settings in the form in which they're given to a transmission
+func (t *TxParams) settings() map[string]string {
+    s := map[string]string{}
+    if t.Frequency != 0 {
+        s["freq"] = strconv.Itoa(t.Frequency)
+    }
+    sf, bw := 0, 0
+    fmt.Sscanf(strings.ToUpper(t.DataRate), "SF%dBW%d", &sf, &bw)
+    if sf != 0 {
+        s["sf"] = fmt.Sprintf("sf%d", sf)
+    }
+    if bw != 0 {
+        s["bw"] = strconv.Itoa(bw)
+    }
+    if t.InvertIQ {
+        s["iqi"] = "on"
+    } else {
+        s["iqi"] = "off"
+    }
+    return s
+}
+
+// Compute the time on air of a transmission
+func (t *TxParams) airtime(payloadLen int) time.Duration {
+    sf, bw := 12, 125
+    fmt.Sscanf(strings.ToUpper(t.DataRate), "SF%dBW%d", &sf, &bw)
+    return Airtime(payloadLen, sf, bw, 5, 8, true)
+}
+
+// Get how the radio is tuned, in the form in which it's described to a network server
+func (c *Controller) tuning() (freq int, datr string, codr string) {
+    setting := func(name string) string {
+        value := c.settings[name]
+        if value == "" {
+            value = moduleDefaults[name]
+        }
+        return value
+    }
+    freq, _ = strconv.Atoi(setting("freq"))
+    sf := 12
+    fmt.Sscanf(setting("sf"), "sf%d", &sf)
+    return freq, fmt.Sprintf("SF%dBW%s", sf, setting("bw")), setting("cr")
+}
+
+// Tune the radio for a transmission and then send it, remembering how to put the radio back afterward
+func (c *Controller) tuneForTransmit(ocmd outboundCommand, cmd string) {
+    tx := ocmd.Tx
+    commands := []string{}
+    c.restoreCommands = nil
+    for _, p := range loraParams {
+        value, present := tx.settings()[p.name]
+        if !present {
+            continue
+        }
+        was := c.settings[p.name]
+        if was == "" {
+            was = moduleDefaults[p.name]
+        }
+        if value == was {
+            continue
+        }
+        commands = append(commands, fmt.Sprintf("radio set %s %s", p.name, value))
+        if was != "" {
+            c.restoreCommands = append(c.restoreCommands, fmt.Sprintf("radio set %s %s", p.name, was))
+        }
+    }
+    c.tune(commands, func() {
+        // Tuning takes a round trip for each setting, which may have made us late
+        if ocmd.missedDeadline() {
+            c.logf("Not transmitting %d bytes: %dms past its deadline after tuning\n", len(ocmd.Command), time.Since(ocmd.Deadline) / time.Millisecond)
+            if !c.sentPendingOutbound() {
+                c.restartReceive()
+            }
+            return
+        }
+        c.send(cmd, cmdStateLPWanTXRPL1)
+    })
+}
+
+// If the last transmission left the radio tuned differently, put it back and then carry on,
+// returning true if that's what we're doing
+func (c *Controller) restoreAfterTransmit(then func()) bool {
+    if len(c.restoreCommands) == 0 {
+        return false
+    }
+    commands := c.restoreCommands
+    c.restoreCommands = nil
+    c.tune(commands, then)
+    return true
+}
+
+// Send a sequence of "radio set" commands, and then carry on
+func (c *Controller) tune(commands []string, then func()) {
+    c.tuneCommands = commands
+    c.afterTune = then
+    c.sendNextTuneCommand()
+}
+
+// Send the next of the commands that tune the radio, or carry on if there are none left
+func (c *Controller) sendNextTuneCommand() {
+    if len(c.tuneCommands) == 0 {
+        then := c.afterTune
+        c.afterTune = nil
+        if then != nil {
+            then()
+        }
+        return
+    }
+    cmd := c.tuneCommands[0]
+    c.tuneCommands = c.tuneCommands[1:]
+    c.send(cmd, cmdStateLPWanTUNERPL)
+}
@@ -0,0 +1,146 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package lpwan
+
+import (
+    "strings"
+    "testing"
+    "time"
+)
+
+// A controller that is configured for the EU and about to transmit, whose commands go to a MemTransport
+func newDownlinkController() (*Controller, *MemTransport) {
+    mt := NewMemTransport()
+    c := New(WithTransport(mt), WithLogger(quietLogger))
+    c.region = "eu"
+    c.duty = NewDutyLedger(c.region)
+    c.settings = map[string]string{"freq": "868100000", "sf": "sf7"}
+    return c, mt
+}
+
+// Get the commands that have been sent
+func sentCommands(mt *MemTransport) (commands []string) {
+    for {
+        select {
+        case cmd := <-mt.Sent():
+            commands = append(commands, string(cmd))
+        default:
+            return commands
+        }
+    }
+}
+
+// Reply "ok" to each tuning command until the controller moves on
+func acknowledgeTuning(c *Controller) {
+    for c.currentState == cmdStateLPWanTUNERPL {
+        c.process([]byte("ok"))
+    }
+}
+
+// A downlink is tuned for, transmitted, and the radio put back as it was
+func TestDownlinkTransmitted(t *testing.T) {
+
+    c, mt := newDownlinkController()
+    c.EnqueueWith([]byte{0x60, 0x01}, TxParams{Frequency: 869525000, DataRate: "SF9BW125", InvertIQ: true}, time.Now().Add(time.Minute))
+    if !c.sentPendingOutbound() {
+        t.Fatalf("downlink not sent")
+    }
+    acknowledgeTuning(c)
+    want := []string{"radio set freq 869525000", "radio set sf sf9", "radio set iqi on", "radio tx 6001"}
+    got := sentCommands(mt)
+    if strings.Join(got, ",") != strings.Join(want, ",") {
+        t.Fatalf("sent %q, want %q", got, want)
+    }
+
+    // It's charged against the duty cycle only once the module has accepted it
+    if c.DutyCycleStats() != "" {
+        t.Fatalf("charged before being accepted: %s", c.DutyCycleStats())
+    }
+    c.process([]byte("ok"))
+    if c.DutyCycleStats() == "" {
+        t.Fatalf("not charged once accepted")
+    }
+
+}
+
+// A downlink that is already late, or that becomes late while tuning for it, isn't transmitted
+func TestDownlinkDeadline(t *testing.T) {
+
+    c, mt := newDownlinkController()
+    c.EnqueueWith([]byte{0x60, 0x01}, TxParams{Frequency: 869525000, DataRate: "SF9BW125", InvertIQ: true}, time.Now().Add(-time.Millisecond))
+    if c.sentPendingOutbound() {
+        t.Fatalf("late downlink sent: %q", sentCommands(mt))
+    }
+    if len(sentCommands(mt)) != 0 {
+        t.Fatalf("late downlink tuned for")
+    }
+
+    c.EnqueueWith([]byte{0x60, 0x02}, TxParams{Frequency: 869525000, DataRate: "SF9BW125", InvertIQ: true}, time.Now().Add(20 * time.Millisecond))
+    if !c.sentPendingOutbound() {
+        t.Fatalf("downlink not tuned for")
+    }
+    time.Sleep(30 * time.Millisecond)
+    acknowledgeTuning(c)
+    for _, cmd := range sentCommands(mt) {
+        if strings.HasPrefix(cmd, "radio tx") {
+            t.Fatalf("downlink sent after its deadline")
+        }
+    }
+    if len(c.restoreCommands) != 0 || c.settings["freq"] != "868100000" || c.settings["iqi"] != "off" {
+        t.Fatalf("radio left tuned for the downlink: %v", c.settings)
+    }
+    if c.DutyCycleStats() != "" {
+        t.Fatalf("charged for downlinks that weren't sent: %s", c.DutyCycleStats())
+    }
+
+}
+
+// Nothing is transmitted on a frequency or at a power that isn't legal in the region, even if
+// it's what we were receiving on
+func TestTransmitWithinRegion(t *testing.T) {
+
+    tests := []struct {
+        freq string
+        pwr string
+        sent bool
+    }{
+        {"868100000", "14", true},
+        {"869525000", "", true},
+        {"915000000", "14", false},
+        {"433175000", "10", false},
+        {"", "14", false},
+        {"868100000", "20", false},
+    }
+
+    for _, test := range tests {
+        c, mt := newDownlinkController()
+        c.settings["freq"] = test.freq
+        c.settings["pwr"] = test.pwr
+        c.Enqueue([]byte{0x01})
+        if c.sentPendingOutbound() != test.sent {
+            t.Errorf("freq %q pwr %q: sent %v, want %v", test.freq, test.pwr, !test.sent, test.sent)
+        }
+        if !test.sent && len(sentCommands(mt)) != 0 {
+            t.Errorf("freq %q pwr %q: transmitted", test.freq, test.pwr)
+        }
+    }
+
+}
+
+// Only firmware with "radio rxstop" can transmit at a particular time
+func TestCanStopReceive(t *testing.T) {
+    c := New(WithLogger(quietLogger))
+    for version, want := range map[string]bool{
+        emulatorRN2483Version: false,
+        "RN2483 1.0.4 Oct 12 2017 14:59:25": true,
+        emulatorRN2903Version: false,
+        "RN2903 1.0.5 Nov 06 2018 10:45:27": true,
+    } {
+        c.firmware, _ = parseFirmwareVersion(version)
+        if c.CanStopReceive() != want {
+            t.Errorf("%s: CanStopReceive %v, want %v", version, !want, want)
+        }
+    }
+}
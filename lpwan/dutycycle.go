@@ -0,0 +1,158 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Accounting of transmit airtime against regional duty-cycle limits
+package lpwan
+
+import (
+    "fmt"
+    "sync"
+    "time"
+)
+
+// loraBand is a sub-band within which transmit airtime is limited to a fraction of the time
+type loraBand struct {
+    low int                     // In Hz
+    high int
+    duty float64                // Fraction of the window that we may spend transmitting
+}
+
+// Duty cycle is assessed over a sliding hour, as per ETSI EN 300 220
+const dutyWindow = 1 * time.Hour
+
+// How long an outbound may wait for budget before it's no longer worth sending
+const dutyMaxDefer = 5 * time.Minute
+
+// dutyTransmission is a single transmission recorded in the ledger
+type dutyTransmission struct {
+    at time.Time
+    band int
+    airtime time.Duration
+}
+
+// DutyLedger records a radio's recent transmissions, by band
+type DutyLedger struct {
+    mu sync.Mutex
+    bands []loraBand
+    history []dutyTransmission
+}
+
+// Find the band containing a frequency, or -1 if it isn't limited
+func (l *DutyLedger) band(freq int) int {
+    for i := range l.bands {
+        if freq >= l.bands[i].low && freq <= l.bands[i].high {
+            return i
+        }
+    }
+    return -1
+}
+
+// Discard transmissions that have aged out of the window; must be called with the lock held
+func (l *DutyLedger) expire(now time.Time) {
+    i := 0
+    for i < len(l.history) && now.Sub(l.history[i].at) >= dutyWindow {
+        i++
+    }
+    l.history = l.history[i:]
+}
+
+// Get the airtime used in a band within the window; must be called with the lock held
+func (l *DutyLedger) used(band int) (total time.Duration) {
+    for _, t := range l.history {
+        if t.band == band {
+            total += t.airtime
+        }
+    }
+    return total
+}
+
+// Get the budget of a band; must be called with the lock held
+func (l *DutyLedger) budget(band int) time.Duration {
+    return time.Duration(float64(dutyWindow) * l.bands[band].duty)
+}
+
+// Allowed determines whether a transmission is within budget and, if not, how long until it will be
+func (l *DutyLedger) Allowed(freq int, airtime time.Duration) (ok bool, wait time.Duration) {
+    if l == nil {
+        return true, 0
+    }
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    band := l.band(freq)
+    if band < 0 {
+        return true, 0
+    }
+
+    now := time.Now()
+    l.expire(now)
+    excess := l.used(band) + airtime - l.budget(band)
+    if excess <= 0 {
+        return true, 0
+    }
+
+    // Walk forward through the band's transmissions until enough have aged out
+    for _, t := range l.history {
+        if t.band != band {
+            continue
+        }
+        excess -= t.airtime
+        if excess <= 0 {
+            return false, t.at.Add(dutyWindow).Sub(now)
+        }
+    }
+
+    // It wouldn't fit even in an idle band
+    return false, dutyWindow
+}
+
+// Record records a transmission
+func (l *DutyLedger) Record(freq int, airtime time.Duration) {
+    if l == nil {
+        return
+    }
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    band := l.band(freq)
+    if band >= 0 {
+        l.history = append(l.history, dutyTransmission{at: time.Now(), band: band, airtime: airtime})
+    }
+}
+
+// Stats describes the remaining budget of each band that has been used
+func (l *DutyLedger) Stats() string {
+    if l == nil {
+        return ""
+    }
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    l.expire(time.Now())
+    s := ""
+    for i := range l.bands {
+        used := l.used(i)
+        if used == 0 {
+            continue
+        }
+        if s != "" {
+            s += ","
+        }
+        remaining := l.budget(i) - used
+        if remaining < 0 {
+            remaining = 0
+        }
+        s += fmt.Sprintf("%.1f-%.1fMHz:%.1fs", float64(l.bands[i].low) / 1000000, float64(l.bands[i].high) / 1000000, remaining.Seconds())
+    }
+    return s
+}
+
+// NewDutyLedger creates the ledger for a region, or nil if the region doesn't limit duty cycle
+func NewDutyLedger(region string) *DutyLedger {
+    plan := loraRegionFind(region)
+    if plan == nil || len(plan.bands) == 0 {
+        return nil
+    }
+    return &DutyLedger{bands: plan.bands}
+}
@@ -0,0 +1,409 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Software emulation of the Microchip RN2483/RN2903, for integration testing and demos
+package lpwan
+
+import (
+    "encoding/hex"
+    "fmt"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Emulator models the subset of the module's ASCII command set that is used by the Controller.
+// It is itself a Transport, so it may be attached in-process with WithTransport, or it
+// may be served over a pseudo-terminal so that the real serial transport talks to it.
+type Emulator struct {
+    mu sync.Mutex
+    lines chan []byte
+    closed chan struct{}
+    closeOnce sync.Once
+
+    // Identity
+    model string
+    version string
+    hweui string
+
+    // Radio state
+    wdt time.Duration
+    receiving bool
+    transmitting bool
+    rxTimer *time.Timer
+    pendingRx []string
+    snr int
+    rssi int
+
+    // Scales all radio timing, so that a test need not wait the full 54321ms receive window
+    timeScale float64
+    txDuration time.Duration
+
+    // Fault injection
+    wedged bool
+    stalled bool
+    busyRemaining int
+    dropRemaining int
+
+    // Statistics
+    commandsReceived int
+}
+
+// Default firmware identification strings, as reported by "sys get ver"
+const (
+    emulatorRN2483Version = "RN2483 1.0.1 Dec 15 2015 09:38:09"
+    emulatorRN2903Version = "RN2903 1.0.3 Aug  8 2017 15:11:09"
+)
+
+// NewEmulator creates an emulator of the specified model, either "RN2483" or "RN2903"
+func NewEmulator(model string) *Emulator {
+    e := &Emulator{}
+    e.lines = make(chan []byte, memTransportQueueDepth)
+    e.closed = make(chan struct{})
+    e.model = strings.ToUpper(model)
+    if e.model == "RN2903" {
+        e.version = emulatorRN2903Version
+        e.hweui = "0004A30B001E0F03"
+    } else {
+        e.model = "RN2483"
+        e.version = emulatorRN2483Version
+        e.hweui = "0004A30B001C4D12"
+    }
+    e.wdt = 15000 * time.Millisecond
+    e.snr = 7
+    e.rssi = -87
+    e.timeScale = 1.0
+    e.txDuration = 200 * time.Millisecond
+    return e
+}
+
+// SetTimeScale scales all emulated radio timing by the specified factor
+func (e *Emulator) SetTimeScale(scale float64) {
+    e.mu.Lock()
+    e.timeScale = scale
+    e.mu.Unlock()
+}
+
+// Model returns the model being emulated
+func (e *Emulator) Model() string {
+    return e.model
+}
+
+// SetHWEUI overrides the "sys get hweui" reply, so that several emulated modules may be told apart
+func (e *Emulator) SetHWEUI(hweui string) {
+    e.mu.Lock()
+    e.hweui = hweui
+    e.mu.Unlock()
+}
+
+// HWEUI returns the "sys get hweui" reply
+func (e *Emulator) HWEUI() string {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    return e.hweui
+}
+
+// SetVersion overrides the "sys get ver" reply, such as to emulate older firmware
+func (e *Emulator) SetVersion(version string) {
+    e.mu.Lock()
+    e.version = version
+    e.mu.Unlock()
+}
+
+// SetSNR sets the SNR reported for the next received packets
+func (e *Emulator) SetSNR(snr int) {
+    e.mu.Lock()
+    e.snr = snr
+    e.mu.Unlock()
+}
+
+// SetRSSI sets the RSSI reported for the next received packets
+func (e *Emulator) SetRSSI(rssi int) {
+    e.mu.Lock()
+    e.rssi = rssi
+    e.mu.Unlock()
+}
+
+// Wedge causes the emulated module to silently swallow all commands, as a hung module does
+func (e *Emulator) Wedge(wedged bool) {
+    e.mu.Lock()
+    e.wedged = wedged
+    e.mu.Unlock()
+}
+
+// StallReceive causes a "radio rx" to never terminate, neither by packet nor by watchdog
+func (e *Emulator) StallReceive(stalled bool) {
+    e.mu.Lock()
+    e.stalled = stalled
+    e.mu.Unlock()
+}
+
+// BusyStorm causes the next n commands to be rejected with "busy"
+func (e *Emulator) BusyStorm(n int) {
+    e.mu.Lock()
+    e.busyRemaining = n
+    e.mu.Unlock()
+}
+
+// DropReplies causes the replies to the next n commands to be lost, as in a reply timeout
+func (e *Emulator) DropReplies(n int) {
+    e.mu.Lock()
+    e.dropRemaining = n
+    e.mu.Unlock()
+}
+
+// CommandsReceived returns the number of commands the emulator has been sent
+func (e *Emulator) CommandsReceived() int {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    return e.commandsReceived
+}
+
+// Receive emulates a packet arriving over the air.  If a receive is in progress it
+// completes immediately, else the packet is heard by the next "radio rx".
+func (e *Emulator) Receive(payload []byte) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    hexPayload := strings.ToUpper(hex.EncodeToString(payload))
+    if e.receiving && !e.stalled {
+        e.completeReceive("radio_rx  " + hexPayload)
+        return
+    }
+    e.pendingRx = append(e.pendingRx, hexPayload)
+}
+
+// Reset emulates a hardware reset of the module, which aborts any radio
+// operation in progress and announces the firmware version
+func (e *Emulator) Reset() {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    e.resetRadio()
+    e.wedged = false
+    e.stalled = false
+    e.busyRemaining = 0
+    e.dropRemaining = 0
+    e.reply(e.version)
+}
+
+// ReadLine returns the next reply from the emulated module
+func (e *Emulator) ReadLine() ([]byte, error) {
+    select {
+    case line := <-e.lines:
+        return line, nil
+    case <-e.closed:
+        return nil, ErrTransportClosed
+    }
+}
+
+// WriteCommand processes a command sent to the emulated module
+func (e *Emulator) WriteCommand(cmd []byte) error {
+    select {
+    case <-e.closed:
+        return ErrTransportClosed
+    default:
+    }
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    e.command(strings.TrimSpace(string(cmd)))
+    return nil
+}
+
+// Flush discards replies that have not yet been read
+func (e *Emulator) Flush() {
+    for {
+        select {
+        case <-e.lines:
+        default:
+            return
+        }
+    }
+}
+
+// Close shuts down the emulator
+func (e *Emulator) Close() error {
+    e.closeOnce.Do(func() {
+        e.mu.Lock()
+        e.resetRadio()
+        e.mu.Unlock()
+        close(e.closed)
+    })
+    return nil
+}
+
+// Queue a reply line; must be called with the lock held
+func (e *Emulator) reply(line string) {
+    select {
+    case e.lines <- []byte(line):
+    default:
+        go fmt.Printf("emulator: reply queue full, dropping '%s'\n", line)
+    }
+}
+
+// Scale a duration by the time scale; must be called with the lock held
+func (e *Emulator) scaled(d time.Duration) time.Duration {
+    return time.Duration(float64(d) * e.timeScale)
+}
+
+// Determine whether the emulated firmware has an optional command; must be called with the lock held
+func (e *Emulator) supports(capability string) bool {
+    fw, _ := parseFirmwareVersion(e.version)
+    return fw.supports(capability)
+}
+
+// Abort any radio operation in progress; must be called with the lock held
+func (e *Emulator) resetRadio() {
+    if e.rxTimer != nil {
+        e.rxTimer.Stop()
+        e.rxTimer = nil
+    }
+    e.receiving = false
+    e.transmitting = false
+}
+
+// Finish a receive in progress with the specified reply; must be called with the lock held
+func (e *Emulator) completeReceive(line string) {
+    if e.rxTimer != nil {
+        e.rxTimer.Stop()
+        e.rxTimer = nil
+    }
+    e.receiving = false
+    e.reply(line)
+}
+
+// Process a single command; must be called with the lock held
+func (e *Emulator) command(cmd string) {
+
+    e.commandsReceived++
+
+    // Fault injection
+    if e.wedged {
+        return
+    }
+    if e.dropRemaining > 0 {
+        e.dropRemaining--
+        return
+    }
+    if e.busyRemaining > 0 {
+        e.busyRemaining--
+        e.reply("busy")
+        return
+    }
+
+    args := strings.Fields(cmd)
+    if len(args) < 2 {
+        e.reply("invalid_param")
+        return
+    }
+
+    switch args[0] + " " + args[1] {
+
+    case "sys get":
+        if len(args) == 3 && args[2] == "ver" {
+            e.reply(e.version)
+        } else if len(args) == 3 && args[2] == "hweui" {
+            e.reply(e.hweui)
+        } else {
+            e.reply("invalid_param")
+        }
+
+    case "sys reset":
+        e.resetRadio()
+        e.reply(e.version)
+
+    case "mac pause":
+        e.reply("4294967245")
+
+    case "radio set":
+        if len(args) != 4 {
+            e.reply("invalid_param")
+            return
+        }
+        if args[2] == "wdt" {
+            ms, err := strconv.Atoi(args[3])
+            if err != nil || ms < 0 {
+                e.reply("invalid_param")
+                return
+            }
+            e.wdt = time.Duration(ms) * time.Millisecond
+        }
+        e.reply("ok")
+
+    case "radio get":
+        if len(args) == 3 && args[2] == "snr" {
+            e.reply(strconv.Itoa(e.snr))
+        } else if len(args) == 3 && args[2] == "pktrssi" && e.supports(capabilityPktRssi) {
+            e.reply(strconv.Itoa(e.rssi))
+        } else {
+            e.reply("invalid_param")
+        }
+
+    case "radio rx":
+        if e.receiving || e.transmitting {
+            e.reply("busy")
+            return
+        }
+        e.receiving = true
+        e.reply("ok")
+        if e.stalled {
+            return
+        }
+        if len(e.pendingRx) > 0 {
+            payload := e.pendingRx[0]
+            e.pendingRx = e.pendingRx[1:]
+            e.completeReceive("radio_rx  " + payload)
+            return
+        }
+        if e.wdt > 0 {
+            e.rxTimer = time.AfterFunc(e.scaled(e.wdt), func() {
+                e.mu.Lock()
+                defer e.mu.Unlock()
+                if e.receiving && !e.stalled {
+                    e.completeReceive("radio_err")
+                }
+            })
+        }
+
+    case "radio rxstop":
+        if !e.supports(capabilityRxStop) || !e.receiving {
+            e.reply("invalid_param")
+            return
+        }
+        if e.rxTimer != nil {
+            e.rxTimer.Stop()
+            e.rxTimer = nil
+        }
+        e.receiving = false
+        e.reply("ok")
+
+    case "radio tx":
+        if len(args) != 3 || len(args[2])%2 != 0 {
+            e.reply("invalid_param")
+            return
+        }
+        if _, err := hex.DecodeString(args[2]); err != nil {
+            e.reply("invalid_param")
+            return
+        }
+        if e.receiving || e.transmitting {
+            e.reply("busy")
+            return
+        }
+        e.transmitting = true
+        e.reply("ok")
+        time.AfterFunc(e.scaled(e.txDuration), func() {
+            e.mu.Lock()
+            defer e.mu.Unlock()
+            if e.transmitting {
+                e.transmitting = false
+                e.reply("radio_tx_ok")
+            }
+        })
+
+    default:
+        e.reply("invalid_param")
+
+    }
+
+}
@@ -0,0 +1,71 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Serving the module emulator over a Linux pseudo-terminal
+package lpwan
+
+import (
+    "fmt"
+    "os"
+    "syscall"
+    "unsafe"
+)
+
+// ServePty creates a pseudo-terminal whose far end behaves like a module's UART, returning
+// the path of the device that the gateway (or any other program) should open
+func (e *Emulator) ServePty() (string, error) {
+
+    master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+    if err != nil {
+        return "", err
+    }
+
+    // unlockpt()
+    var unlock int32
+    _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock)))
+    if errno != 0 {
+        master.Close()
+        return "", errno
+    }
+
+    // ptsname()
+    var ptn uint32
+    _, _, errno = syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&ptn)))
+    if errno != 0 {
+        master.Close()
+        return "", errno
+    }
+    path := fmt.Sprintf("/dev/pts/%d", ptn)
+
+    // Commands written by the gateway arrive on the master side
+    go func() {
+        buf := make([]byte, serialReadBufsize)
+        framer := newLineFramer(maxLineLength)
+        for {
+            n, err := master.Read(buf)
+            if err != nil {
+                e.Close()
+                return
+            }
+            for _, line := range framer.Write(buf[:n]) {
+                e.WriteCommand(line)
+            }
+        }
+    }()
+
+    // Replies from the emulator are written back to the master side
+    go func() {
+        for {
+            line, err := e.ReadLine()
+            if err != nil {
+                master.Close()
+                return
+            }
+            master.Write(append(line, []byte("\r\n")...))
+        }
+    }()
+
+    return path, nil
+
+}
@@ -0,0 +1,18 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+// Serving the module emulator over a pseudo-terminal is only supported on Linux
+package lpwan
+
+import (
+    "errors"
+)
+
+// ServePty is not supported on this platform
+func (e *Emulator) ServePty() (string, error) {
+    return "", errors.New("emulator pty is only supported on linux")
+}
@@ -0,0 +1,92 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Module firmware identification, and the commands that each firmware version supports
+package lpwan
+
+import (
+    "fmt"
+    "strings"
+    "time"
+)
+
+// Optional commands, which aren't understood by older firmware
+const (
+    capabilityPktRssi = "pktrssi"       // radio get pktrssi
+    capabilityRxStop = "rxstop"         // radio rxstop
+)
+
+// Firmware identifies the firmware of a module, as reported by "sys get ver"
+type Firmware struct {
+    Model string
+    Version string
+    BuildDate string
+}
+
+// firmwareCapability is the first firmware version of a model to support an optional command
+type firmwareCapability struct {
+    capability string
+    model string
+    version int
+}
+
+// From Microchip's firmware release notes
+var firmwareCapabilities = []firmwareCapability{
+    {capabilityPktRssi, "RN2483", 10005},
+    {capabilityPktRssi, "RN2903", 10005},
+    {capabilityRxStop, "RN2483", 10004},
+    {capabilityRxStop, "RN2903", 10005},
+}
+
+// Parse the reply to "sys get ver", such as "RN2483 1.0.1 Dec 15 2015 09:38:09"
+func parseFirmwareVersion(s string) (fw Firmware, ok bool) {
+
+    fields := strings.Fields(s)
+    if len(fields) < 2 {
+        return fw, false
+    }
+    if fields[0] != "RN2483" && fields[0] != "RN2903" {
+        return fw, false
+    }
+    fw.Model = fields[0]
+    fw.Version = fields[1]
+
+    // The day of the month is space-padded, which Fields has taken care of for us
+    if len(fields) >= 6 {
+        built, err := time.Parse("Jan 2 2006 15:04:05", strings.Join(fields[2:6], " "))
+        if err == nil {
+            fw.BuildDate = built.Format("2006-01-02T15:04:05")
+        }
+    }
+
+    return fw, fw.versionNumber() != 0
+
+}
+
+// The version as a comparable number, such as 10005 for 1.0.5
+func (fw Firmware) versionNumber() int {
+    var major, minor, patch int
+    n, _ := fmt.Sscanf(fw.Version, "%d.%d.%d", &major, &minor, &patch)
+    if n != 3 {
+        return 0
+    }
+    return major*10000 + minor*100 + patch
+}
+
+// Determine whether the firmware supports an optional command.  If we don't know what the
+// firmware is, we assume that it doesn't.
+func (fw Firmware) supports(capability string) bool {
+    version := fw.versionNumber()
+    for _, c := range firmwareCapabilities {
+        if c.capability == capability && c.model == fw.Model {
+            return version >= c.version
+        }
+    }
+    return false
+}
+
+// String describes the firmware
+func (fw Firmware) String() string {
+    return fmt.Sprintf("%s %s (%s)", fw.Model, fw.Version, fw.BuildDate)
+}
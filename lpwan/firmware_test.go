@@ -0,0 +1,63 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package lpwan
+
+import (
+    "testing"
+)
+
+// Banners reported by "sys get ver" on the firmware releases that we've seen in the field
+var firmwareBanners = []struct {
+    banner string
+    model string
+    version string
+    built string
+    pktRssi bool
+    rxStop bool
+}{
+    {"RN2483 1.0.1 Dec 15 2015 09:38:09", "RN2483", "1.0.1", "2015-12-15T09:38:09", false, false},
+    {"RN2483 1.0.3 Mar 22 2017 06:00:42", "RN2483", "1.0.3", "2017-03-22T06:00:42", false, false},
+    {"RN2483 1.0.4 Oct 12 2017 14:59:25", "RN2483", "1.0.4", "2017-10-12T14:59:25", false, true},
+    {"RN2483 1.0.5 Oct 31 2018 15:06:52", "RN2483", "1.0.5", "2018-10-31T15:06:52", true, true},
+    {"RN2903 1.0.3 Aug  8 2017 15:11:09", "RN2903", "1.0.3", "2017-08-08T15:11:09", false, false},
+    {"RN2903 1.0.5 Nov 06 2018 10:45:27", "RN2903", "1.0.5", "2018-11-06T10:45:27", true, true},
+}
+
+// The model, version and capabilities are parsed from each firmware's banner
+func TestFirmwareCapabilities(t *testing.T) {
+
+    for _, test := range firmwareBanners {
+        fw, ok := parseFirmwareVersion(test.banner)
+        if !ok {
+            t.Errorf("%s: not parsed", test.banner)
+            continue
+        }
+        if fw.Model != test.model || fw.Version != test.version || fw.BuildDate != test.built {
+            t.Errorf("%s: parsed as %s", test.banner, fw)
+        }
+        if fw.supports(capabilityPktRssi) != test.pktRssi {
+            t.Errorf("%s: pktrssi %v, want %v", test.banner, !test.pktRssi, test.pktRssi)
+        }
+        if fw.supports(capabilityRxStop) != test.rxStop {
+            t.Errorf("%s: rxstop %v, want %v", test.banner, !test.rxStop, test.rxStop)
+        }
+    }
+
+}
+
+// Anything else that the module may say isn't taken for a banner, and supports nothing optional
+func TestFirmwareNotBanner(t *testing.T) {
+
+    for _, s := range []string{"", "ok", "invalid_param", "RN2483", "RN2483 1.0", "RN2483 v1.0.5", "RN2843 1.0.5 Oct 31 2018 15:06:52"} {
+        fw, ok := parseFirmwareVersion(s)
+        if ok {
+            t.Errorf("%q parsed as %s", s, fw)
+        }
+        if fw.supports(capabilityPktRssi) || fw.supports(capabilityRxStop) {
+            t.Errorf("%q supports optional commands", s)
+        }
+    }
+
+}
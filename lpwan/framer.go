@@ -0,0 +1,97 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Assembly of module replies into lines from an arbitrary stream of bytes
+package lpwan
+
+// The longest legitimate line is "radio_rx  " followed by a 255-byte payload in hex,
+// so anything much longer than that is noise that never saw a delimiter.
+const maxLineLength = 600
+
+// lineFramer incrementally splits a byte stream into CR and/or LF delimited lines.
+// The module speaks a printable-ASCII protocol, so other bytes are treated as noise:
+// noise before the first character of a line (such as the burst of nulls we see just
+// after a reset) is silently skipped, while noise within a line garbles that line
+// and it is discarded when its delimiter arrives.  Lines longer than the maximum are
+// discarded in their entirety, so memory use is bounded no matter what arrives.
+type lineFramer struct {
+    line []byte
+    maxLength int
+    garbled bool
+    overlong bool
+
+    // Statistics
+    noiseBytes uint32
+    garbledLines uint32
+    overlongLines uint32
+}
+
+// Create a line framer with the specified maximum line length
+func newLineFramer(maxLength int) *lineFramer {
+    f := &lineFramer{}
+    f.maxLength = maxLength
+    f.line = make([]byte, 0, maxLength)
+    return f
+}
+
+// Write feeds a chunk of the stream to the framer, returning the complete lines that it
+// contained.  Returned lines do not alias the framer's buffer or the caller's chunk.
+func (f *lineFramer) Write(p []byte) (lines [][]byte) {
+
+    for _, b := range p {
+
+        // A delimiter completes the current line, if any
+        if b == '\r' || b == '\n' {
+            if f.garbled {
+                f.garbledLines++
+            } else if f.overlong {
+                f.overlongLines++
+            } else if len(f.line) > 0 {
+                lines = append(lines, append([]byte(nil), f.line...))
+            }
+            f.line = f.line[:0]
+            f.garbled = false
+            f.overlong = false
+            continue
+        }
+
+        // Non-printable characters are noise
+        if b < ' ' || b >= 0x7f {
+            f.noiseBytes++
+            if len(f.line) > 0 {
+                f.garbled = true
+            }
+            continue
+        }
+
+        // Once a line is known to be bad, just wait for its delimiter
+        if f.garbled || f.overlong {
+            continue
+        }
+        if len(f.line) >= f.maxLength {
+            f.overlong = true
+            f.line = f.line[:0]
+            continue
+        }
+
+        f.line = append(f.line, b)
+
+    }
+
+    return lines
+
+}
+
+// Reset discards any partially-assembled line, such as when the module has been reset
+// and whatever preceded the reset is meaningless
+func (f *lineFramer) Reset() {
+    f.line = f.line[:0]
+    f.garbled = false
+    f.overlong = false
+}
+
+// Pending returns the number of bytes of the partially-assembled line
+func (f *lineFramer) Pending() int {
+    return len(f.line)
+}
@@ -0,0 +1,168 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package lpwan
+
+import (
+    "bytes"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// Feed a stream to a new framer in chunks of the specified sizes, cycling through them,
+// or all at once if there are none
+func frameInChunks(stream []byte, sizes []int) (lines [][]byte, f *lineFramer) {
+    f = newLineFramer(maxLineLength)
+    for i := 0; len(stream) > 0; i++ {
+        n := len(stream)
+        if len(sizes) > 0 {
+            n = sizes[i % len(sizes)]
+        }
+        if n < 1 || n > len(stream) {
+            n = len(stream)
+        }
+        lines = append(lines, f.Write(stream[:n])...)
+        stream = stream[n:]
+    }
+    return lines, f
+}
+
+// Convert lines to strings so that failures are readable
+func lineStrings(lines [][]byte) []string {
+    s := []string{}
+    for _, line := range lines {
+        s = append(s, string(line))
+    }
+    return s
+}
+
+// Noise that surrounds lines is skipped, while noise within a line discards it
+func TestLineFramerNoise(t *testing.T) {
+
+    tests := []struct {
+        name string
+        stream string
+        lines []string
+        noise uint32
+        garbled uint32
+    }{
+        {"clean", "ok\r\nradio_err\r\n", []string{"ok", "radio_err"}, 0, 0},
+        {"lf only", "ok\nbusy\n", []string{"ok", "busy"}, 0, 0},
+        {"blank lines", "\r\n\r\nok\r\n\n", []string{"ok"}, 0, 0},
+        {"post-reset null burst", "\x00\x00\x00\x00RN2483 1.0.1 Dec 15 2015 09:38:09\r\n", []string{"RN2483 1.0.1 Dec 15 2015 09:38:09"}, 4, 0},
+        {"null burst between lines", "ok\r\n\x00\x00\x00radio_err\r\n", []string{"ok", "radio_err"}, 3, 0},
+        {"null burst after text", "ok\x00\x00\r\nbusy\r\n", []string{"busy"}, 2, 1},
+        {"high bit within line", "radio_rx  01\xff02\r\nok\r\n", []string{"ok"}, 1, 1},
+        {"unterminated", "ok\r\nradio_", []string{"ok"}, 0, 0},
+    }
+
+    for _, test := range tests {
+        lines, f := frameInChunks([]byte(test.stream), nil)
+        got := lineStrings(lines)
+        if !reflect.DeepEqual(got, test.lines) {
+            t.Errorf("%s: lines %q, want %q", test.name, got, test.lines)
+        }
+        if f.noiseBytes != test.noise {
+            t.Errorf("%s: %d noise bytes, want %d", test.name, f.noiseBytes, test.noise)
+        }
+        if f.garbledLines != test.garbled {
+            t.Errorf("%s: %d garbled lines, want %d", test.name, f.garbledLines, test.garbled)
+        }
+    }
+
+}
+
+// Lines too long to be legitimate are discarded whole, and the framer recovers at the next delimiter
+func TestLineFramerOverlong(t *testing.T) {
+    stream := strings.Repeat("A", maxLineLength + 1) + "\r\nok\r\n"
+    lines, f := frameInChunks([]byte(stream), []int{7})
+    got := lineStrings(lines)
+    if !reflect.DeepEqual(got, []string{"ok"}) {
+        t.Fatalf("lines %q, want [ok]", got)
+    }
+    if f.overlongLines != 1 {
+        t.Fatalf("%d overlong lines, want 1", f.overlongLines)
+    }
+    if f.Pending() != 0 {
+        t.Fatalf("%d bytes pending", f.Pending())
+    }
+}
+
+// Reset discards whatever was partially assembled, whether good or bad
+func TestLineFramerReset(t *testing.T) {
+
+    tests := []struct {
+        name string
+        before string
+        pending int
+    }{
+        {"partial line", "radio_rx  0102", len("radio_rx  0102")},
+        {"garbled line", "radio_rx\x00 0102", len("radio_rx")},
+        {"overlong line", strings.Repeat("B", maxLineLength + 10), 0},
+        {"nothing", "", 0},
+    }
+
+    for _, test := range tests {
+        f := newLineFramer(maxLineLength)
+        lines := f.Write([]byte(test.before))
+        if len(lines) != 0 {
+            t.Errorf("%s: lines %q before reset", test.name, lineStrings(lines))
+        }
+        if f.Pending() != test.pending {
+            t.Errorf("%s: %d bytes pending, want %d", test.name, f.Pending(), test.pending)
+        }
+        f.Reset()
+        if f.Pending() != 0 {
+            t.Errorf("%s: %d bytes pending after reset", test.name, f.Pending())
+        }
+        got := lineStrings(f.Write([]byte("\x00\x00RN2483 1.0.1\r\n")))
+        if !reflect.DeepEqual(got, []string{"RN2483 1.0.1"}) {
+            t.Errorf("%s: lines %q after reset", test.name, got)
+        }
+        if f.garbledLines != 0 || f.overlongLines != 0 {
+            t.Errorf("%s: %d garbled and %d overlong after reset", test.name, f.garbledLines, f.overlongLines)
+        }
+    }
+
+}
+
+// Whatever arrives, lines are bounded and printable, and don't depend on how the stream was chunked
+func FuzzLineFramer(f *testing.F) {
+    f.Add([]byte("ok\r\nradio_err\r\n"), []byte{1})
+    f.Add([]byte("\x00\x00\x00RN2483 1.0.1 Dec 15 2015 09:38:09\r\n"), []byte{3, 1, 4})
+    f.Add([]byte("radio_rx  0102\x00FF\r\nbusy\n"), []byte{2})
+    f.Add([]byte(strings.Repeat("A", maxLineLength + 1) + "\r\nok\r\n"), []byte{100, 7})
+    f.Add([]byte("\r\n\n\r\xff\x7f\x1b[0m"), []byte{})
+
+    f.Fuzz(func(t *testing.T, stream []byte, chunks []byte) {
+
+        whole, _ := frameInChunks(stream, nil)
+        for _, line := range whole {
+            if len(line) == 0 || len(line) > maxLineLength {
+                t.Fatalf("line of %d bytes", len(line))
+            }
+            for _, b := range line {
+                if b < ' ' || b >= 0x7f {
+                    t.Fatalf("line %q contains %#02x", line, b)
+                }
+            }
+        }
+
+        sizes := []int{}
+        for _, c := range chunks {
+            sizes = append(sizes, int(c) + 1)
+        }
+        chunked, _ := frameInChunks(stream, sizes)
+        if len(chunked) != len(whole) {
+            t.Fatalf("%d lines in chunks of %v, but %d whole", len(chunked), sizes, len(whole))
+        }
+        for i := range whole {
+            if !bytes.Equal(chunked[i], whole[i]) {
+                t.Fatalf("line %d is %q in chunks of %v, but %q whole", i, chunked[i], sizes, whole[i])
+            }
+        }
+
+    })
+}
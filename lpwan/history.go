@@ -0,0 +1,88 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// A bounded history of what the controller has done, for diagnosing a module that misbehaves
+package lpwan
+
+import (
+    "sync"
+    "time"
+)
+
+// DefaultHistorySize is the number of entries kept unless otherwise configured
+const DefaultHistorySize = 250
+
+// Kinds of history entries
+const (
+    HistoryState = "state"          // The state changed, from the state in Detail
+    HistorySend = "send"            // A command was sent
+    HistoryRecv = "recv"            // A reply was received
+    HistoryTimeout = "timeout"      // No reply came to the command in Detail
+    HistoryRecover = "recover"      // We began to recover from misbehavior, for the reason in Detail
+    HistoryReinit = "reinit"        // The module was reset and is being reconfigured
+    HistoryReopen = "reopen"        // The serial port was reopened
+)
+
+// HistoryEntry is a single thing that happened, and the state we were in when it did
+type HistoryEntry struct {
+    At time.Time `json:"at"`
+    Kind string `json:"kind"`
+    State string `json:"state"`
+    Detail string `json:"detail,omitempty"`
+}
+
+// A ring of the most recent entries
+type history struct {
+    mu sync.Mutex
+    entries []HistoryEntry
+    next int
+    full bool
+}
+
+// Create a history that keeps the specified number of entries
+func newHistory(size int) *history {
+    if size < 1 {
+        size = 1
+    }
+    return &history{entries: make([]HistoryEntry, size)}
+}
+
+// Add an entry, replacing the oldest if the ring is full
+func (h *history) add(e HistoryEntry) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.entries[h.next] = e
+    h.next++
+    if h.next == len(h.entries) {
+        h.next = 0
+        h.full = true
+    }
+}
+
+// Get the entries, oldest first
+func (h *history) get() []HistoryEntry {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if !h.full {
+        return append([]HistoryEntry{}, h.entries[:h.next]...)
+    }
+    return append(append([]HistoryEntry{}, h.entries[h.next:]...), h.entries[:h.next]...)
+}
+
+// Record something that happened.  Must be called from the event loop.
+func (c *Controller) remember(kind string, detail string) {
+    c.history.add(HistoryEntry{At: time.Now().UTC(), Kind: kind, State: c.currentState.String(), Detail: detail})
+}
+
+// History returns what the controller has done most recently, oldest first
+func (c *Controller) History() []HistoryEntry {
+    return c.history.get()
+}
+
+// State returns the current state of the controller's state machine
+func (c *Controller) State() State {
+    c.statsMutex.Lock()
+    defer c.statsMutex.Unlock()
+    return c.currentState
+}
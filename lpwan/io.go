@@ -0,0 +1,269 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Low-level I/O with the module
+package lpwan
+
+import (
+    "errors"
+    "time"
+)
+
+// Returned when there is no port to write to, such as while it's being reopened
+var errNoTransport = errors.New("no transport")
+
+// Initialize the i/o with the module
+func (c *Controller) ioInit() {
+
+    // Use the transport we were given, such as an emulated module
+    if c.transport != nil {
+        c.initTransport(c.transport)
+        return
+    }
+
+    // Open the serial port.  If we can't, the event loop will keep trying.
+    t, err := c.opener()
+    if err != nil {
+        c.logf("Cannot open %s: %v\n", c.serialPort, err)
+        c.replyWatchdogReset(false)
+        c.scheduleReopen()
+        return
+    }
+    c.transportOpened = true
+
+    // Allow for noise on the newly-opened serial port to settle
+    time.Sleep(c.scaled(2 * time.Second))
+
+    // Begin processing
+    c.initTransport(t)
+
+}
+
+// Initialize the i/o on an already-open transport, which is also how an
+// in-memory transport is attached when running without a physical module
+func (c *Controller) initTransport(t Transport) {
+
+    c.setTransport(t)
+
+    // Reset the watchdog timer used to notify us that the chip is wedged
+    c.replyWatchdogReset(false)
+
+    // Process receives in a different goroutine because I/O is synchronous
+    go c.inboundMain(t)
+
+}
+
+// Get the current transport, which is nil while the serial port is being reopened
+func (c *Controller) getTransport() Transport {
+    c.ioMutex.Lock()
+    defer c.ioMutex.Unlock()
+    return c.transport
+}
+
+// Set the current transport
+func (c *Controller) setTransport(t Transport) {
+    c.ioMutex.Lock()
+    c.transport = t
+    c.ioMutex.Unlock()
+}
+
+// Get the names of the serial ports that are spoken for by other controllers
+func (c *Controller) serialPortsInUse() map[string]bool {
+    if c.portsInUse == nil {
+        return map[string]bool{}
+    }
+    return c.portsInUse()
+}
+
+// Open the serial port to the module, which is how the port is opened unless a test says otherwise
+func (c *Controller) openSerial() (Transport, error) {
+    return c.serialOpen(c.serialPortsInUse())
+}
+
+// Abandon a transport that has failed, closing it and reopening the serial port in its place.
+// It may well come back on a different port, which is why we detect it afresh if it wasn't
+// explicitly configured.  A transport that we were given rather than opened, such as an emulated
+// module, has nothing to reopen.  Must be called from the event loop.
+func (c *Controller) abandonTransport(t Transport) {
+    if t == nil || c.getTransport() != t {
+        // Already abandoned
+        return
+    }
+    c.setTransport(nil)
+    t.Close()
+    if !c.transportOpened {
+        c.logf("LPWAN transport closed\n")
+        return
+    }
+    c.reopenBackoff = 0
+    c.scheduleReopen()
+}
+
+// Arrange for the event loop to try reopening the serial port after a backoff
+func (c *Controller) scheduleReopen() {
+    if c.reopenBackoff == 0 {
+        c.reopenBackoff = 1 * time.Second
+    } else if c.reopenBackoff < 30 * time.Second {
+        c.reopenBackoff = c.reopenBackoff * 2
+    }
+    time.AfterFunc(c.reopenBackoff, func() {
+        c.post(controllerEvent{kind: eventReopen})
+    })
+}
+
+// Try to reopen the serial port, such as after a USB module was unplugged, retrying with backoff
+// until the module is back, and then reinitialize the module from scratch.  Must be called from the event loop.
+func (c *Controller) reopen() {
+
+    if c.getTransport() != nil {
+        return
+    }
+
+    t, err := c.opener()
+    if err != nil {
+        if c.verbose {
+            c.logf("serial: reopen failed: %v\n", err)
+        }
+        c.scheduleReopen()
+        return
+    }
+
+    c.logf("serial: reopened %s\n", c.SerialPort())
+    c.transportOpened = true
+    c.reopenBackoff = 0
+    c.initTransport(t)
+    c.remember(HistoryReopen, c.SerialPort())
+    c.reinit()
+
+}
+
+// Initialize the Microchip RN2483/RN2903 LPWAN controller using the specified reset,
+// returning how long it needs to settle before we talk to it
+func (c *Controller) initMicrochip(reset ResetStrategy) time.Duration {
+
+    // The transport buffers incoming data until it gets a newline.
+    // If we've accumulated buffered data, we need to force it to discard it.
+    t := c.getTransport()
+    if t != nil {
+        t.Flush()
+    }
+
+    // Perform the reset
+    err := reset.Reset()
+    if err != nil {
+        c.logf("ioInitMicrochip: err %v\n", err)
+        return 0
+    }
+
+    c.logf("\nLPWAN Reset\n\n")
+    return reset.Settle()
+
+}
+
+// The inbound I/O goroutine used for handling of inbound synchronous I/O
+func (c *Controller) inboundMain(t Transport) {
+
+    // Primary I/O loop, which ends when the transport is closed or fails
+    for {
+
+        // If the port failed, have the event loop abandon it and reopen it
+        line, err := t.ReadLine()
+        if err != nil {
+            if err != ErrTransportClosed {
+                c.logf("serial: read error %v\n", err)
+                c.post(controllerEvent{kind: eventFailed, transport: t})
+            }
+            return
+        }
+
+        // Reset the command watchdog because we received a reply
+        c.replyWatchdogReset(false)
+
+        // Record it if we're capturing the session
+        if c.trace != nil {
+            c.trace(false, line)
+        }
+
+        // Feed this line to the state machine
+        c.post(controllerEvent{kind: eventLine, line: line})
+
+    }
+
+}
+
+// Reset the watchdog timer as enabled or disabled
+func (c *Controller) replyWatchdogReset(fEnable bool) {
+    c.ioMutex.Lock()
+    c.replyWatchdogEnabled = fEnable
+    c.replyWatchdogTickCount = 0
+    c.ioMutex.Unlock()
+}
+
+// Monitor serial I/O as a way of handling the Microchip getting into a locked state
+func (c *Controller) io5sWatchdog() {
+    // Process the watchdog monitoring request/response from the LPWAN chip.  This is
+    // independent of the state machine's own timeouts, as a failsafe in case it is wedged.
+    c.ioMutex.Lock()
+    enabled := c.replyWatchdogEnabled
+    if enabled {
+        c.replyWatchdogTickCount = c.replyWatchdogTickCount + 1
+    }
+    ticks := c.replyWatchdogTickCount
+    c.ioMutex.Unlock()
+    if enabled {
+        if (ticks >= 5) {
+            c.logf("*** ioReplyWatchdog: no cmd reply!\n")
+            // The state machine recovers from missing replies on its own, so if we've gone
+            // this long without one, the event loop itself is wedged and there's nothing
+            // for it but to let the owner know that we've given up
+            if (ticks == 100 && c.onModuleLost != nil) {
+                c.onModuleLost()
+            }
+        }
+    }
+}
+
+// Send a string as a full newline-delimited command to the serial port
+func (c *Controller) sendCommandString(cmd string) {
+    c.noteRadioSetting(cmd)
+    c.sendCommand([]byte(cmd))
+}
+
+// Send bytes to the serial port as a full newline-delimited command
+func (c *Controller) sendCommand(cmd []byte) {
+
+    c.writeCommand(cmd)
+
+    // Set the watchdog timer because we've successfully written to the port,
+    // and we are now awaiting a reply from the chip.
+    c.replyWatchdogReset(true)
+
+}
+
+// Write a command to the serial port, logging and tracing it like any other, but without
+// awaiting a reply, which is all that's wanted for a command such as "sys reset"
+func (c *Controller) writeCommand(cmd []byte) error {
+
+    c.logf("send(%s)\n", cmd)
+    c.remember(HistorySend, string(cmd))
+
+    // Record it if we're capturing the session
+    if c.trace != nil {
+        c.trace(true, cmd)
+    }
+
+    // Write this, appending newline.  If the write fails, the port is no longer
+    // usable, so close it and reopen it.
+    t := c.getTransport()
+    if (t == nil) {
+        return errNoTransport
+    }
+    err := t.WriteCommand(cmd)
+    if err != nil {
+        c.logf("write err: %v\n", err)
+        c.abandonTransport(t)
+    }
+    return err
+
+}
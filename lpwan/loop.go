@@ -0,0 +1,165 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// The controller's event loop, which is the only goroutine that touches the state machine
+package lpwan
+
+import (
+    "fmt"
+    "time"
+)
+
+// Events delivered to the event loop
+const (
+    eventLine = iota        // A line was received from the module
+    eventTimer              // A timer set by the state machine has fired
+    eventOutbound           // An outbound command was enqueued
+    eventFailed             // The transport failed
+    eventReopen             // It's time to try reopening the port
+    eventWatchdog           // The 1m watchdog has ticked
+)
+
+// An event delivered to the event loop
+type controllerEvent struct {
+    kind int
+    line []byte
+    timer int
+    transport Transport
+}
+
+// The event loop.  Everything else that needs the state machine's attention delivers an event to it.
+func (c *Controller) run() {
+
+    // Init state machine, etc.
+    c.reinit()
+
+    for ev := range c.events {
+        switch ev.kind {
+
+        case eventLine:
+            c.process(ev.line)
+
+        case eventTimer:
+            // Ignore timers that have since been replaced or cancelled
+            if ev.timer == c.timerGeneration && c.timerAction != nil {
+                action := c.timerAction
+                c.timerAction = nil
+                action()
+            }
+
+        case eventOutbound:
+            if len(c.outboundQueue) != 0 {
+                c.stopReceive()
+            }
+
+        case eventFailed:
+            c.abandonTransport(ev.transport)
+
+        case eventReopen:
+            c.reopen()
+
+        case eventWatchdog:
+            c.cmd1mWatchdog()
+
+        }
+    }
+
+}
+
+// Deliver an event to the event loop, waiting if it is backed up
+func (c *Controller) post(ev controllerEvent) {
+    c.events <- ev
+}
+
+// Deliver a notification to the event loop.  These are only prompts to look at something,
+// so if one is already waiting to be handled there's no need to wait to deliver another.
+func (c *Controller) notify(kind int) {
+    select {
+    case c.events <- controllerEvent{kind: kind}:
+    default:
+    }
+}
+
+// Arrange for the event loop to perform an action after a delay, replacing any
+// action that was already pending.  Must be called from the event loop.
+func (c *Controller) setTimer(d time.Duration, action func()) {
+    c.timerGeneration++
+    generation := c.timerGeneration
+    c.timerAction = action
+    time.AfterFunc(d, func() {
+        c.post(controllerEvent{kind: eventTimer, timer: generation})
+    })
+}
+
+// Reinitialize the world, such as when starting up or when the port has been reopened
+func (c *Controller) reinit() {
+    c.reinitWith(c.reset)
+}
+
+// Reinitialize the world using the specified reset
+func (c *Controller) reinitWith(reset ResetStrategy) {
+
+    // Initialize the state machine, and reinitialize the Microchip in case it's wedged.
+    c.remember(HistoryReinit, reset.String())
+    c.setResetState()
+    settle := c.initMicrochip(reset)
+
+    // Once the module has settled, kick off a device reset.  Whatever it says while
+    // it's coming back up is noise, and is discarded.
+    c.delaying = true
+    c.setTimer(c.scaled(settle), func() {
+        c.delaying = false
+        c.process(nil)
+    })
+
+}
+
+// Run the watchdogs, which are independent of the event loop so that they work even if it's wedged
+func (c *Controller) watchdogMain() {
+    ticks := 0
+    for {
+        time.Sleep(5 * time.Second)
+        c.io5sWatchdog()
+        ticks++
+        if ticks % 12 == 0 {
+            c.notify(eventWatchdog)
+        }
+    }
+}
+
+// Watchdog, in order to handle LPWAN chip resets.  Each state has its own timeout, so this is just a backstop.
+func (c *Controller) cmd1mWatchdog() {
+
+    // Ignore the first increments, but then recover
+    c.watchdog1mCount = c.watchdog1mCount + 1
+    switch {
+    case c.watchdog1mCount == c.recovery.StuckMinutes - 1:
+        c.logf("*** cmdStateChangeWatchdog: Warning!\n")
+    case c.watchdog1mCount >= c.recovery.StuckMinutes:
+        c.recover(fmt.Sprintf("stuck %s for %dm", c.currentState, c.watchdog1mCount))
+    }
+
+}
+
+// Handle the case where the chip gets into a locked state
+// in which it is permanently returning "busy" as a reply
+func (c *Controller) busy() {
+
+    // Ignore the first increments, but then recover
+    c.busyCount = c.busyCount + 1
+    if c.busyCount > c.recovery.BusyLimit {
+        c.recover(fmt.Sprintf("%d busy replies", c.busyCount))
+    }
+
+}
+
+// Reset the cmd watchdog
+func (c *Controller) stateChangeWatchdogReset() {
+    c.watchdog1mCount = 0
+}
+
+// Reset the "busy reply" watchdog
+func (c *Controller) busyReset() {
+    c.busyCount = 0
+}
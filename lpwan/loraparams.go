@@ -0,0 +1,204 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// LoRa radio parameters, validated against what the Microchip module accepts
+package lpwan
+
+import (
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// loraParam is a "radio set" parameter, whose value is obtained from the parameter lookup
+// once we know the region in which we're operating
+type loraParam struct {
+    name string
+    validate func(model string, value string) (string, error)
+}
+
+// Parameters in the order in which they are set
+var loraParams = []loraParam{
+    {"freq", loraValidateFreq},
+    {"pwr", loraValidatePwr},
+    {"sf", loraValidateSF},
+    {"bw", loraValidateBW},
+    {"cr", loraValidateCR},
+    {"sync", loraValidateSync},
+    {"prlen", loraValidatePrlen},
+    {"crc", loraValidateOnOff},
+    {"iqi", loraValidateOnOff},
+}
+
+// Get the commands that configure the radio for its region
+func (c *Controller) radioSetupCommands() (commands []string) {
+
+    region := strings.ToLower(c.region)
+    plan := loraRegionFind(region)
+    defaults := map[string]string{}
+    if plan != nil {
+        defaults["freq"] = strconv.Itoa(plan.freq)
+        defaults["pwr"] = strconv.Itoa(plan.pwr)
+    }
+
+    for _, p := range loraParams {
+
+        value := ""
+        if c.paramLookup != nil {
+            value = c.paramLookup(region, p.name)
+        }
+        if value == "" && p.name == "freq" {
+            value = c.frequency
+        }
+
+        if value != "" {
+            validated, err := c.validateParam(plan, p, value)
+            if err == nil {
+                commands = append(commands, fmt.Sprintf("radio set %s %s", p.name, validated))
+                continue
+            }
+            c.logf("Ignoring radio %s %s: %v\n", p.name, value, err)
+        }
+
+        // The region's defaults are held to the same standard, lest the region not suit the module
+        if defaults[p.name] != "" {
+            validated, err := c.validateParam(plan, p, defaults[p.name])
+            if err == nil {
+                commands = append(commands, fmt.Sprintf("radio set %s %s", p.name, validated))
+                continue
+            }
+            c.logf("Not setting radio %s to %s's default of %s: %v\n", p.name, plan.name, defaults[p.name], err)
+        }
+
+    }
+
+    // Without a region we have nothing to go on, so leave the module alone unless told otherwise
+    if plan == nil && len(commands) == 0 {
+        return nil
+    }
+
+    return append([]string{"radio set mod lora"}, commands...)
+
+}
+
+// Validate a setting against what the module accepts and, if we know the region, what is legal in it
+func (c *Controller) validateParam(plan *loraRegionPlan, p loraParam, value string) (string, error) {
+    validated, err := p.validate(c.firmware.Model, value)
+    if err == nil && plan != nil {
+        err = plan.validate(p.name, validated)
+    }
+    return validated, err
+}
+
+// Validate a setting that the module accepts against what is legal in the region
+func (plan *loraRegionPlan) validate(name string, value string) error {
+    switch name {
+    case "freq":
+        hz, _ := strconv.Atoi(value)
+        if hz < plan.freqLow || hz > plan.freqHigh {
+            return fmt.Errorf("must be %.3f-%.3fMHz in %s", float64(plan.freqLow) / 1000000, float64(plan.freqHigh) / 1000000, plan.name)
+        }
+    case "pwr":
+        dbm, _ := strconv.Atoi(value)
+        if dbm > plan.maxEIRP {
+            return fmt.Errorf("must be at most %ddBm in %s", plan.maxEIRP, plan.name)
+        }
+    }
+    return nil
+}
+
+// Frequency in Hz, within the bands supported by the module
+func loraValidateFreq(model string, value string) (string, error) {
+    hz, err := strconv.Atoi(value)
+    if err != nil {
+        return "", errors.New("must be in Hz")
+    }
+    switch model {
+    case "RN2483":
+        if (hz >= 433050000 && hz <= 434790000) || (hz >= 863000000 && hz <= 870000000) {
+            return value, nil
+        }
+        return "", errors.New("must be 433.05-434.79MHz or 863-870MHz")
+    case "RN2903":
+        if hz >= 902000000 && hz <= 928000000 {
+            return value, nil
+        }
+        return "", errors.New("must be 902-928MHz")
+    }
+    return value, nil
+}
+
+// Transmit power in dBm, whose range differs by module
+func loraValidatePwr(model string, value string) (string, error) {
+    low, high := -3, 20
+    switch model {
+    case "RN2483":
+        low, high = -3, 15
+    case "RN2903":
+        low, high = 2, 20
+    }
+    return loraValidateRange(value, low, high)
+}
+
+// Spreading factor, which the module wants as "sf7" through "sf12"
+func loraValidateSF(model string, value string) (string, error) {
+    sf, err := strconv.Atoi(strings.TrimPrefix(strings.ToLower(value), "sf"))
+    if err != nil || sf < 7 || sf > 12 {
+        return "", errors.New("must be sf7 through sf12")
+    }
+    return fmt.Sprintf("sf%d", sf), nil
+}
+
+// Bandwidth in kHz
+func loraValidateBW(model string, value string) (string, error) {
+    switch value {
+    case "125", "250", "500":
+        return value, nil
+    }
+    return "", errors.New("must be 125, 250, or 500")
+}
+
+// Coding rate
+func loraValidateCR(model string, value string) (string, error) {
+    switch value {
+    case "4/5", "4/6", "4/7", "4/8":
+        return value, nil
+    }
+    return "", errors.New("must be 4/5, 4/6, 4/7, or 4/8")
+}
+
+// Sync word, which is a single byte in hex
+func loraValidateSync(model string, value string) (string, error) {
+    v, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(value), "0x"), 16, 8)
+    if err != nil {
+        return "", errors.New("must be a single hex byte")
+    }
+    return fmt.Sprintf("%02X", v), nil
+}
+
+// Preamble length, in symbols
+func loraValidatePrlen(model string, value string) (string, error) {
+    return loraValidateRange(value, 0, 65535)
+}
+
+// A setting that is either on or off
+func loraValidateOnOff(model string, value string) (string, error) {
+    switch strings.ToLower(value) {
+    case "on", "true", "1":
+        return "on", nil
+    case "off", "false", "0":
+        return "off", nil
+    }
+    return "", errors.New("must be on or off")
+}
+
+// An integer within a range
+func loraValidateRange(value string, low int, high int) (string, error) {
+    i, err := strconv.Atoi(value)
+    if err != nil || i < low || i > high {
+        return "", fmt.Errorf("must be %d through %d", low, high)
+    }
+    return strconv.Itoa(i), nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package lpwan
+
+import (
+    "reflect"
+    "testing"
+)
+
+// Settings that the module accepts but that aren't legal in the region are replaced by the region's
+// defaults, which are themselves left unset if the module doesn't accept them
+func TestRadioSetupCommandsRegionLimits(t *testing.T) {
+
+    tests := []struct {
+        region string
+        model string
+        pwr string
+        freq string
+        want []string
+    }{
+        {"as923", "RN2903", "16", "", []string{"radio set mod lora", "radio set freq 923200000", "radio set pwr 16"}},
+        {"as923", "RN2903", "20", "", []string{"radio set mod lora", "radio set freq 923200000", "radio set pwr 14"}},
+        {"kr920", "RN2903", "15", "", []string{"radio set mod lora", "radio set freq 922100000", "radio set pwr 14"}},
+        {"us", "RN2903", "20", "", []string{"radio set mod lora", "radio set freq 915000000", "radio set pwr 20"}},
+        {"eu", "RN2483", "", "915000000", []string{"radio set mod lora", "radio set freq 868100000", "radio set pwr 15"}},
+        {"us", "RN2483", "", "", []string{"radio set mod lora"}},
+        {"eu", "RN2903", "", "", []string{"radio set mod lora", "radio set pwr 15"}},
+    }
+
+    for _, test := range tests {
+        params := map[string]string{"pwr": test.pwr, "freq": test.freq}
+        c := New(WithLogger(quietLogger), WithParams(func(region string, name string) string {
+            return params[name]
+        }))
+        c.region = test.region
+        c.firmware.Model = test.model
+        got := c.radioSetupCommands()
+        if !reflect.DeepEqual(got, test.want) {
+            t.Errorf("%s pwr %s freq %s: %q, want %q", test.region, test.pwr, test.freq, got, test.want)
+        }
+    }
+
+}
+
+// A radio without a module, such as a packet forwarder, transmits at the power that the module
+// would be set up with in the region
+func TestRegionTxPower(t *testing.T) {
+
+    tests := []struct {
+        region string
+        configured string
+        want int
+        refused bool
+    }{
+        {"eu", "", 15, false},
+        {"eu868", "", 15, false},
+        {"us", "", 20, false},
+        {"kr920", "", 14, false},
+        {"eu", "14", 14, false},
+        {"eu", "20", 15, true},
+        {"as923", "16", 16, false},
+        {"as923", "17", 14, true},
+        {"us", "high", 20, true},
+        {"", "", 14, false},
+        {"nowhere", "30", 14, false},
+    }
+
+    for _, test := range tests {
+        dbm, err := RegionTxPower(test.region, test.configured)
+        if dbm != test.want || (err != nil) != test.refused {
+            t.Errorf("%q pwr %q: %ddBm with %v, want %ddBm", test.region, test.configured, dbm, err, test.want)
+        }
+    }
+
+}
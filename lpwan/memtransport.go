@@ -0,0 +1,89 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// In-memory transport, used to drive the state machine without a module attached
+package lpwan
+
+import (
+    "sync"
+)
+
+// MemTransport is a Transport whose "module" is whatever code is holding the other end.
+// Lines handed to Inject are returned by ReadLine, and commands written by the state machine
+// are made available on the Sent channel.
+type MemTransport struct {
+    inbound chan []byte
+    sent chan []byte
+    closed chan struct{}
+    closeOnce sync.Once
+}
+
+// Depth of the in-memory queues, which is far more than the state machine ever has outstanding
+const memTransportQueueDepth = 100
+
+// NewMemTransport creates a new in-memory transport
+func NewMemTransport() *MemTransport {
+    t := &MemTransport{}
+    t.inbound = make(chan []byte, memTransportQueueDepth)
+    t.sent = make(chan []byte, memTransportQueueDepth)
+    t.closed = make(chan struct{})
+    return t
+}
+
+// Inject a line as though it had been received from the module
+func (t *MemTransport) Inject(line string) {
+    select {
+    case t.inbound <- []byte(line):
+    case <-t.closed:
+    }
+}
+
+// Sent returns the channel on which commands written to the "module" appear
+func (t *MemTransport) Sent() <-chan []byte {
+    return t.sent
+}
+
+// ReadLine returns the next injected line
+func (t *MemTransport) ReadLine() ([]byte, error) {
+    select {
+    case line := <-t.inbound:
+        return line, nil
+    case <-t.closed:
+        return nil, ErrTransportClosed
+    }
+}
+
+// WriteCommand records the command.  If nobody is consuming the Sent channel we drop
+// the command rather than blocking, because the state machine must never stall on output.
+func (t *MemTransport) WriteCommand(cmd []byte) error {
+    select {
+    case <-t.closed:
+        return ErrTransportClosed
+    default:
+    }
+    select {
+    case t.sent <- append([]byte(nil), cmd...):
+    default:
+    }
+    return nil
+}
+
+// Flush discards anything that has been injected but not yet read
+func (t *MemTransport) Flush() {
+    for {
+        select {
+        case <-t.inbound:
+        default:
+            return
+        }
+    }
+}
+
+// Close shuts down the transport
+func (t *MemTransport) Close() error {
+    t.closeOnce.Do(func() {
+        close(t.closed)
+    })
+    return nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package lpwan
+
+import (
+    "bytes"
+    "strings"
+    "testing"
+    "time"
+)
+
+// Play the part of a module on the far end of a MemTransport, replying to each command as the
+// firmware would, and answering the first receive with the specified packet
+func memModule(mt *MemTransport, packet string) {
+    for cmd := range mt.Sent() {
+        command := string(cmd)
+        switch {
+        case command == "sys get ver" || command == "sys reset":
+            mt.Inject("RN2483 1.0.1 Dec 15 2015 09:38:09")
+        case command == "sys get hweui":
+            mt.Inject("0004A30B001C4D12")
+        case command == "mac pause":
+            mt.Inject("4294967245")
+        case command == "radio get snr":
+            mt.Inject("-3")
+        case strings.HasPrefix(command, "radio set "):
+            mt.Inject("ok")
+        case command == "radio rx 0":
+            mt.Inject("ok")
+            if packet != "" {
+                mt.Inject("radio_rx  " + packet)
+                packet = ""
+            }
+        case strings.HasPrefix(command, "radio tx "):
+            mt.Inject("ok")
+            mt.Inject("radio_tx_ok")
+        default:
+            mt.Inject("invalid_param")
+        }
+    }
+}
+
+// A packet received through an in-memory transport is decoded and handed on, with its metadata
+func TestMemTransportReceive(t *testing.T) {
+    t.Parallel()
+
+    mt := NewMemTransport()
+    defer mt.Close()
+    tc := newTestController(WithTransport(mt), WithReset(NoReset()))
+    go memModule(mt, "48656C6C6F")
+    tc.Start()
+
+    r := tc.awaitReceive(t, configureTimeout)
+    if !bytes.Equal(r.frame, []byte("Hello")) {
+        t.Fatalf("received %q, want \"Hello\"", r.frame)
+    }
+    if r.meta.SNR != -3 {
+        t.Fatalf("SNR %v, want -3", r.meta.SNR)
+    }
+    if r.meta.ReceivedAt.IsZero() || time.Since(r.meta.ReceivedAt) > time.Minute {
+        t.Fatalf("received at %v", r.meta.ReceivedAt)
+    }
+    if tc.HWEUI() != "0004A30B001C4D12" {
+        t.Fatalf("HWEUI %q", tc.HWEUI())
+    }
+
+    // Having received, the module is put straight back into receive
+    tc.awaitTrace(t, "recv radio_rx", 10 * time.Second)
+    tc.awaitTrace(t, "send radio rx 0", 10 * time.Second)
+    tc.awaitTrace(t, "recv ok", 10 * time.Second)
+
+    // Forwarding to the module goes out once the receive ends
+    tc.Enqueue([]byte("Bye"))
+    mt.Inject("radio_err")
+    tc.awaitTrace(t, "send radio tx 427965", 10 * time.Second)
+    tc.awaitTrace(t, "recv radio_tx_ok", 10 * time.Second)
+
+}
+
+// Lines injected are read back in order, commands written appear on Sent, and
+// once closed the transport neither reads nor writes
+func TestMemTransport(t *testing.T) {
+
+    mt := NewMemTransport()
+    mt.Inject("one")
+    mt.Inject("two")
+    line, err := mt.ReadLine()
+    if err != nil || string(line) != "one" {
+        t.Fatalf("read %q, %v", line, err)
+    }
+    mt.Flush()
+    mt.Inject("three")
+    line, err = mt.ReadLine()
+    if err != nil || string(line) != "three" {
+        t.Fatalf("read %q after flush, %v", line, err)
+    }
+
+    cmd := []byte("radio rx 0")
+    err = mt.WriteCommand(cmd)
+    if err != nil {
+        t.Fatalf("write: %v", err)
+    }
+    cmd[0] = 'X'
+    sent := <-mt.Sent()
+    if string(sent) != "radio rx 0" {
+        t.Fatalf("sent %q", sent)
+    }
+
+    // Nobody draining Sent mustn't stall the writer
+    for i := 0; i < memTransportQueueDepth * 2; i++ {
+        err = mt.WriteCommand([]byte("radio get snr"))
+        if err != nil {
+            t.Fatalf("write %d: %v", i, err)
+        }
+    }
+
+    mt.Close()
+    mt.Close()
+    _, err = mt.ReadLine()
+    if err != ErrTransportClosed {
+        t.Fatalf("read after close: %v", err)
+    }
+    if mt.WriteCommand(cmd) != ErrTransportClosed {
+        t.Fatalf("write after close succeeded")
+    }
+
+}
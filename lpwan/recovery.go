@@ -0,0 +1,215 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Graduated recovery of a module that has stopped behaving
+package lpwan
+
+import (
+    "fmt"
+    "time"
+)
+
+// RecoveryLevel is a rung of the ladder that we climb when a module misbehaves, from the
+// least disruptive remedy to the most.  We only climb when the rung below hasn't worked.
+type RecoveryLevel int
+
+// Recovery levels
+const (
+    RecoverReceive RecoveryLevel = iota     // Restart the receive
+    RecoverSoftReset                        // "sys reset" the module and reconfigure it
+    RecoverHardReset                        // Reset the module as configured, such as by /RESET, and reconfigure it
+    RecoverReopen                           // Close and reopen the serial port
+    RecoverRestart                          // Give up, calling OnModuleLost
+    recoveryLevels
+)
+
+// Names of the levels, as reported in stats
+var recoveryLevelNames = [recoveryLevels]string{"receive", "soft", "hard", "reopen", "restart"}
+
+// String describes the level
+func (l RecoveryLevel) String() string {
+    if l < 0 || l >= recoveryLevels {
+        return fmt.Sprintf("level %d", int(l))
+    }
+    return recoveryLevelNames[l]
+}
+
+// RecoveryPolicy governs when we decide that the module needs recovering and how we go about it
+type RecoveryPolicy struct {
+    Attempts []int                  // Attempts at each level below RecoverRestart before climbing to the next, zero to skip it
+    Backoff time.Duration           // Delay before the first attempt, doubling with each attempt until we've recovered
+    MaxBackoff time.Duration        // Limit on the delay
+    BusyLimit int                   // Consecutive "busy" replies that mean that the module needs recovering
+    StuckMinutes int                // Minutes without a state change that mean that the module needs recovering
+}
+
+// DefaultRecoveryPolicy returns the policy that is used unless another is configured
+func DefaultRecoveryPolicy() RecoveryPolicy {
+    return RecoveryPolicy{
+        Attempts: []int{2, 2, 1, 3},
+        Backoff: 2 * time.Second,
+        MaxBackoff: 2 * time.Minute,
+        BusyLimit: 10,
+        StuckMinutes: 3,
+    }
+}
+
+// Where we are on the ladder
+type recoveryLadder struct {
+    level RecoveryLevel
+    attempts int                    // Attempts made at this level
+    steps int                       // Attempts made since we last recovered, for backoff
+    counts [recoveryLevels]uint32   // Attempts made at each level, ever
+}
+
+// Get the number of attempts to make at a level
+func (p *RecoveryPolicy) attemptsAt(level RecoveryLevel) int {
+    if level >= RecoverRestart {
+        return 1
+    }
+    if int(level) >= len(p.Attempts) {
+        return 1
+    }
+    return p.Attempts[level]
+}
+
+// Get the delay before an attempt
+func (p *RecoveryPolicy) backoff(steps int) time.Duration {
+    d := p.Backoff
+    for i := 0; i < steps && d < p.MaxBackoff; i++ {
+        d = d * 2
+    }
+    if p.MaxBackoff > 0 && d > p.MaxBackoff {
+        d = p.MaxBackoff
+    }
+    return d
+}
+
+// Determine whether a level can do anything for us right now
+func (c *Controller) recoveryApplicable(level RecoveryLevel) bool {
+    switch level {
+    case RecoverReceive:
+        // There's no receive to restart if the module never got as far as configuring
+        return !c.receiveStartedAt.IsZero()
+    case RecoverReopen:
+        // Emulated and replayed modules, which were given to us already open, have nothing to reopen
+        return c.transportOpened
+    }
+    return true
+}
+
+// Recover from the module having misbehaved, by taking the next step up the ladder after a backoff.
+// Must be called from the event loop.
+func (c *Controller) recover(reason string) {
+
+    // Without a port there's nothing that climbing the ladder can do
+    if c.holdForReopen(reason) {
+        return
+    }
+
+    // Find the rung that we're on, skipping those that are disabled or can't help
+    for c.ladder.level < RecoverRestart && (c.ladder.attempts >= c.recovery.attemptsAt(c.ladder.level) || !c.recoveryApplicable(c.ladder.level)) {
+        c.ladder.level++
+        c.ladder.attempts = 0
+    }
+    level := c.ladder.level
+    c.ladder.attempts++
+    delay := c.recovery.backoff(c.ladder.steps)
+    c.ladder.steps++
+
+    c.statsMutex.Lock()
+    c.ladder.counts[level]++
+    c.statsMutex.Unlock()
+
+    c.logf("LPWAN %s; recovering by %s in %ds\n", reason, level, delay / time.Second)
+    c.remember(HistoryRecover, fmt.Sprintf("%s; %s", reason, level))
+
+    // Ignore the module while we back off, lest a stale reply start things up again
+    c.replyWatchdogReset(false)
+    c.stateChangeWatchdogReset()
+    c.busyReset()
+    c.delaying = true
+    c.setTimer(delay, func() {
+        c.delaying = false
+        c.performRecovery(level)
+    })
+
+}
+
+// While the port is being reopened, there's nothing to talk to and nothing to recover, so
+// stop counting timeouts and sending commands, holding our place on the ladder until the
+// port has been reopened and the module reinitialized.  Must be called from the event loop.
+func (c *Controller) holdForReopen(reason string) bool {
+    if c.getTransport() != nil {
+        return false
+    }
+    c.logf("LPWAN %s; holding recovery until the port is reopened\n", reason)
+    c.remember(HistoryRecover, fmt.Sprintf("%s; awaiting reopen", reason))
+    c.replyWatchdogReset(false)
+    c.stateChangeWatchdogReset()
+    c.busyReset()
+    c.timerGeneration++
+    c.timerAction = nil
+    c.delaying = true
+    return true
+}
+
+// Perform a recovery action
+func (c *Controller) performRecovery(level RecoveryLevel) {
+    switch level {
+
+    case RecoverReceive:
+        c.rxStopOutstanding = false
+        c.restartReceive()
+
+    case RecoverSoftReset:
+        c.reinitWith(&softwareReset{controller: c, settle: DefaultResetSettle})
+
+    case RecoverHardReset:
+        c.reinitWith(c.reset)
+
+    case RecoverReopen:
+        // Once reopened, the module is reinitialized
+        c.delaying = true
+        c.abandonTransport(c.getTransport())
+
+    case RecoverRestart:
+        if c.onModuleLost != nil {
+            c.onModuleLost()
+        }
+        // If nobody's going to restart us, start again at the bottom
+        c.ladder.level = RecoverReceive
+        c.ladder.attempts = 0
+        c.ladder.steps = 0
+        c.reinit()
+
+    }
+}
+
+// Note that the module has done what was asked of it, so that next time we start at the bottom of the ladder
+func (c *Controller) recovered() {
+    if c.ladder.steps != 0 {
+        c.logf("LPWAN recovered\n")
+    }
+    c.ladder.level = RecoverReceive
+    c.ladder.attempts = 0
+    c.ladder.steps = 0
+}
+
+// RecoveryStats describes how many times each level of recovery has been attempted
+func (c *Controller) RecoveryStats() string {
+    c.statsMutex.Lock()
+    defer c.statsMutex.Unlock()
+    s := ""
+    for level, count := range c.ladder.counts {
+        if count == 0 {
+            continue
+        }
+        if s != "" {
+            s += ","
+        }
+        s += fmt.Sprintf("%s:%d", RecoveryLevel(level), count)
+    }
+    return s
+}
@@ -0,0 +1,249 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package lpwan
+
+import (
+    "sync"
+    "testing"
+    "time"
+)
+
+// A policy that recovers without the backoff that we'd want in the field
+func testRecoveryPolicy(attempts ...int) RecoveryPolicy {
+    p := DefaultRecoveryPolicy()
+    p.Attempts = attempts
+    p.Backoff = 10 * time.Millisecond
+    p.MaxBackoff = 10 * time.Millisecond
+    return p
+}
+
+// Start an emulated module, waiting for it to announce itself after the reset with which the
+// controller starts, because the reset clears any faults injected before it
+func startEmulated(t *testing.T, e *Emulator, options ...Option) *testController {
+    e.SetTimeScale(0.01)
+    options = append([]Option{WithTransport(e), WithReset(EmulatorReset(e))}, options...)
+    tc := newTestController(options...)
+    tc.Start()
+    tc.awaitTrace(t, "recv " + e.model, 10 * time.Second)
+    return tc
+}
+
+// Determine whether a kind of thing has happened
+func remembered(c *Controller, kind string) bool {
+    for _, e := range c.History() {
+        if e.Kind == kind {
+            return true
+        }
+    }
+    return false
+}
+
+// A transport to a module that has gone silent, whose reads block until it is closed, as a
+// read of a serial port would if closing the port didn't end it
+type silentTransport struct {
+    closed chan struct{}
+    once sync.Once
+}
+
+// Create a silent transport
+func newSilentTransport() *silentTransport {
+    return &silentTransport{closed: make(chan struct{})}
+}
+
+// ReadLine blocks until the transport is closed
+func (t *silentTransport) ReadLine() ([]byte, error) {
+    <-t.closed
+    return nil, ErrTransportClosed
+}
+
+// WriteCommand accepts anything until the transport is closed
+func (t *silentTransport) WriteCommand(cmd []byte) error {
+    select {
+    case <-t.closed:
+        return ErrTransportClosed
+    default:
+        return nil
+    }
+}
+
+// Flush does nothing
+func (t *silentTransport) Flush() {
+}
+
+// Close ends any pending read
+func (t *silentTransport) Close() error {
+    t.once.Do(func() {
+        close(t.closed)
+    })
+    return nil
+}
+
+// A lost reply is resent rather than treated as the module having failed
+func TestRecoverDroppedReply(t *testing.T) {
+    t.Parallel()
+
+    e := NewEmulator("RN2483")
+    defer e.Close()
+    tc := startEmulated(t, e, WithRecoveryPolicy(testRecoveryPolicy(2, 2, 1, 3)))
+    e.DropReplies(1)
+
+    tc.awaitTrace(t, "send sys get ver", configureTimeout)
+    tc.awaitTrace(t, "send sys get ver", 10 * time.Second)
+    tc.awaitState(t, cmdStateLPWanRCVRPL, configureTimeout)
+    if !remembered(tc.Controller, HistoryTimeout) {
+        t.Fatalf("timeout not remembered")
+    }
+    if tc.RecoveryStats() != "" {
+        t.Fatalf("recovered by %s, which shouldn't have been necessary", tc.RecoveryStats())
+    }
+
+}
+
+// A module rejecting everything as busy has its receive restarted once it exceeds the limit
+func TestRecoverBusyStorm(t *testing.T) {
+    t.Parallel()
+
+    e := NewEmulator("RN2483")
+    defer e.Close()
+    policy := testRecoveryPolicy(2, 2, 1, 3)
+    policy.BusyLimit = 2
+    tc := startEmulated(t, e, WithRecoveryPolicy(policy))
+    tc.awaitState(t, cmdStateLPWanRCVRPL, configureTimeout)
+    tc.awaitTrace(t, "recv ok", 10 * time.Second)
+
+    e.BusyStorm(policy.BusyLimit + 1)
+    for i := 0; i <= policy.BusyLimit; i++ {
+        tc.awaitTrace(t, "recv busy", 30 * time.Second)
+    }
+    tc.awaitTrace(t, "send radio rx 0", 10 * time.Second)
+    tc.awaitTrace(t, "recv ok", 10 * time.Second)
+    tc.awaitTrace(t, "recv radio_err", 10 * time.Second)
+    if tc.RecoveryStats() != "receive:1" {
+        t.Fatalf("recovered by %q, want receive:1", tc.RecoveryStats())
+    }
+    if !remembered(tc.Controller, HistoryRecover) {
+        t.Fatalf("recovery not remembered")
+    }
+
+}
+
+// A wedged module ignores "sys reset", so the ladder climbs to the configured reset
+func TestRecoverWedged(t *testing.T) {
+    t.Parallel()
+
+    e := NewEmulator("RN2483")
+    defer e.Close()
+    tc := startEmulated(t, e, WithRecoveryPolicy(testRecoveryPolicy(0, 1, 1, 3)))
+    e.Wedge(true)
+
+    tc.awaitTrace(t, "send sys reset", 2 * configureTimeout)
+    tc.awaitState(t, cmdStateLPWanRCVRPL, 2 * configureTimeout)
+    if tc.RecoveryStats() != "soft:1,hard:1" {
+        t.Fatalf("recovered by %q, want soft:1,hard:1", tc.RecoveryStats())
+    }
+    if tc.HWEUI() != e.HWEUI() {
+        t.Fatalf("HWEUI %q after recovery, want %q", tc.HWEUI(), e.HWEUI())
+    }
+
+}
+
+// A module that has gone silent has its port closed and reopened, and is then reinitialized
+func TestRecoverReopen(t *testing.T) {
+    t.Parallel()
+
+    silent := newSilentTransport()
+    mt := NewMemTransport()
+    defer mt.Close()
+    go memModule(mt, "")
+
+    tc := newTestController(WithReset(NoReset()), WithRecoveryPolicy(testRecoveryPolicy(0, 0, 0, 1)))
+    opened := []Transport{silent, mt}
+    tc.opener = func() (Transport, error) {
+        if len(opened) == 0 {
+            return nil, ErrTransportClosed
+        }
+        t := opened[0]
+        opened = opened[1:]
+        return t, nil
+    }
+    tc.Start()
+
+    tc.awaitState(t, cmdStateLPWanRCVRPL, configureTimeout)
+    select {
+    case <-silent.closed:
+    default:
+        t.Fatalf("silent port left open")
+    }
+    if len(opened) != 0 {
+        t.Fatalf("port never reopened")
+    }
+    if tc.RecoveryStats() != "reopen:1" {
+        t.Fatalf("recovered by %q, want reopen:1", tc.RecoveryStats())
+    }
+    if !remembered(tc.Controller, HistoryReopen) {
+        t.Fatalf("reopen not remembered")
+    }
+
+}
+
+// A transport that we were given, rather than opened, isn't replaced by a serial port when it fails
+func TestSuppliedTransportNotReopened(t *testing.T) {
+    t.Parallel()
+
+    failed := newSilentTransport()
+    failed.Close()
+    tc := newTestController(WithTransport(failed), WithReset(NoReset()))
+    opened := make(chan struct{}, 1)
+    tc.opener = func() (Transport, error) {
+        opened <- struct{}{}
+        return nil, ErrTransportClosed
+    }
+    tc.Start()
+
+    tc.awaitTrace(t, "send ", configureTimeout)
+    select {
+    case <-opened:
+        t.Fatalf("opened a serial port in place of the transport")
+    case <-time.After(3 * time.Second):
+    }
+
+}
+
+// While the port is being reopened, timeouts neither resend nor climb the ladder
+func TestRecoveryHeldForReopen(t *testing.T) {
+
+    mt := NewMemTransport()
+    c := New(WithTransport(mt), WithLogger(quietLogger), WithRecoveryPolicy(testRecoveryPolicy(2, 2, 1, 3)))
+    c.setTransport(nil)
+
+    c.lastCommand = "sys get ver"
+    c.awaitReply(cmdStateLPWanGETVERRPL)
+    for i := 0; i < 10; i++ {
+        c.replyTimeout()
+        c.recover("stuck")
+    }
+    if c.retries != 0 {
+        t.Fatalf("%d retries without a port", c.retries)
+    }
+    if c.ladder.level != RecoverReceive || c.ladder.steps != 0 || c.RecoveryStats() != "" {
+        t.Fatalf("climbed to %s (%s) without a port", c.ladder.level, c.RecoveryStats())
+    }
+    if !c.delaying || c.timerAction != nil {
+        t.Fatalf("still acting without a port")
+    }
+    select {
+    case cmd := <-mt.Sent():
+        t.Fatalf("sent %q without a port", cmd)
+    default:
+    }
+
+    // Once the port is back, recovery proceeds as usual
+    c.setTransport(mt)
+    c.recover("stuck")
+    if c.RecoveryStats() != "soft:1" {
+        t.Fatalf("recovered by %q, want soft:1", c.RecoveryStats())
+    }
+
+}
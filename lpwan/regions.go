@@ -0,0 +1,227 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Regional frequency plans, and the airtime calculations needed to comply with them
+package lpwan
+
+import (
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// loraRegionPlan describes where and how we may operate in a region.  To support a new region,
+// just add it to the table; nothing else knows about specific regions.
+type loraRegionPlan struct {
+    name string                 // As reported by Region(), and passed to the parameter lookup
+    aliases []string
+    model string                // The module whose band covers the region
+    freqLow int                 // Legal band, in Hz
+    freqHigh int
+    freq int                    // Default frequency on which we listen and reply
+    pwr int                     // Default module transmit power, in dBm
+    maxEIRP int                 // In dBm, which pwr leaves headroom under for a typical antenna
+    dwell time.Duration         // Maximum airtime of a single transmission, or 0 if unlimited
+    bands []loraBand            // Sub-bands with duty-cycle limits
+    countries []string          // ISO 3166 codes, as provided by ip-api
+}
+
+// The plans, the first of each model being the one used when we know nothing but the module
+var loraRegionPlans = []loraRegionPlan{
+    {
+        name: "eu", aliases: []string{"eu868"}, model: "RN2483",
+        freqLow: 863000000, freqHigh: 870000000, freq: 868100000, pwr: 15, maxEIRP: 16,
+        countries: []string{"AT", "BE", "BG", "CH", "CY", "CZ", "DE", "DK", "EE", "ES", "FI", "FR", "GB",
+            "GR", "HR", "HU", "IE", "IS", "IT", "LI", "LT", "LU", "LV", "MT", "NL", "NO", "PL", "PT", "RO",
+            "RU", "SE", "SI", "SK", "TR", "UA", "ZA"},
+        // ETSI EN 300 220 / ERC Rec 70-03 sub-bands
+        bands: []loraBand{
+            {863000000, 865000000, 0.001},
+            {865000000, 868000000, 0.01},
+            {868000000, 868600000, 0.01},
+            {868700000, 869200000, 0.001},
+            {869400000, 869650000, 0.10},
+            {869700000, 870000000, 0.01},
+        },
+    },
+    {
+        name: "us", aliases: []string{"us915"}, model: "RN2903",
+        freqLow: 902000000, freqHigh: 928000000, freq: 915000000, pwr: 20, maxEIRP: 30,
+        dwell: 400 * time.Millisecond,
+        countries: []string{"US", "CA", "MX"},
+    },
+    {
+        name: "as923", model: "RN2903",
+        freqLow: 920000000, freqHigh: 928000000, freq: 923200000, pwr: 14, maxEIRP: 16,
+        dwell: 400 * time.Millisecond,
+        countries: []string{"JP", "SG", "TH", "TW", "HK", "MY", "PH", "VN", "BN", "KH", "LA", "MM"},
+    },
+    {
+        name: "au915", model: "RN2903",
+        freqLow: 915000000, freqHigh: 928000000, freq: 916800000, pwr: 20, maxEIRP: 30,
+        countries: []string{"AU", "NZ", "AR", "BR", "CL"},
+    },
+    {
+        name: "in865", model: "RN2483",
+        freqLow: 865000000, freqHigh: 867000000, freq: 865062500, pwr: 15, maxEIRP: 30,
+        countries: []string{"IN"},
+    },
+    {
+        name: "kr920", model: "RN2903",
+        freqLow: 920900000, freqHigh: 923300000, freq: 922100000, pwr: 14, maxEIRP: 14,
+        countries: []string{"KR"},
+    },
+}
+
+// Find a plan by name or alias
+func loraRegionFind(name string) *loraRegionPlan {
+    name = strings.ToLower(name)
+    for i := range loraRegionPlans {
+        plan := &loraRegionPlans[i]
+        if plan.name == name {
+            return plan
+        }
+        for _, alias := range plan.aliases {
+            if alias == name {
+                return plan
+            }
+        }
+    }
+    return nil
+}
+
+// RegionSelect selects the region in which to operate: as configured, else as suggested by the
+// country in which we find ourselves, else whatever the module is built for.  The model may be
+// empty when there's no module, such as when using a packet forwarder.  A configured region
+// that is unknown, or outside the band of the module, is refused with an error that says why,
+// along with the region that was selected in its place.
+func RegionSelect(configured string, country string, model string) (region string, err error) {
+
+    if configured != "" {
+        plan := loraRegionFind(configured)
+        if plan == nil {
+            err = fmt.Errorf("unknown region %s", configured)
+        } else if model != "" && plan.model != model {
+            err = fmt.Errorf("region %s is outside the band of the %s", plan.name, model)
+        } else {
+            return plan.name, nil
+        }
+    }
+
+    if country != "" {
+        for i := range loraRegionPlans {
+            plan := &loraRegionPlans[i]
+            if model != "" && plan.model != model {
+                continue
+            }
+            for _, c := range plan.countries {
+                if c == country {
+                    return plan.name, err
+                }
+            }
+        }
+    }
+
+    for i := range loraRegionPlans {
+        if loraRegionPlans[i].model == model {
+            return loraRegionPlans[i].name, err
+        }
+    }
+
+    return "", err
+
+}
+
+// RegionTxPower gets the transmit power, in dBm, to use in a region: as configured if that's legal
+// there, else the region's default, just as the module is set up.  A configured power that isn't
+// legal is refused with an error that says why.  In an unknown region it's the lowest default of
+// any region, which is legal in all of them.
+func RegionTxPower(region string, configured string) (dbm int, err error) {
+
+    plan := loraRegionFind(region)
+    if plan == nil {
+        for i := range loraRegionPlans {
+            if i == 0 || loraRegionPlans[i].pwr < dbm {
+                dbm = loraRegionPlans[i].pwr
+            }
+        }
+        return dbm, nil
+    }
+
+    if configured != "" {
+        dbm, err = strconv.Atoi(configured)
+        if err != nil {
+            err = fmt.Errorf("pwr %s must be in dBm", configured)
+        } else {
+            err = plan.validate("pwr", configured)
+            if err == nil {
+                return dbm, nil
+            }
+            err = fmt.Errorf("pwr %s %v", configured, err)
+        }
+    }
+
+    return plan.pwr, err
+
+}
+
+// Airtime computes the time on air of a LoRa packet, as per the Semtech SX1272/3/6 datasheet.
+// The coding rate is the n of 4/n.  We always use an explicit header.
+func Airtime(payloadLen int, sf int, bwKHz int, cr int, preamble int, crc bool) time.Duration {
+
+    tSym := math.Pow(2, float64(sf)) / float64(bwKHz * 1000)
+    tPreamble := (float64(preamble) + 4.25) * tSym
+
+    de := 0
+    if sf >= 11 && bwKHz == 125 {
+        de = 1
+    }
+    crcBits := 0
+    if crc {
+        crcBits = 16
+    }
+
+    numerator := float64(8 * payloadLen - 4 * sf + 28 + crcBits)
+    denominator := float64(4 * (sf - 2 * de))
+    symbols := math.Ceil(numerator / denominator) * float64(cr)
+    if symbols < 0 {
+        symbols = 0
+    }
+    payloadSymbols := 8 + symbols
+
+    seconds := tPreamble + payloadSymbols * tSym
+    return time.Duration(seconds * float64(time.Second))
+
+}
+
+// Remember what we've set the radio to, for computing airtime
+func (c *Controller) noteRadioSetting(cmd string) {
+    args := strings.Fields(cmd)
+    if len(args) == 4 && args[0] == "radio" && args[1] == "set" {
+        if c.settings == nil {
+            c.settings = map[string]string{}
+        }
+        c.settings[args[2]] = args[3]
+    }
+}
+
+// Compute the time on air of a payload transmitted with the radio's current settings,
+// which are the module's defaults unless we've changed them
+func (c *Controller) airtime(payloadLen int) time.Duration {
+    sf := 12
+    bw := 125
+    cr := 5
+    preamble := 8
+    crc := true
+    fmt.Sscanf(c.settings["sf"], "sf%d", &sf)
+    fmt.Sscanf(c.settings["bw"], "%d", &bw)
+    fmt.Sscanf(c.settings["cr"], "4/%d", &cr)
+    fmt.Sscanf(c.settings["prlen"], "%d", &preamble)
+    if c.settings["crc"] == "off" {
+        crc = false
+    }
+    return Airtime(payloadLen, sf, bw, cr, preamble, crc)
+}
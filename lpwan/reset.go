@@ -0,0 +1,212 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Strategies for resetting the LPWAN module
+package lpwan
+
+import (
+    "errors"
+    "fmt"
+    "time"
+    "github.com/stianeikeland/go-rpio"
+)
+
+// ResetStrategy is a way of resetting a (possibly wedged) module back into its power-on state.
+// Settle is how long the module needs after the reset before it can be talked to, which the
+// controller waits out on its own rather than Reset sleeping through it.
+type ResetStrategy interface {
+    Reset() error
+    Settle() time.Duration
+    String() string
+}
+
+// Note that the 250ms reset and 5s settling period have been carefully determined and are very reliable.
+const DefaultResetPulse = 250 * time.Millisecond
+const DefaultResetSettle = 5 * time.Second
+
+// gpioPulseReset pulses a Raspberry Pi GPIO pin wired to the module's /RESET.  Note that this requires two things to be true:
+// 1) On the back side of the RN2483/RN2903, use solder to close the gap of SJ1, which brings /RESET to Xbee Pin 17
+// 2) Wire Xbee Pin 17 to the RPi's Pin 18 BCM Pin 24: http://pinout.xyz/pinout/pin18_gpio24
+type gpioPulseReset struct {
+    pin int             // BCM pin # on Raspberry Pi Pinout
+    activeHigh bool
+    pulse time.Duration
+    settle time.Duration
+}
+
+// Statics
+var rpioIsOpen = false
+
+// GPIOReset resets the module by pulsing a Raspberry Pi GPIO pin, identified by BCM pin number
+func GPIOReset(pin int, activeHigh bool, pulse time.Duration, settle time.Duration) ResetStrategy {
+    return &gpioPulseReset{pin: pin, activeHigh: activeHigh, pulse: pulse, settle: settle}
+}
+
+// Reset pulses the pin
+func (r *gpioPulseReset) Reset() error {
+
+    // Leave the Raspberry Pi's GPIO open forever while we are running
+    if !rpioIsOpen {
+        err := rpio.Open()
+        if err != nil {
+            return err
+        }
+        rpioIsOpen = true
+    }
+
+    pin := rpio.Pin(r.pin)
+    pin.Output()
+    if r.activeHigh {
+        pin.High()
+        time.Sleep(r.pulse)
+        pin.Low()
+    } else {
+        pin.Low()
+        time.Sleep(r.pulse)
+        pin.High()
+    }
+
+    return nil
+
+}
+
+// Settle is how long the module takes to come back up
+func (r *gpioPulseReset) Settle() time.Duration {
+    return r.settle
+}
+
+// String describes the strategy
+func (r *gpioPulseReset) String() string {
+    return fmt.Sprintf("gpio pin %d", r.pin)
+}
+
+// gpiochipReset pulses a line of a Linux GPIO character device, which works on any board with a modern kernel
+type gpiochipReset struct {
+    chip string
+    line int
+    activeHigh bool
+    pulse time.Duration
+    settle time.Duration
+    fd int
+}
+
+// GPIOChipReset resets the module by pulsing a line of a GPIO character device, such as /dev/gpiochip0
+func GPIOChipReset(chip string, line int, activeHigh bool, pulse time.Duration, settle time.Duration) ResetStrategy {
+    return &gpiochipReset{chip: chip, line: line, activeHigh: activeHigh, pulse: pulse, settle: settle, fd: -1}
+}
+
+// Settle is how long the module takes to come back up
+func (r *gpiochipReset) Settle() time.Duration {
+    return r.settle
+}
+
+// String describes the strategy
+func (r *gpiochipReset) String() string {
+    return fmt.Sprintf("%s line %d", r.chip, r.line)
+}
+
+// softwareReset issues "sys reset", which is all that's possible when /RESET isn't wired,
+// but which of course does nothing for a module that is no longer processing commands
+type softwareReset struct {
+    controller *Controller
+    settle time.Duration
+}
+
+// SoftwareReset resets the module with "sys reset", the controller being filled in when it is attached
+func SoftwareReset(settle time.Duration) ResetStrategy {
+    return &softwareReset{settle: settle}
+}
+
+// Reset sends the command.  It goes through the controller so that it is logged and traced
+// like the rest of the conversation, but it isn't awaiting a reply because it is the reset
+// mechanism rather than part of the conversation.
+func (r *softwareReset) Reset() error {
+    if r.controller == nil {
+        return errors.New("no controller")
+    }
+    return r.controller.writeCommand([]byte("sys reset"))
+}
+
+// Settle is how long the module takes to come back up
+func (r *softwareReset) Settle() time.Duration {
+    return r.settle
+}
+
+// String describes the strategy
+func (r *softwareReset) String() string {
+    return "software"
+}
+
+// noneReset does nothing, such as when replaying a capture
+type noneReset struct {
+}
+
+// NoReset never resets the module
+func NoReset() ResetStrategy {
+    return &noneReset{}
+}
+
+// Reset does nothing
+func (r *noneReset) Reset() error {
+    return nil
+}
+
+// Settle is immediate because nothing happened
+func (r *noneReset) Settle() time.Duration {
+    return 0
+}
+
+// String describes the strategy
+func (r *noneReset) String() string {
+    return "none"
+}
+
+// emulatorReset resets an emulated module
+type emulatorReset struct {
+    e *Emulator
+}
+
+// EmulatorReset resets an emulated module
+func EmulatorReset(e *Emulator) ResetStrategy {
+    return &emulatorReset{e: e}
+}
+
+// Reset resets the emulator
+func (r *emulatorReset) Reset() error {
+    r.e.Reset()
+    return nil
+}
+
+// Settle is immediate because the emulator resets synchronously
+func (r *emulatorReset) Settle() time.Duration {
+    return 0
+}
+
+// String describes the strategy
+func (r *emulatorReset) String() string {
+    return "emulator"
+}
+
+// fakeReset records that resets were requested, optionally failing them, for use by tests
+type fakeReset struct {
+    count int
+    err error
+    settle time.Duration
+}
+
+// Reset counts the reset
+func (r *fakeReset) Reset() error {
+    r.count++
+    return r.err
+}
+
+// Settle is whatever the test asked for
+func (r *fakeReset) Settle() time.Duration {
+    return r.settle
+}
+
+// String describes the strategy
+func (r *fakeReset) String() string {
+    return "fake"
+}
@@ -0,0 +1,87 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Module reset through the Linux GPIO character device
+package lpwan
+
+import (
+    "syscall"
+    "time"
+    "unsafe"
+)
+
+// From <linux/gpio.h>, the v1 line handle ABI which is supported by every kernel with gpiochip devices
+const (
+    gpioHandlesMax = 64
+    gpioHandleRequestOutput = 1 << 1
+    gpioGetLineHandleIoctl = 0xC16CB403
+    gpioHandleSetLineValuesIoctl = 0xC040B409
+)
+
+// struct gpiohandle_request
+type gpioHandleRequest struct {
+    LineOffsets [gpioHandlesMax]uint32
+    Flags uint32
+    DefaultValues [gpioHandlesMax]uint8
+    ConsumerLabel [32]byte
+    Lines uint32
+    Fd int32
+}
+
+// struct gpiohandle_data
+type gpioHandleData struct {
+    Values [gpioHandlesMax]uint8
+}
+
+// Reset pulses the line.  Like the Raspberry Pi GPIO, we hold the line forever once requested.
+func (r *gpiochipReset) Reset() error {
+
+    asserted := uint8(0)
+    if r.activeHigh {
+        asserted = 1
+    }
+
+    if r.fd < 0 {
+        chip, err := syscall.Open(r.chip, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+        if err != nil {
+            return err
+        }
+        req := gpioHandleRequest{}
+        req.LineOffsets[0] = uint32(r.line)
+        req.Flags = gpioHandleRequestOutput
+        req.DefaultValues[0] = 1 - asserted
+        copy(req.ConsumerLabel[:], "ttgate")
+        req.Lines = 1
+        _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(chip), gpioGetLineHandleIoctl, uintptr(unsafe.Pointer(&req)))
+        syscall.Close(chip)
+        if errno != 0 {
+            return errno
+        }
+        r.fd = int(req.Fd)
+    }
+
+    err := r.set(asserted)
+    if err != nil {
+        return err
+    }
+    time.Sleep(r.pulse)
+    err = r.set(1 - asserted)
+    if err != nil {
+        return err
+    }
+
+    return nil
+
+}
+
+// Set the value of the line
+func (r *gpiochipReset) set(value uint8) error {
+    data := gpioHandleData{}
+    data.Values[0] = value
+    _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(r.fd), gpioHandleSetLineValuesIoctl, uintptr(unsafe.Pointer(&data)))
+    if errno != 0 {
+        return errno
+    }
+    return nil
+}
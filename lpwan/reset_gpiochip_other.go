@@ -0,0 +1,18 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+// GPIO character devices only exist on Linux
+package lpwan
+
+import (
+    "errors"
+)
+
+// Reset is not supported on this platform
+func (r *gpiochipReset) Reset() error {
+    return errors.New("gpiochip reset is only supported on linux")
+}
@@ -0,0 +1,88 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package lpwan
+
+import (
+    "errors"
+    "testing"
+)
+
+// Discard the controller's debug output
+func quietLogger(format string, args ...interface{}) {
+}
+
+// Reinitializing uses the configured reset, and carries on even if the reset fails
+func TestReinitUsesReset(t *testing.T) {
+
+    fr := &fakeReset{}
+    c := New(WithTransport(NewMemTransport()), WithReset(fr), WithLogger(quietLogger))
+
+    c.reinit()
+    if fr.count != 1 {
+        t.Fatalf("reset %d times, want 1", fr.count)
+    }
+    if c.currentState != cmdStateLPWanRESETREQ {
+        t.Fatalf("state %s after reinit, want %s", c.currentState, cmdStateLPWanRESETREQ)
+    }
+
+    fr.err = errors.New("stuck")
+    c.reinit()
+    if fr.count != 2 {
+        t.Fatalf("reset %d times, want 2", fr.count)
+    }
+    if c.currentState != cmdStateLPWanRESETREQ {
+        t.Fatalf("state %s after failed reset, want %s", c.currentState, cmdStateLPWanRESETREQ)
+    }
+
+    reinits := 0
+    for _, e := range c.History() {
+        if e.Kind == HistoryReinit && e.Detail == "fake" {
+            reinits++
+        }
+    }
+    if reinits != 2 {
+        t.Fatalf("%d reinits remembered, want 2", reinits)
+    }
+
+}
+
+// A software reset is sent like any other command, so that it shows up in the trace and history
+func TestSoftwareResetIsTraced(t *testing.T) {
+
+    mt := NewMemTransport()
+    traced := []string{}
+    c := New(WithTransport(mt), WithReset(SoftwareReset(0)), WithLogger(quietLogger), WithTrace(func(sent bool, line []byte) {
+        if sent {
+            traced = append(traced, string(line))
+        }
+    }))
+
+    err := c.reset.Reset()
+    if err != nil {
+        t.Fatalf("reset: %v", err)
+    }
+    select {
+    case cmd := <-mt.Sent():
+        if string(cmd) != "sys reset" {
+            t.Fatalf("sent %q, want \"sys reset\"", cmd)
+        }
+    default:
+        t.Fatalf("nothing sent")
+    }
+    if len(traced) != 1 || traced[0] != "sys reset" {
+        t.Fatalf("traced %q", traced)
+    }
+    h := c.History()
+    if len(h) == 0 || h[len(h)-1].Kind != HistorySend || h[len(h)-1].Detail != "sys reset" {
+        t.Fatalf("reset not remembered: %v", h)
+    }
+
+    // Without a port there's nothing to reset
+    c.setTransport(nil)
+    if c.reset.Reset() == nil {
+        t.Fatalf("reset without a transport succeeded")
+    }
+
+}
@@ -0,0 +1,262 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Rotation of the receiver through a plan of channels and spreading factors
+package lpwan
+
+import (
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// A scan plan is a list of space-separated entries, each of which is
+//   <freq>[/<sf>[/<bw>[/<dwell>]]]
+// such as "868.1/sf7/125/60s 868.3/sf9/125/30s 869.525/sf12/125/120s".  The frequency is
+// in MHz or Hz, the bandwidth in kHz, and the dwell is how long to listen before moving on.
+type scanChannel struct {
+    freq int
+    sf string
+    bw int
+    dwell time.Duration
+    received uint32
+}
+
+// ScanPlan is a radio's position within its plan
+type ScanPlan struct {
+    mu sync.Mutex
+    channels []scanChannel
+    current int
+    tuned int
+    tunedAt time.Time
+    holdUntil time.Time
+}
+
+// Defaults for entries that don't specify everything
+const (
+    scanDefaultSF = "sf12"
+    scanDefaultBW = 125
+    scanDefaultDwell = 60 * time.Second
+)
+
+// How long we stay on a channel after hearing a device that may be sent a reply, which
+// must cover the service's round trip and the randomized delay before a pingback
+const scanReplyHold = 45 * time.Second
+
+// ParseScanPlan parses a scan plan, returning nil if there isn't one
+func ParseScanPlan(s string) (*ScanPlan, error) {
+
+    entries := strings.Fields(s)
+    if len(entries) == 0 {
+        return nil, nil
+    }
+
+    p := &ScanPlan{}
+    p.tuned = -1
+    for _, entry := range entries {
+        c, err := scanChannelParse(entry)
+        if err != nil {
+            return nil, fmt.Errorf("scan plan entry %s: %v", entry, err)
+        }
+        p.channels = append(p.channels, c)
+    }
+
+    return p, nil
+
+}
+
+// Parse a single entry of a scan plan
+func scanChannelParse(entry string) (c scanChannel, err error) {
+
+    fields := strings.Split(entry, "/")
+    if len(fields) > 4 {
+        return c, errors.New("too many fields")
+    }
+
+    // Frequency, in either MHz or Hz
+    f64, err := strconv.ParseFloat(fields[0], 64)
+    if err != nil {
+        return c, errors.New("bad frequency")
+    }
+    if f64 < 10000 {
+        f64 = f64 * 1000000
+    }
+    c.freq = int(f64 + 0.5)
+    if c.freq < 137000000 || c.freq > 1020000000 {
+        return c, errors.New("frequency out of range")
+    }
+
+    // Spreading factor, with or without the "sf" that the module requires
+    c.sf = scanDefaultSF
+    if len(fields) > 1 && fields[1] != "" {
+        sf, err := strconv.Atoi(strings.TrimPrefix(strings.ToLower(fields[1]), "sf"))
+        if err != nil || sf < 7 || sf > 12 {
+            return c, errors.New("spreading factor must be sf7 through sf12")
+        }
+        c.sf = fmt.Sprintf("sf%d", sf)
+    }
+
+    // Bandwidth
+    c.bw = scanDefaultBW
+    if len(fields) > 2 && fields[2] != "" {
+        c.bw, err = strconv.Atoi(fields[2])
+        if err != nil || (c.bw != 125 && c.bw != 250 && c.bw != 500) {
+            return c, errors.New("bandwidth must be 125, 250, or 500")
+        }
+    }
+
+    // Dwell, in seconds if no unit is given
+    c.dwell = scanDefaultDwell
+    if len(fields) > 3 && fields[3] != "" {
+        d, err := time.ParseDuration(fields[3])
+        if err != nil {
+            secs, err2 := strconv.Atoi(fields[3])
+            if err2 != nil {
+                return c, errors.New("bad dwell time")
+            }
+            d = time.Duration(secs) * time.Second
+        }
+        if d < time.Second {
+            return c, errors.New("dwell time must be at least 1s")
+        }
+        c.dwell = d
+    }
+
+    return c, nil
+
+}
+
+// Validate every channel of the plan against what the module accepts and what is legal in the region
+func (p *ScanPlan) validate(region *loraRegionPlan, model string) error {
+    for i := range p.channels {
+        freq := strconv.Itoa(p.channels[i].freq)
+        _, err := loraValidateFreq(model, freq)
+        if err == nil && region != nil {
+            err = region.validate("freq", freq)
+        }
+        if err != nil {
+            return fmt.Errorf("channel %s: %v", p.channels[i].String(), err)
+        }
+    }
+    return nil
+}
+
+// Get the configured scan plan if it may be used in the region, and otherwise nothing, so that
+// we stay on the region's own frequency
+func (c *Controller) applicableScanPlan(region string, model string) *ScanPlan {
+    if c.configuredScan == nil {
+        return nil
+    }
+    err := c.configuredScan.validate(loraRegionFind(region), model)
+    if err != nil {
+        c.logf("LPWAN ignoring scan plan in %s: %v\n", region, err)
+        return nil
+    }
+    return c.configuredScan
+}
+
+// String describes a channel as it is shown in stats
+func (c *scanChannel) String() string {
+    return fmt.Sprintf("%.3fMHz/%s/%d", float64(c.freq) / 1000000, strings.ToUpper(c.sf), c.bw)
+}
+
+// The receive watchdog to use, in ms, which must not be longer than the shortest dwell or we'd
+// never get the chance to rotate
+func (p *ScanPlan) wdt(defaultMs int) int {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    ms := defaultMs
+    for i := range p.channels {
+        dwellMs := int(p.channels[i].dwell / time.Millisecond)
+        if dwellMs < ms {
+            ms = dwellMs
+        }
+    }
+    return ms
+}
+
+// Forget which channel the module is tuned to, such as after it has been reset
+func (p *ScanPlan) untune() {
+    p.mu.Lock()
+    p.tuned = -1
+    p.holdUntil = time.Time{}
+    p.mu.Unlock()
+}
+
+// Determine the commands needed to tune the module before the next receive, moving on to
+// the next channel if we've been on this one long enough and aren't awaiting a reply
+func (p *ScanPlan) next() (commands []string) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    now := time.Now()
+    if p.tuned >= 0 && now.Before(p.holdUntil) {
+        return nil
+    }
+    if p.tuned >= 0 && now.Sub(p.tunedAt) >= p.channels[p.current].dwell {
+        p.current = (p.current + 1) % len(p.channels)
+    }
+    if p.tuned == p.current {
+        return nil
+    }
+
+    // Only send what differs from the channel we're tuned to
+    c := &p.channels[p.current]
+    var was *scanChannel
+    if p.tuned >= 0 {
+        was = &p.channels[p.tuned]
+    }
+    if was == nil || was.freq != c.freq {
+        commands = append(commands, fmt.Sprintf("radio set freq %d", c.freq))
+    }
+    if was == nil || was.sf != c.sf {
+        commands = append(commands, "radio set sf " + c.sf)
+    }
+    if was == nil || was.bw != c.bw {
+        commands = append(commands, fmt.Sprintf("radio set bw %d", c.bw))
+    }
+    p.tuned = p.current
+    p.tunedAt = now
+
+    return commands
+}
+
+// Count a packet received on the channel to which we're tuned
+func (p *ScanPlan) received() {
+    if p == nil {
+        return
+    }
+    p.mu.Lock()
+    if p.tuned >= 0 {
+        p.channels[p.tuned].received++
+    }
+    p.mu.Unlock()
+}
+
+// Stay on the channel to which we're tuned, because a device there may be sent a reply
+func (p *ScanPlan) hold() {
+    if p == nil {
+        return
+    }
+    p.mu.Lock()
+    p.holdUntil = time.Now().Add(scanReplyHold)
+    p.mu.Unlock()
+}
+
+// Stats describes how many packets have been received on each channel
+func (p *ScanPlan) Stats() string {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    s := ""
+    for i := range p.channels {
+        if s != "" {
+            s += ","
+        }
+        s += fmt.Sprintf("%s:%d", p.channels[i].String(), p.channels[i].received)
+    }
+    return s
+}
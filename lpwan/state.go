@@ -0,0 +1,669 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// State management for processing of Lora commands
+package lpwan
+
+import (
+    "bytes"
+    "encoding/hex"
+    "fmt"
+    "strconv"
+    "time"
+)
+
+// State is a state of the controller's state machine
+type State uint16
+
+// Command processing states
+const (
+    cmdStateIDLE State = iota
+    cmdStateLPWanRESETREQ
+    cmdStateLPWanRESETRPL
+    cmdStateLPWanGETVERRPL
+    cmdStateLPWanMACPAUSERPL
+    cmdStateLPWanSETWDTRPL
+    cmdStateLPWanRCVRPL
+    cmdStateLPWanTXRPL1
+    cmdStateLPWanTXRPL2
+    cmdStateLPWanSNRRPL
+    cmdStateLPWanSENDFQRPL
+    cmdStateLPWanGETEUIRPL
+    cmdStateLPWanSCANRPL
+    cmdStateLPWanRSSIRPL
+    cmdStateLPWanTUNERPL
+)
+
+// Names of the states, for debugging
+var stateNames = map[State]string{
+    cmdStateIDLE: "idle",
+    cmdStateLPWanRESETREQ: "reset requested",
+    cmdStateLPWanRESETRPL: "resetting",
+    cmdStateLPWanGETVERRPL: "getting version",
+    cmdStateLPWanMACPAUSERPL: "pausing mac",
+    cmdStateLPWanSETWDTRPL: "configuring",
+    cmdStateLPWanRCVRPL: "receiving",
+    cmdStateLPWanTXRPL1: "transmitting",
+    cmdStateLPWanTXRPL2: "awaiting transmit completion",
+    cmdStateLPWanSNRRPL: "getting snr",
+    cmdStateLPWanSENDFQRPL: "setting frequency",
+    cmdStateLPWanGETEUIRPL: "getting hweui",
+    cmdStateLPWanSCANRPL: "tuning",
+    cmdStateLPWanRSSIRPL: "getting rssi",
+    cmdStateLPWanTUNERPL: "tuning for transmit",
+}
+
+// String describes the state
+func (s State) String() string {
+    name, ok := stateNames[s]
+    if !ok {
+        return fmt.Sprintf("state %d", uint16(s))
+    }
+    return name
+}
+
+// How long to wait for the reply to a command, and how many times to resend it if none comes
+type replyPolicy struct {
+    timeout time.Duration
+    retries int
+}
+
+// Get the policy for awaiting a reply in a state.  Queries and settings may safely be resent,
+// but a receive or a transmit may not.
+func (c *Controller) replyPolicy(state State) replyPolicy {
+    switch state {
+    case cmdStateLPWanRESETRPL:
+        // The module takes a moment to come back up after a reset
+        return replyPolicy{10 * time.Second, 2}
+    case cmdStateLPWanRCVRPL:
+        // The module's own receive watchdog should always end the receive well before this
+        return replyPolicy{time.Duration(c.receiveWatchdogMs()) * time.Millisecond + 15 * time.Second, 0}
+    case cmdStateLPWanTXRPL1:
+        return replyPolicy{5 * time.Second, 0}
+    case cmdStateLPWanTXRPL2:
+        // Longer than any transmission we'd be permitted to make
+        return replyPolicy{30 * time.Second, 0}
+    case cmdStateLPWanSNRRPL, cmdStateLPWanRSSIRPL:
+        // The message is more important than its metadata, so don't hold it up
+        return replyPolicy{5 * time.Second, 0}
+    }
+    return replyPolicy{5 * time.Second, 2}
+}
+
+// Set the current state of the state machine
+func (c *Controller) setState(newState State) {
+    oldState := c.currentState
+    c.statsMutex.Lock()
+    c.currentState = newState
+    c.statsMutex.Unlock()
+    c.stateChangeWatchdogReset()
+    if newState != oldState {
+        c.remember(HistoryState, oldState.String())
+        if c.onStateChange != nil {
+            c.onStateChange(oldState, newState)
+        }
+    }
+}
+
+// Send a command to the module and await its reply in the specified state
+func (c *Controller) send(cmd string, newState State) {
+    c.lastCommand = cmd
+    c.retries = 0
+    c.sendCommandString(cmd)
+    c.awaitReply(newState)
+}
+
+// Send a command after a delay, such as to allow the module to settle.  Anything that
+// arrives in the meantime is a stale reply to something we've given up on, and is discarded.
+func (c *Controller) sendAfter(d time.Duration, cmd string, newState State) {
+    c.delaying = true
+    c.setTimer(c.scaled(d), func() {
+        c.delaying = false
+        c.send(cmd, newState)
+    })
+}
+
+// Restart the receive after a delay
+func (c *Controller) restartReceiveAfter(d time.Duration) {
+    c.delaying = true
+    c.setTimer(c.scaled(d), func() {
+        c.delaying = false
+        c.restartReceive()
+    })
+}
+
+// Enter a state in which we're awaiting a reply, and start its timeout
+func (c *Controller) awaitReply(newState State) {
+    c.setState(newState)
+    c.setTimer(c.scaled(c.replyPolicy(newState).timeout), c.replyTimeout)
+}
+
+// Scale one of our own delays or timeouts by the configured time scale
+func (c *Controller) scaled(d time.Duration) time.Duration {
+    return time.Duration(float64(d) * c.timeScale)
+}
+
+// Handle the lack of a reply to the last command, by resending it if it's safe to do so
+// and otherwise by resetting the module
+func (c *Controller) replyTimeout() {
+
+    c.remember(HistoryTimeout, c.lastCommand)
+    if c.holdForReopen(fmt.Sprintf("no reply to %s", c.lastCommand)) {
+        return
+    }
+
+    if c.retries < c.replyPolicy(c.currentState).retries {
+        c.retries++
+        c.logf("LPWAN no reply to %s; retrying\n", c.lastCommand)
+        c.sendCommandString(c.lastCommand)
+        c.awaitReply(c.currentState)
+        return
+    }
+
+    switch c.currentState {
+    case cmdStateLPWanSNRRPL, cmdStateLPWanRSSIRPL:
+        c.logf("LPWAN no reply to %s; processing message without it\n", c.lastCommand)
+        if c.currentState == cmdStateLPWanSNRRPL {
+            c.receivedMeta = Metadata{SNR: InvalidSNR}
+        }
+        c.processReceivedMessage()
+    default:
+        c.recover(fmt.Sprintf("no reply to %s", c.lastCommand))
+    }
+
+}
+
+// Set into a Receive state, and await reply.  If we're scanning, first
+// move on to the next channel of the plan if it's time to do so.
+func (c *Controller) restartReceive() {
+    c.receiveAcked = false
+    if c.restoreAfterTransmit(c.restartReceive) {
+        return
+    }
+    if c.scan != nil {
+        c.scanCommands = c.scan.next()
+        if len(c.scanCommands) != 0 {
+            c.sendNextScanCommand()
+            return
+        }
+    }
+    c.receiveStartedAt = time.Now()
+    c.send("radio rx 0", cmdStateLPWanRCVRPL)
+}
+
+// Stop a receive in progress, so that an outbound can be transmitted right away rather than
+// waiting for the receive watchdog
+func (c *Controller) stopReceive() {
+    if !c.firmware.supports(capabilityRxStop) {
+        return
+    }
+    if c.currentState != cmdStateLPWanRCVRPL || !c.receiveAcked || c.rxStopOutstanding {
+        return
+    }
+    c.rxStopOutstanding = true
+    c.sendCommandString("radio rxstop")
+}
+
+// Handle the reply to a "radio rxstop", returning true if that's what this was.  Because the
+// receive may have ended on its own before the module saw the rxstop, the reply may arrive in
+// the middle of handling that, and so we check for it before dispatching on state.
+func (c *Controller) rxStopReply(cmd []byte) bool {
+
+    outstanding := c.rxStopOutstanding
+    stopped := outstanding && c.receiveAcked && c.currentState == cmdStateLPWanRCVRPL && bytes.HasPrefix(cmd, []byte("ok"))
+    tooLate := outstanding && bytes.HasPrefix(cmd, []byte("invalid_param"))
+    if stopped || tooLate {
+        c.rxStopOutstanding = false
+        c.receiveAcked = false
+    }
+
+    // If the receive had already ended, whatever ended it has taken care of the outbound
+    if tooLate {
+        return true
+    }
+    if !stopped {
+        return false
+    }
+
+    c.logf("Receive stopped for outbound\n")
+    if !c.sentPendingOutbound() {
+        c.restartReceive()
+    }
+    return true
+
+}
+
+// Send the next of the commands that tune the module to a channel of the scan plan
+func (c *Controller) sendNextScanCommand() {
+    cmd := c.scanCommands[0]
+    c.scanCommands = c.scanCommands[1:]
+    c.send(cmd, cmdStateLPWanSCANRPL)
+}
+
+// Set the state to perform a reset
+func (c *Controller) setResetState() {
+    // The reset loses the channel to which we were tuned
+    if c.scan != nil {
+        c.scan.untune()
+    }
+    c.settings = nil
+    c.tuneCommands = nil
+    c.afterTune = nil
+    c.restoreCommands = nil
+    c.receiveStartedAt = time.Time{}
+    c.receiveAcked = false
+    c.rxStopOutstanding = false
+    c.delaying = false
+    c.timerGeneration++
+    c.timerAction = nil
+	c.setState(cmdStateLPWanRESETREQ)
+}
+
+// The receive watchdog, in ms
+func (c *Controller) receiveWatchdogMs() int {
+    // On 2017-05-09, change this from exactly 60000 to an odd number,
+    // so that we don't accidentally get into a rhythm with transmitters
+    // who also tend to synchronize on even boundaries.
+    ms := 54321
+    if c.scan != nil {
+        ms = c.scan.wdt(ms)
+    }
+    return ms
+}
+
+// Process an inbound message received from the LPWAN.  This is only ever called
+// from the radio's event loop.
+func (c *Controller) process(cmd []byte) {
+    cmdstr := string(cmd)
+
+    // Special case of kicking off the state machine, which isn't a reply to anything
+    if cmd == nil {
+        cmd = []byte("")
+    } else {
+        c.logf("recv(%s)\n", cmdstr)
+        c.remember(HistoryRecv, cmdstr)
+        if c.delaying {
+            return
+        }
+    }
+
+    // State dispatcher
+    if c.rxStopReply(cmd) {
+        return
+    }
+    switch c.currentState {
+
+        ////
+        // Initialization states
+        ////
+
+    case cmdStateLPWanRESETREQ:
+        c.sendAfter(4 * time.Second, "sys get ver", cmdStateLPWanGETVERRPL)
+
+    case cmdStateLPWanGETVERRPL:
+        c.regionCommandNumber = 0
+        if (!bytes.HasPrefix(cmd, []byte("RN2483"))) && (!bytes.HasPrefix(cmd, []byte("RN2903"))) {
+            c.sendAfter(4 * time.Second, "sys get ver", cmdStateLPWanGETVERRPL)
+        } else {
+            fw, _ := parseFirmwareVersion(cmdstr)
+            if fw != c.firmware {
+                c.logf("LPWAN firmware %s\n", fw)
+            }
+            country := ""
+            if c.country != nil {
+                country = c.country()
+            }
+            region, err := RegionSelect(c.configuredRegion, country, fw.Model)
+            if err != nil {
+                c.logf("LPWAN ignoring configured region: %v\n", err)
+            }
+            if c.region != "" && region != c.region {
+                c.logf("LPWAN region changed from %s to %s\n", c.region, region)
+            }
+            scan := c.applicableScanPlan(region, fw.Model)
+            c.statsMutex.Lock()
+            c.firmware = fw
+            // The ledger survives resets, lest they refill the budget, but its limits are the region's
+            if c.duty == nil || region != c.region {
+                c.duty = NewDutyLedger(region)
+            }
+            c.region = region
+            c.scan = scan
+            c.statsMutex.Unlock()
+            c.setupCommands = c.radioSetupCommands()
+            c.sendAfter(4 * time.Second, "sys reset", cmdStateLPWanRESETRPL)
+        }
+
+    case cmdStateLPWanRESETRPL:
+        c.sendAfter(4 * time.Second, "mac pause", cmdStateLPWanMACPAUSERPL)
+
+    case cmdStateLPWanMACPAUSERPL:
+        // If we're still getting these responses, it's because we're still
+        // flushing the buffer of incoming sys get ver's or sys resets from
+        // previous commands.  In this case, do NOT issue new commands
+        // because we'll just aggravate the situation.  Just flush,
+        // and keep waiting for the expected command.
+        if (bytes.HasPrefix(cmd, []byte("RN2483"))) || (bytes.HasPrefix(cmd, []byte("RN2903"))) {
+            break
+        }
+        i64, err := strconv.ParseInt(cmdstr, 10, 64)
+        if err != nil || i64 < 100000 {
+            c.logf("Bad response from mac pause: %s\n", cmdstr)
+        } else {
+            c.sendAfter(4 * time.Second, "sys get hweui", cmdStateLPWanGETEUIRPL)
+        }
+
+    case cmdStateLPWanGETEUIRPL:
+        c.statsMutex.Lock()
+        c.hweui = cmdstr
+        c.statsMutex.Unlock()
+        c.send(fmt.Sprintf("radio set wdt %d", c.receiveWatchdogMs()), cmdStateLPWanSETWDTRPL)
+
+    case cmdStateLPWanSETWDTRPL:
+        isCommand, theCommand := c.lorafpGetCommand(c.regionCommandNumber)
+        if (isCommand) {
+            c.regionCommandNumber++;
+            c.sendAfter(100 * time.Millisecond, theCommand, cmdStateLPWanSETWDTRPL)
+            break;
+        }
+        fallthrough
+    case cmdStateLPWanSENDFQRPL:
+        // Allow the LPWAN to settle after init, and then begin a receive
+        c.restartReceiveAfter(4 * time.Second)
+
+        ////
+        // Steady-state receive handling states
+        ////
+
+    case cmdStateLPWanTUNERPL:
+        if !bytes.HasPrefix(cmd, []byte("ok")) {
+            c.logf("LPWAN %s error: %s\n", c.lastCommand, cmdstr)
+        }
+        c.sendNextTuneCommand()
+
+    case cmdStateLPWanSCANRPL:
+        if !bytes.HasPrefix(cmd, []byte("ok")) {
+            c.logf("LPWAN scan error: %s\n", cmdstr)
+        }
+        if len(c.scanCommands) != 0 {
+            c.sendNextScanCommand()
+        } else {
+            c.restartReceive()
+        }
+
+    case cmdStateLPWanRCVRPL:
+        if bytes.HasPrefix(cmd, []byte("ok")) {
+            // this is expected response from initiating the rcv,
+            // so just keep waiting for a message to come in, unless
+            // an outbound was queued while we were starting up
+            c.receiveAcked = true
+            c.busyReset()
+            if len(c.outboundQueue) != 0 {
+                c.stopReceive()
+            }
+            break
+        }
+        c.receiveAcked = false
+        if bytes.HasPrefix(cmd, []byte("radio_err")) || bytes.HasPrefix(cmd, []byte("radio_rx")) {
+            // The receive ended as it should, so the module is healthy
+            c.recovered()
+        }
+        if bytes.HasPrefix(cmd, []byte("radio_err")) {
+            // Expected from receive timeout of WDT seconds.  If it comes before
+            // that, it's because a packet was received with a bad CRC.
+            if time.Now().Sub(c.receiveStartedAt) < time.Duration(c.receiveWatchdogMs() * 9 / 10) * time.Millisecond {
+                c.statsMutex.Lock()
+                c.crcErrors++
+                c.statsMutex.Unlock()
+            }
+            // if there's a pending outbound, transmit it (which will change state)
+            // else restart the receive
+            if !c.sentPendingOutbound() {
+                c.restartReceive()
+            }
+        } else if bytes.HasPrefix(cmd, []byte("busy")) {
+            // This is not at all expected, but it means that we're
+            // moving too quickly and we should try again.
+            c.restartReceiveAfter(5 * time.Second)
+            // reset the world if too many consecutive busy errors
+            c.busy()
+        } else if bytes.HasPrefix(cmd, []byte("radio_rx")) {
+            // skip whitespace, then remember the message that we received,
+            // because we'll need it after we get the SNR of the transmission
+            var hexstarts int
+            for hexstarts = len("radio_rx"); hexstarts < len(cmd); hexstarts++ {
+                if cmd[hexstarts] > ' ' {
+                    break
+                }
+            }
+            c.receivedMessage = cmd[hexstarts:]
+            c.receivedAt = time.Now()
+            c.scan.received()
+            // Get the SNR of the last message received
+            c.send("radio get snr", cmdStateLPWanSNRRPL)
+        } else {
+            // Totally unknown error, but since we cannot just
+            // leave things in a state without a pending receive,
+            // we need to just restart the world.
+            c.recover("rcv error")
+        }
+
+    case cmdStateLPWanSNRRPL:
+        {
+            // Get the number in the commanbd buffer
+            snr64, err := strconv.ParseFloat(cmdstr, 64)
+            if err != nil {
+                snr64 = float64(InvalidSNR)
+            }
+            c.receivedMeta = Metadata{SNR: float32(snr64)}
+            // Get the RSSI of the last message received, if the firmware can tell us
+            if c.firmware.supports(capabilityPktRssi) && !c.noPktRssi {
+                c.send("radio get pktrssi", cmdStateLPWanRSSIRPL)
+                break
+            }
+            c.processReceivedMessage()
+        }
+
+    case cmdStateLPWanRSSIRPL:
+        {
+            // If we were wrong about the firmware having this command, don't bother asking again
+            rssi64, err := strconv.ParseInt(cmdstr, 10, 32)
+            if err == nil {
+                c.receivedMeta.RSSI = int32(rssi64)
+            } else if bytes.HasPrefix(cmd, []byte("invalid_param")) {
+                c.logf("LPWAN firmware doesn't support pktrssi\n")
+                c.noPktRssi = true
+            }
+            c.processReceivedMessage()
+        }
+
+        ////
+        // Post-cmdEnqueueOutbound transmit-handling states
+        ////
+
+    case cmdStateLPWanTXRPL1:
+        if bytes.HasPrefix(cmd, []byte("ok")) {
+            c.busyReset()
+            c.duty.Record(c.transmitFreq, c.transmitAirtime)
+            c.awaitReply(cmdStateLPWanTXRPL2)
+        } else if bytes.HasPrefix(cmd, []byte("busy")) {
+            // This is not at all expected, but it means that we're
+            // moving too quickly and we should try again.
+            c.restartReceiveAfter(5 * time.Second)
+            // reset the world if too many consecutive busy errors
+            c.busy()
+        } else {
+            c.logf("LPWAN xmt1 error\n")
+            c.restartReceive()
+        }
+
+    case cmdStateLPWanTXRPL2:
+        if bytes.HasPrefix(cmd, []byte("radio_tx_ok")) {
+            c.recovered()
+            // if there's another pending outbound, transmit it, else restart the receive
+            if !c.sentPendingOutbound() {
+                c.restartReceive()
+            }
+        } else {
+            c.logf("LPWAN xmt2 error\n")
+            c.restartReceive()
+        }
+
+    }
+
+}
+
+// Process the message just received along with its metadata, and then resume
+func (c *Controller) processReceivedMessage() {
+    // Hand it to whoever is interested, along with how it was received
+    c.receivedMeta.ReceivedAt = c.receivedAt
+    c.receivedMeta.Frequency, c.receivedMeta.DataRate, c.receivedMeta.CodingRate = c.tuning()
+    frame, err := hexDecode(c.receivedMessage)
+    if err != nil {
+        c.logf("LPWAN received %s\n", err)
+        if c.onReceiveError != nil {
+            c.onReceiveError(err)
+        }
+    } else if c.onReceive != nil {
+        c.onReceive(frame, c.receivedMeta)
+    }
+    // If there's a pending outbound, transmit it (which will change state)
+    // else restart the receive
+    if !c.sentPendingOutbound() {
+        c.restartReceive()
+    }
+}
+
+// Send the pending outbound (from the event loop)
+func (c *Controller) sentPendingOutbound() bool {
+    hexchar := []byte("0123456789ABCDEF")
+
+    // Give the caller a last chance to enqueue something
+    if c.onReadyToTransmit != nil {
+        c.onReadyToTransmit()
+    }
+
+    // Put the radio back as it was if the last transmission was tuned differently
+    if c.restoreAfterTransmit(func() {
+        if !c.sentPendingOutbound() {
+            c.restartReceive()
+        }
+    }) {
+        return true
+    }
+
+    // We test the queue length because we can never afford to block here,
+    // and we knkow that we're the only consumer of this queue
+    for c.deferredOutbound != nil || len(c.outboundQueue) != 0 {
+
+        // An outbound that was deferred for lack of duty-cycle budget goes first
+        var ocmd outboundCommand
+        if c.deferredOutbound != nil {
+            ocmd = *c.deferredOutbound
+            c.deferredOutbound = nil
+        } else {
+            ocmd = <-c.outboundQueue
+        }
+
+        // Something that must go out at a particular time is useless once that has passed
+        if ocmd.missedDeadline() {
+            c.logf("Not transmitting %d bytes: %dms past its deadline\n", len(ocmd.Command), time.Since(ocmd.Deadline) / time.Millisecond)
+            continue
+        }
+
+        // Don't exceed the region's limit on the duration of a transmission
+        plan := loraRegionFind(c.region)
+        airtime := c.airtime(len(ocmd.Command))
+        if ocmd.Tx != nil {
+            airtime = ocmd.Tx.airtime(len(ocmd.Command))
+        }
+        if plan != nil && plan.dwell != 0 && airtime > plan.dwell {
+            c.logf("Not transmitting %d bytes: %dms on air exceeds the %dms dwell limit in %s\n",
+                len(ocmd.Command), airtime / time.Millisecond, plan.dwell / time.Millisecond, plan.name)
+            continue
+        }
+
+        // Nor its band or power, whether it's to be sent on a frequency of the caller's
+        // choosing or on the one we're receiving on, which a scan plan may have changed
+        freq, _ := strconv.Atoi(c.settings["freq"])
+        if ocmd.Tx != nil {
+            freq = ocmd.Tx.Frequency
+        }
+        if plan != nil {
+            err := plan.validate("freq", strconv.Itoa(freq))
+            if err == nil {
+                err = plan.validate("pwr", c.settings["pwr"])
+            }
+            if err != nil {
+                c.logf("Not transmitting %d bytes at %.3fMHz: %v\n", len(ocmd.Command), float64(freq) / 1000000, err)
+                continue
+            }
+        }
+
+        // Nor its limit on the fraction of time spent transmitting.  If we'll have the budget
+        // soon enough, hang onto it and try again after the next receive, unless it must go
+        // out at a particular time.
+        ok, wait := c.duty.Allowed(freq, airtime)
+        if !ok {
+            if ocmd.Tx == nil && time.Now().Add(wait).Sub(ocmd.QueuedAt) < dutyMaxDefer {
+                c.logf("Deferring %d bytes for %ds to stay within duty cycle\n", len(ocmd.Command), wait / time.Second)
+                c.deferredOutbound = &ocmd
+                break
+            }
+            c.logf("Not transmitting %d bytes: duty cycle budget exhausted\n", len(ocmd.Command))
+            continue
+        }
+
+        // It's charged against the budget only once the module has accepted it
+        c.transmitFreq = freq
+        c.transmitAirtime = airtime
+
+        // Convert it to a hex commnd
+        outbuf := []byte("radio tx ")
+        for _, databyte := range ocmd.Command {
+            loChar := hexchar[(databyte & 0x0f)]
+            hiChar := hexchar[((databyte >> 4) & 0x0f)]
+            outbuf = append(outbuf, hiChar)
+            outbuf = append(outbuf, loChar)
+        }
+
+        // Send it, first tuning the radio for it if need be
+        if ocmd.Tx != nil {
+            c.tuneForTransmit(ocmd, string(outbuf))
+            return true
+        }
+        c.send(string(outbuf), cmdStateLPWanTXRPL1)
+        // Returning true indicates that we set state
+        return true
+
+    }
+
+    // Returning false indicates that state is unchanged
+    return false
+}
+
+// Convert a received message from hexadecimal text to binary.  Anything that isn't valid hex
+// is an error rather than being quietly decoded as zeroes, because it means that the line was garbled.
+func hexDecode(text []byte) ([]byte, error) {
+    if len(text) == 0 {
+        return nil, &ReceiveError{ReceiveErrEmpty, "no payload"}
+    }
+    buf := make([]byte, hex.DecodedLen(len(text)))
+    _, err := hex.Decode(buf, text)
+    if err == hex.ErrLength {
+        return nil, &ReceiveError{ReceiveErrOddLength, fmt.Sprintf("%d hex digits", len(text))}
+    }
+    if err != nil {
+        return nil, &ReceiveError{ReceiveErrBadHex, err.Error()}
+    }
+    return buf, nil
+}
+
+// Commands for configuring the radio for its region
+func (c *Controller) lorafpGetCommand(cmdno int) (bool, string) {
+    if cmdno < len(c.setupCommands) {
+        return true, c.setupCommands[cmdno]
+    }
+    return false, ""
+}
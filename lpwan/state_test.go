@@ -0,0 +1,160 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package lpwan
+
+import (
+    "testing"
+)
+
+// Feed the controller the module's version, as happens after every reset
+func identifyModule(c *Controller, version string) {
+    c.setResetState()
+    c.setState(cmdStateLPWanGETVERRPL)
+    c.process([]byte(version))
+}
+
+// The duty-cycle ledger is kept across resets, but replaced when the region changes
+func TestDutyLedgerFollowsRegion(t *testing.T) {
+
+    country := "DE"
+    c := New(WithLogger(quietLogger), WithCountry(func() string {
+        return country
+    }))
+
+    identifyModule(c, emulatorRN2483Version)
+    if c.Region() != "eu" || c.duty == nil {
+        t.Fatalf("region %q with ledger %v, want eu with a ledger", c.Region(), c.duty)
+    }
+    eu := c.duty
+
+    identifyModule(c, emulatorRN2483Version)
+    if c.duty != eu {
+        t.Fatalf("ledger replaced by a reset")
+    }
+
+    country = "IN"
+    identifyModule(c, emulatorRN2483Version)
+    if c.Region() != "in865" || c.duty != nil {
+        t.Fatalf("region %q with ledger %v, want in865 without a ledger", c.Region(), c.duty)
+    }
+
+    country = "DE"
+    identifyModule(c, emulatorRN2483Version)
+    if c.Region() != "eu" || c.duty == nil || c.duty == eu {
+        t.Fatalf("region %q, want eu with a new ledger", c.Region())
+    }
+
+}
+
+// A configured region takes precedence over the country, however often we're reset
+func TestConfiguredRegion(t *testing.T) {
+
+    c := New(WithLogger(quietLogger), WithRegion("EU868"), WithCountry(func() string {
+        return "IN"
+    }))
+    for i := 0; i < 2; i++ {
+        identifyModule(c, emulatorRN2483Version)
+        if c.Region() != "eu" {
+            t.Fatalf("region %q, want eu", c.Region())
+        }
+    }
+
+}
+
+// A configured region outside the band of the module is refused in favour of one that the module supports
+func TestConfiguredRegionOutOfBand(t *testing.T) {
+
+    tests := []struct {
+        configured string
+        country string
+        want string
+    }{
+        {"us", "DE", "eu"},
+        {"as923", "IN", "in865"},
+        {"us", "", "eu"},
+        {"nowhere", "", "eu"},
+    }
+
+    for _, test := range tests {
+        c := New(WithLogger(quietLogger), WithRegion(test.configured), WithCountry(func() string {
+            return test.country
+        }))
+        identifyModule(c, emulatorRN2483Version)
+        if c.Region() != test.want {
+            t.Errorf("%s in %q: region %q, want %q", test.configured, test.country, c.Region(), test.want)
+        }
+        region, err := RegionSelect(test.configured, test.country, "RN2483")
+        if region != test.want || err == nil {
+            t.Errorf("%s in %q: selected %q with %v, want %q with an error", test.configured, test.country, region, err, test.want)
+        }
+    }
+
+}
+
+// A scan plan is only used if every one of its channels is legal in the region
+func TestScanPlanFollowsRegion(t *testing.T) {
+
+    tests := []struct {
+        plan string
+        country string
+        used bool
+    }{
+        {"868.1/sf7 868.3/sf9 869.525/sf12", "DE", true},
+        {"868.1/sf7 915.0/sf9", "DE", false},
+        {"868.1/sf7 433.175/sf9", "DE", false},
+        {"868.1/sf7 868.3/sf9", "IN", false},
+        {"865.0625 865.4025 865.985", "IN", true},
+    }
+
+    for _, test := range tests {
+        plan, err := ParseScanPlan(test.plan)
+        if err != nil {
+            t.Fatalf("%s: %v", test.plan, err)
+        }
+        c := New(WithLogger(quietLogger), WithScanPlan(plan), WithCountry(func() string {
+            return test.country
+        }))
+        identifyModule(c, emulatorRN2483Version)
+        if (c.scanPlan() == plan) != test.used {
+            t.Errorf("%s in %s: used %v, want %v", test.plan, test.country, !test.used, test.used)
+        }
+        if (c.ChannelStats() != "") != test.used {
+            t.Errorf("%s in %s: channel stats %q", test.plan, test.country, c.ChannelStats())
+        }
+    }
+
+}
+
+// A frame that the module reported but that can't be passed on is reported with the reason
+func TestReceiveErrors(t *testing.T) {
+
+    tests := []struct {
+        message string
+        kind string
+    }{
+        {"", ReceiveErrEmpty},
+        {"48656C6C6G", ReceiveErrBadHex},
+        {"48656C6C6 ", ReceiveErrBadHex},
+        {"48656C6C6", ReceiveErrOddLength},
+        {"48656C6C6F", ""},
+    }
+
+    for _, test := range tests {
+        kind := ""
+        c := New(WithTransport(NewMemTransport()), WithLogger(quietLogger), OnReceiveError(func(err error) {
+            re, isReceiveError := err.(*ReceiveError)
+            if !isReceiveError {
+                t.Fatalf("%q: %T error: %v", test.message, err, err)
+            }
+            kind = re.Kind
+        }))
+        c.receivedMessage = []byte(test.message)
+        c.processReceivedMessage()
+        if kind != test.kind {
+            t.Errorf("%q: receive error %q, want %q", test.message, kind, test.kind)
+        }
+    }
+
+}
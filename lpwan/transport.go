@@ -0,0 +1,161 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Line-oriented transports used to talk to the LPWAN module
+package lpwan
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "sync"
+    "time"
+    "github.com/tarm/serial"
+)
+
+// Transport is a bidirectional, line-oriented link to a Microchip RN2483/RN2903.
+// The state machine only ever deals in whole lines, so the transport is responsible
+// for framing inbound data and for appending the delimiter to outbound commands.
+type Transport interface {
+    // ReadLine blocks until a complete non-blank line is available, returned without its delimiter
+    ReadLine() ([]byte, error)
+    // WriteCommand sends a single command to the module
+    WriteCommand(cmd []byte) error
+    // Flush discards any partially-received data, such as after a hardware reset
+    Flush()
+    // Close shuts down the transport, causing any pending ReadLine to fail
+    Close() error
+}
+
+// ErrTransportClosed is returned by ReadLine once a transport has been closed
+var ErrTransportClosed = errors.New("transport closed")
+
+// serialTransport is the production transport, talking to the module over a UART
+type serialTransport struct {
+    port *serial.Port
+    name string
+    buf []byte
+    mu sync.Mutex
+    framer *lineFramer
+    lines [][]byte
+    verbose bool
+    closed bool
+}
+
+// Size of the serial read buffer
+const serialReadBufsize = 1024
+
+// How long a read waits for data before giving us the chance to notice that the port has been
+// closed.  Closing the port doesn't interrupt a read that is blocked in the kernel.
+const serialReadTimeout = 500 * time.Millisecond
+
+// Open a serial transport with the specified configuration, optionally logging everything read
+func newSerialTransport(config serial.Config, verbose bool) (*serialTransport, error) {
+
+    // Reads return when data arrives or when the timeout expires, whichever comes first
+    config.ReadTimeout = serialReadTimeout
+    s, err := serial.OpenPort(&config)
+    if err != nil {
+        return nil, err
+    }
+
+    t := &serialTransport{}
+    t.port = s
+    t.name = config.Name
+    t.buf = make([]byte, serialReadBufsize)
+    t.framer = newLineFramer(maxLineLength)
+    t.verbose = verbose
+
+    return t, nil
+
+}
+
+// ReadLine returns the next line received on the serial port
+func (t *serialTransport) ReadLine() ([]byte, error) {
+
+    for {
+
+        // Return lines that have already been framed, unless we've been closed
+        t.mu.Lock()
+        if t.closed {
+            t.mu.Unlock()
+            return nil, ErrTransportClosed
+        }
+        if len(t.lines) != 0 {
+            line := t.lines[0]
+            t.lines = t.lines[1:]
+            t.mu.Unlock()
+            return line, nil
+        }
+        t.mu.Unlock()
+
+        // Do the read, which returns nothing (as EOF) if no data arrives before the timeout.
+        // A device that has gone away, such as a USB module that has been unplugged, also
+        // returns nothing, but does so at once rather than after the timeout.
+        readAt := time.Now()
+        n, err := t.port.Read(t.buf)
+        if t.isClosed() {
+            return nil, ErrTransportClosed
+        }
+        if err == io.EOF && n == 0 && time.Since(readAt) >= serialReadTimeout / 2 {
+            continue
+        }
+        if err != nil {
+            return nil, err
+        }
+
+        if t.verbose {
+            go fmt.Printf("read(%d): '%s'\n% 02x\n", n, t.buf[:n], t.buf[:n])
+        }
+
+        // Frame what we've received.  Note that we do this under the lock so that
+        // a concurrent Flush is guaranteed to take effect at a line boundary.
+        t.mu.Lock()
+        noise, garbled, overlong := t.framer.noiseBytes, t.framer.garbledLines, t.framer.overlongLines
+        t.lines = append(t.lines, t.framer.Write(t.buf[:n])...)
+        if t.verbose && t.framer.noiseBytes != noise {
+            go fmt.Printf("serial: skipped %d noise bytes\n", t.framer.noiseBytes - noise)
+        }
+        if t.framer.garbledLines != garbled {
+            go fmt.Printf("serial: discarded garbled line\n")
+        }
+        if t.framer.overlongLines != overlong {
+            go fmt.Printf("serial: discarded line longer than %d bytes\n", maxLineLength)
+        }
+        t.mu.Unlock()
+
+    }
+
+}
+
+// WriteCommand writes a command to the serial port, appending the newline
+func (t *serialTransport) WriteCommand(cmd []byte) error {
+    _, err := t.port.Write(append(cmd, []byte("\r\n")...))
+    return err
+}
+
+// Flush discards everything received up until now: the partial line being assembled,
+// lines framed but not yet read, and anything still sitting in the OS's buffers.
+func (t *serialTransport) Flush() {
+    t.mu.Lock()
+    t.framer.Reset()
+    t.lines = nil
+    t.port.Flush()
+    t.mu.Unlock()
+}
+
+// Close closes the serial port.  A pending ReadLine notices when its read times out.
+func (t *serialTransport) Close() error {
+    t.mu.Lock()
+    t.closed = true
+    t.mu.Unlock()
+    return t.port.Close()
+}
+
+// Determine whether the serial port has been closed
+func (t *serialTransport) isClosed() bool {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return t.closed
+}
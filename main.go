@@ -6,6 +6,7 @@
 package main
 
 import (
+    "encoding/json"
     "fmt"
     "io/ioutil"
     "net/http"
@@ -13,6 +14,7 @@ import (
     "time"
     "runtime"
     "strconv"
+    "github.com/Safecast/TTGate/lpwan"
 )
 
 // OurTimezone is the time zone of the gateway
@@ -39,20 +41,35 @@ func main() {
     // Translate the DNS address to an IP address, because this can be slow
     UpdateTargetIP()
 
-    // Spawn our localhost web server, used to update the HDMI status display
+    // Load the sessions of the LoRaWAN devices that we decode ourselves
+    lorawanSessionsInit()
+
+    // Use a Semtech packet forwarder as the radio frontend if one is configured
+    if gwmpEnabled() {
+
+        gwmpInit()
+
+    } else {
+
+        // Initialize I/O devices
+        ioInit()
+
+        // Initialize the state machine and command processing
+        cmdInit()
+
+    }
+
+    // Forward LoRaWAN frames to a network server if one is configured
+    lorawanForwarderInit()
+
+    // Spawn our localhost web server, used to update the HDMI status display, now that
+    // the radios whose history it also serves exist
     go webServer()
 
-    // Spawn housekeeping and watchdog tasks
+    // Spawn housekeeping and watchdog tasks, now that the radios that they look after exist
     go timer15m()
     go timer5m()
     go timer1m()
-    go timer5s()
-
-    // Initialize I/O devices
-    ioInit()
-
-    // Initialize the state machine and command processing
-    cmdInit()
 
     // Wait for quite a while, and then exit, which will cause our
     // shell script to restart the container.  This is a failsafe
@@ -72,13 +89,6 @@ func main() {
 }
 
 // Timer functions
-func timer5s() {
-    for {
-        time.Sleep(5 * time.Second)
-        io5sWatchdog()
-    }
-}
-
 func timer1m() {
     minutesAlive := 0
     for {
@@ -88,9 +98,6 @@ func timer1m() {
             cmdSendStatsToTeletypeService()
         }
 
-        // Time out commands
-        cmd1mWatchdog()
-
         // Update what's on the browser connected to HDMI
         webUpdateData()
 
@@ -129,6 +136,27 @@ func timer15m() {
         hoursAgo :=  int64(t.Sub(bootedAt) / time.Hour)
         minutesAgo := int64(t.Sub(bootedAt) / time.Minute) - (hoursAgo * 60)
         go fmt.Printf("STATS: %d received in the last %dh %dm\n", cmdGetStats(), hoursAgo, minutesAgo)
+        go fmt.Printf("STATS: %d CRC errors\n", cmdGetCrcErrors())
+        duty := cmdGetDutyCycleStats()
+        if duty != "" {
+            go fmt.Printf("STATS: duty cycle remaining %s\n", duty)
+        }
+        channels := cmdGetChannelStats()
+        if channels != "" {
+            go fmt.Printf("STATS: by channel %s\n", channels)
+        }
+        recoveries := cmdGetRecoveryStats()
+        if recoveries != "" {
+            go fmt.Printf("STATS: recoveries %s\n", recoveries)
+        }
+        frameErrors := cmdGetFrameErrorStats()
+        if frameErrors != "" {
+            go fmt.Printf("STATS: frame errors %s\n", frameErrors)
+        }
+        lorawan := cmdGetLoRaWANStats()
+        if lorawan != "" {
+            go fmt.Printf("STATS: LoRaWAN %s\n", lorawan)
+        }
         go fmt.Printf("\n")
 
         // Print resource usage, just as an FYI
@@ -171,12 +199,36 @@ func loadLocalTimezone() {
 
 }
 
-// The localhost server used exclusively to update the local HDMI display
+// The localhost server used to update the local HDMI display, and to diagnose the radios
 func webServer() {
     http.Handle("/", http.FileServer(http.Dir("./web")))
+    http.HandleFunc("/history", webHistory)
     http.ListenAndServe(":8080", nil)
 }
 
+// A radio's recent history, as served by the local web server
+type radioHistory struct {
+    Radio string `json:"radio"`
+    State string `json:"state"`
+    Recoveries string `json:"recoveries,omitempty"`
+    History []lpwan.HistoryEntry `json:"history"`
+}
+
+// Serve what each radio's controller has done most recently, so that a gateway that is stuck
+// can be diagnosed without having to log into it
+func webHistory(rw http.ResponseWriter, req *http.Request) {
+    histories := []radioHistory{}
+    for _, r := range radios {
+        if r.ctl == nil {
+            continue
+        }
+        histories = append(histories, radioHistory{Radio: r.id, State: r.ctl.State().String(), Recoveries: r.ctl.RecoveryStats(), History: r.ctl.History()})
+    }
+    buffer, _ := json.MarshalIndent(histories, "", "    ")
+    rw.Header().Set("Content-Type", "application/json")
+    rw.Write(buffer)
+}
+
 // This periodically updates the JSON data file periodically reloaded by index.html
 func webUpdateData() {
     buffer := GetSafecastDataAsJSON()
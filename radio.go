@@ -0,0 +1,248 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Per-radio state, so that a single gateway may drive several LPWAN modules
+package main
+
+import (
+    "fmt"
+    "os"
+    "strings"
+    "sync"
+    "time"
+    "github.com/Safecast/TTGate/lpwan"
+    "github.com/tarm/serial"
+)
+
+// loraRadio is a single LPWAN module as far as the gateway is concerned: the controller that
+// drives it, how we're talking to it, and what we need to remember about what it has heard.
+type loraRadio struct {
+    id string
+    index int
+    ctl *lpwan.Controller           // Nil for the packet forwarder, which has no module
+
+    // I/O
+    emulator *lpwan.Emulator
+    replay *replayTransport
+    capture *sessionCapture
+
+    // Messages received
+    deviceToNotifyIfServiceDown uint32
+
+    // The packet forwarder's identity and outbound queue, which are otherwise the controller's
+    statsMutex sync.Mutex
+    hweui string
+    region string
+    duty *lpwan.DutyLedger
+    outboundQueue chan outboundCommand
+}
+
+// Statics
+var radios []*loraRadio
+
+// Create a radio.  Its controller is created when its i/o is initialized.
+func newLoraRadio(id string, index int) *loraRadio {
+    r := &loraRadio{}
+    r.id = id
+    r.index = index
+    return r
+}
+
+// Get the options for the radio's controller, with its configuration taken from the index'th
+// entry of each of the comma-separated per-radio environment variables
+func (r *loraRadio) controllerOptions() []lpwan.Option {
+    options := []lpwan.Option{
+        lpwan.WithSerialPort(getenvList("SERIAL", r.index)),
+        lpwan.WithSerialConfig(serialConfig("")),
+        lpwan.WithPortsInUse(serialPortsInUse),
+        lpwan.WithRegion(getenvList("REGION", r.index)),
+        lpwan.WithFrequency(getenvList("FREQ", r.index)),
+        lpwan.WithCountry(func() string { return OurCountryCode }),
+        lpwan.WithParams(r.loraParam),
+        lpwan.WithLogger(r.logf),
+        lpwan.WithVerbose(verboseDebug),
+        lpwan.WithTrace(r.trace),
+        lpwan.WithRecoveryPolicy(ioGetRecoveryPolicy(r)),
+        lpwan.WithHistorySize(getenvInt("HISTORY_SIZE", lpwan.DefaultHistorySize)),
+        lpwan.OnReceive(r.received),
+        lpwan.OnReceiveError(receiveErrorCount),
+        lpwan.OnReadyToTransmit(r.notifyIfServiceDown),
+        lpwan.OnModuleLost(ioModuleLost),
+    }
+    plan, err := lpwan.ParseScanPlan(getenvList("SCAN_PLAN", r.index))
+    if err != nil {
+        r.logf("Ignoring SCAN_PLAN: %v\n", err)
+    }
+    if plan != nil {
+        options = append(options, lpwan.WithScanPlan(plan))
+    }
+    return options
+}
+
+// The kind of frame error that each kind of error receiving a frame is counted as
+var receiveErrorKinds = map[string]string{
+    lpwan.ReceiveErrEmpty: frameErrEmpty,
+    lpwan.ReceiveErrBadHex: frameErrBadHex,
+    lpwan.ReceiveErrOddLength: frameErrOddHex,
+}
+
+// Count something that a radio received but couldn't pass on as a frame error of the corresponding kind
+func receiveErrorCount(err error) {
+    kind, detail := frameErrBadHex, err.Error()
+    re, isReceiveError := err.(*lpwan.ReceiveError)
+    if isReceiveError {
+        kind, detail = receiveErrorKinds[re.Kind], re.Detail
+        if kind == "" {
+            kind = re.Kind
+        }
+    }
+    frameErrorCount(&frameError{kind, detail})
+}
+
+// Get a "radio set" parameter, which may be configured with LORA_<NAME>, or for a specific
+// region with LORA_<REGION>_<NAME> (such as LORA_EU_SF=sf9).  As with the other per-radio
+// variables, a comma-separated list gives one value per radio.
+func (r *loraRadio) loraParam(region string, name string) string {
+    value := getenvList("LORA_" + strings.ToUpper(region) + "_" + strings.ToUpper(name), r.index)
+    if value == "" {
+        value = getenvList("LORA_" + strings.ToUpper(name), r.index)
+    }
+    return value
+}
+
+// Record a line sent to or received from the module if we're capturing the session
+func (r *loraRadio) trace(sent bool, line []byte) {
+    if sent {
+        r.capture.Line(captureSent, line)
+    } else {
+        r.capture.Line(captureReceived, line)
+    }
+}
+
+// Process a frame received by the radio's module
+func (r *loraRadio) received(frame []byte, meta lpwan.Metadata) {
+    cmdProcessReceived(frame, rxMetadata{Snr: meta.SNR, Rssi: meta.RSSI, Radio: r, ReceivedAt: meta.ReceivedAt,
+        Freq: meta.Frequency, Datr: meta.DataRate, Codr: meta.CodingRate})
+}
+
+// Enqueue an outbound message that already has a PB_ARRAY header.  This may be called from any goroutine.
+func (r *loraRadio) enqueueOutboundPayload(cmd []byte) {
+    if r.ctl != nil {
+        r.ctl.Enqueue(cmd)
+        return
+    }
+    var ocmd outboundCommand
+    ocmd.Command = cmd
+    ocmd.QueuedAt = time.Now()
+    r.outboundQueue <- ocmd
+}
+
+// Stay on the channel to which we're tuned, because a device there may be sent a reply
+func (r *loraRadio) holdChannel() {
+    if r.ctl != nil {
+        r.ctl.HoldChannel()
+    }
+}
+
+// Get the radio's EUI and region, once they are known
+func (r *loraRadio) identity() (hweui string, region string) {
+    if r.ctl != nil {
+        return r.ctl.HWEUI(), r.ctl.Region()
+    }
+    r.statsMutex.Lock()
+    defer r.statsMutex.Unlock()
+    return r.hweui, r.region
+}
+
+// Get the index'th entry of a comma-separated environment variable.  A variable with
+// only a single entry applies to every radio.
+func getenvList(name string, index int) string {
+    values := strings.Split(os.Getenv(name), ",")
+    if len(values) == 1 {
+        return strings.TrimSpace(values[0])
+    }
+    if index < len(values) {
+        return strings.TrimSpace(values[index])
+    }
+    return ""
+}
+
+// Determine how many radios have been configured, which is the number of entries
+// in whichever of the per-radio variables that define a module has the most
+func radioCount() int {
+    count := 1
+    for _, name := range []string{"SERIAL", "EMULATE"} {
+        s := os.Getenv(name)
+        if s != "" {
+            n := len(strings.Split(s, ","))
+            if n > count {
+                count = n
+            }
+        }
+    }
+    return count
+}
+
+// Get the serial port configuration from the environment, for the specified port
+func serialConfig(port string) serial.Config {
+
+    // This is the default speed for the Microchip RN2483/2903
+    config := serial.Config{Name: port, Baud: getenvInt("BAUD", 57600)}
+
+    config.Size = byte(getenvInt("SERIAL_DATABITS", 8))
+
+    switch strings.ToUpper(os.Getenv("SERIAL_PARITY")) {
+    case "E", "EVEN":
+        config.Parity = serial.ParityEven
+    case "O", "ODD":
+        config.Parity = serial.ParityOdd
+    case "M", "MARK":
+        config.Parity = serial.ParityMark
+    case "S", "SPACE":
+        config.Parity = serial.ParitySpace
+    default:
+        config.Parity = serial.ParityNone
+    }
+
+    if getenvInt("SERIAL_STOPBITS", 1) == 2 {
+        config.StopBits = serial.Stop2
+    } else {
+        config.StopBits = serial.Stop1
+    }
+
+    return config
+
+}
+
+// Get the names of the serial ports currently open by any radio
+func serialPortsInUse() map[string]bool {
+    inUse := map[string]bool{}
+    for _, r := range radios {
+        if r.ctl != nil && r.ctl.SerialPort() != "" {
+            inUse[r.ctl.SerialPort()] = true
+        }
+    }
+    return inUse
+}
+
+// Prefix used for the radio's debug output, which is only needed when there's more than one
+func (r *loraRadio) logPrefix() string {
+    if len(radios) <= 1 {
+        return ""
+    }
+    return r.id + ": "
+}
+
+// Print debug output associated with this radio
+func (r *loraRadio) logf(format string, args ...interface{}) {
+    go fmt.Printf(r.logPrefix() + format, args...)
+}
+
+// Find the primary radio, whose identity is that of the gateway
+func primaryRadio() *loraRadio {
+    if len(radios) == 0 {
+        return nil
+    }
+    return radios[0]
+}
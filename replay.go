@@ -0,0 +1,312 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Replay of a captured serial session through the state machine and forwarding pipeline
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "os"
+    "strconv"
+    "sync"
+    "time"
+    "github.com/Safecast/TTGate/lpwan"
+)
+
+// replayTransport is an lpwan.Transport that plays back the lines received in a capture.
+// To reproduce the session exactly, each received line is held back until the state
+// machine has sent as many commands as had been sent when that line was originally
+// received, and then for the same interval that had originally elapsed.
+type replayTransport struct {
+    mu sync.Mutex
+    records []captureRecord
+    sends []captureRecord
+    sendsBefore []int
+    sendTimes []time.Time
+    next int
+    lastEventAt time.Time
+    speed float64
+    poke chan struct{}
+    closed chan struct{}
+    closeOnce sync.Once
+    done chan struct{}
+    doneOnce sync.Once
+
+    // Statistics
+    delivered int
+    mismatches int
+    syncTimeouts int
+}
+
+// If the state machine diverges from the capture, don't wait forever for a command it will never send
+var replaySyncTimeout = 30 * time.Second
+
+// Once the capture has been played back, the replay is complete when the stub service has seen
+// nothing for a while, which gives the uploads of the last few frames time to finish
+const replayIdleTime = 3 * time.Second
+const replayIdleTimeout = 2 * time.Minute
+
+// replayStub is a local stand-in for TTSERVE that logs whatever the gateway sends it
+type replayStub struct {
+    mu sync.Mutex
+    active int
+    lastActiveAt time.Time
+}
+
+// Create a replay transport from a capture file, playing back at the specified speed
+func newReplayTransport(filename string, speed float64) (*replayTransport, error) {
+
+    records, err := captureLoad(filename)
+    if err != nil {
+        return nil, err
+    }
+
+    r := &replayTransport{}
+    r.records = records
+    r.sendsBefore = make([]int, len(records))
+    for i, rec := range records {
+        r.sendsBefore[i] = len(r.sends)
+        if rec.Direction == captureSent {
+            r.sends = append(r.sends, rec)
+        }
+    }
+    r.speed = speed
+    r.lastEventAt = time.Now()
+    r.poke = make(chan struct{}, 1)
+    r.closed = make(chan struct{})
+    r.done = make(chan struct{})
+
+    return r, nil
+
+}
+
+// Done is closed when every received line in the capture has been played back
+func (r *replayTransport) Done() <-chan struct{} {
+    return r.done
+}
+
+// Summary describes how faithfully the replay tracked the capture
+func (r *replayTransport) Summary() string {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return fmt.Sprintf("%d lines played back, %d of %d commands sent, %d mismatched, %d sync timeouts",
+        r.delivered, len(r.sendTimes), len(r.sends), r.mismatches, r.syncTimeouts)
+}
+
+// ReadLine returns the next received line from the capture, when it is due
+func (r *replayTransport) ReadLine() ([]byte, error) {
+
+    for {
+
+        r.mu.Lock()
+
+        // Skip over the commands that we sent
+        for r.next < len(r.records) && r.records[r.next].Direction == captureSent {
+            r.next++
+        }
+        if r.next >= len(r.records) {
+            r.mu.Unlock()
+            r.doneOnce.Do(func() { close(r.done) })
+            <-r.closed
+            return nil, lpwan.ErrTransportClosed
+        }
+        i := r.next
+        rec := r.records[i]
+        synced := len(r.sendTimes) >= r.sendsBefore[i]
+        r.mu.Unlock()
+
+        // Wait for the state machine to catch up with the capture
+        if !synced {
+            select {
+            case <-r.poke:
+                continue
+            case <-time.After(replaySyncTimeout):
+                r.mu.Lock()
+                r.syncTimeouts++
+                for len(r.sendTimes) < r.sendsBefore[i] {
+                    r.sendTimes = append(r.sendTimes, time.Now())
+                }
+                r.mu.Unlock()
+                go fmt.Printf("replay: gave up waiting for '%s'\n", r.sends[r.sendsBefore[i]-1].Line)
+                continue
+            case <-r.closed:
+                return nil, lpwan.ErrTransportClosed
+            }
+        }
+
+        // Wait for the same interval as originally elapsed since the previous record
+        r.mu.Lock()
+        since := r.lastEventAt
+        if i > 0 && r.records[i-1].Direction == captureSent {
+            since = r.sendTimes[r.sendsBefore[i]-1]
+        }
+        var gap time.Duration
+        if i > 0 {
+            gap = rec.At.Sub(r.records[i-1].At)
+        }
+        r.mu.Unlock()
+        wait := time.Duration(float64(gap) / r.speed) - time.Now().Sub(since)
+        if wait > 0 {
+            select {
+            case <-time.After(wait):
+            case <-r.closed:
+                return nil, lpwan.ErrTransportClosed
+            }
+        }
+
+        r.mu.Lock()
+        r.next++
+        r.delivered++
+        r.lastEventAt = time.Now()
+        r.mu.Unlock()
+
+        return append([]byte(nil), rec.Line...), nil
+
+    }
+
+}
+
+// WriteCommand checks the command against what was originally sent at this point
+func (r *replayTransport) WriteCommand(cmd []byte) error {
+
+    r.mu.Lock()
+    k := len(r.sendTimes)
+    if k < len(r.sends) && !bytes.Equal(cmd, r.sends[k].Line) {
+        r.mismatches++
+        go fmt.Printf("replay: sent '%s' but capture has '%s'\n", cmd, r.sends[k].Line)
+    }
+    r.sendTimes = append(r.sendTimes, time.Now())
+    r.lastEventAt = time.Now()
+    r.mu.Unlock()
+
+    select {
+    case r.poke <- struct{}{}:
+    default:
+    }
+
+    return nil
+
+}
+
+// Flush does nothing, because the capture only contains lines that survived flushing
+func (r *replayTransport) Flush() {
+}
+
+// Close stops the replay
+func (r *replayTransport) Close() error {
+    r.closeOnce.Do(func() {
+        close(r.closed)
+    })
+    return nil
+}
+
+// Open the replay specified by the REPLAY environment variable, if any
+func ioOpenReplay() *replayTransport {
+
+    filename := os.Getenv("REPLAY")
+    if filename == "" {
+        return nil
+    }
+
+    speed := 1.0
+    s := os.Getenv("REPLAY_SPEED")
+    if s != "" {
+        f, err := strconv.ParseFloat(s, 64)
+        if err == nil && f > 0 {
+            speed = f
+        }
+    }
+
+    r, err := newReplayTransport(filename, speed)
+    if err != nil {
+        go fmt.Printf("replay: %v\n", err)
+        return nil
+    }
+
+    // Never send replayed traffic to the real service
+    stub, err := replayStubService()
+    if err != nil {
+        go fmt.Printf("replay: cannot start stub service: %v\n", err)
+        return nil
+    }
+
+    go fmt.Printf("Replaying %s (%d records) at %.1fx\n", filename, len(r.records), speed)
+
+    // Exit when the replay is complete, once uploads have finished
+    go func() {
+        <-r.Done()
+        if !stub.waitIdle(replayIdleTime, replayIdleTimeout) {
+            fmt.Printf("replay: stub service still busy after %s\n", replayIdleTimeout)
+        }
+        fmt.Printf("Replay complete: %s\n", r.Summary())
+        os.Exit(0)
+    }()
+
+    return r
+
+}
+
+// Start the stub service, and send everything to it in place of TTSERVE
+func replayStubService() (*replayStub, error) {
+
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        return nil, err
+    }
+
+    s := &replayStub{}
+    s.lastActiveAt = time.Now()
+    go http.Serve(listener, s)
+
+    ttUploadAddress = listener.Addr().String()
+    ttUploadIP = ttUploadAddress
+    ttStatsURL = fmt.Sprintf("http://%s/gateway", ttUploadAddress)
+
+    return s, nil
+
+}
+
+// Log a request, noting that the stub is in use until it has been handled
+func (s *replayStub) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+
+    s.mu.Lock()
+    s.active++
+    s.mu.Unlock()
+
+    body, _ := ioutil.ReadAll(req.Body)
+    go fmt.Printf("stub ttserve %s: %s\n", req.URL.Path, body)
+
+    s.mu.Lock()
+    s.active--
+    s.lastActiveAt = time.Now()
+    s.mu.Unlock()
+
+}
+
+// Wait until the stub has handled every request and then seen no more for the idle time,
+// returning false if that hasn't happened within the timeout
+func (s *replayStub) waitIdle(idle time.Duration, timeout time.Duration) bool {
+
+    deadline := time.Now().Add(timeout)
+    for {
+        s.mu.Lock()
+        wait := idle - time.Now().Sub(s.lastActiveAt)
+        if s.active != 0 {
+            wait = idle
+        }
+        s.mu.Unlock()
+        if wait <= 0 {
+            return true
+        }
+        if time.Now().Add(wait).After(deadline) {
+            return false
+        }
+        time.Sleep(wait)
+    }
+
+}
@@ -0,0 +1,305 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+    "io"
+    "io/ioutil"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+    "github.com/Safecast/TTGate/lpwan"
+)
+
+// Answer the commands sent to an in-memory transport as an RN2483 would, receiving a packet on the first
+// receive and noting when the module has been put back into receive after that
+func replayTestModule(mt *lpwan.MemTransport, packet string, listening chan struct{}) {
+    received := false
+    for cmd := range mt.Sent() {
+        command := string(cmd)
+        switch {
+        case command == "sys get ver" || command == "sys reset":
+            mt.Inject("RN2483 1.0.1 Dec 15 2015 09:38:09")
+        case command == "sys get hweui":
+            mt.Inject("0004A30B001C4D12")
+        case command == "mac pause":
+            mt.Inject("4294967245")
+        case command == "radio get snr":
+            mt.Inject("-3")
+        case strings.HasPrefix(command, "radio set "):
+            mt.Inject("ok")
+        case command == "radio rx 0":
+            mt.Inject("ok")
+            if received {
+                select {
+                case listening <- struct{}{}:
+                default:
+                }
+            } else {
+                mt.Inject("radio_rx  " + packet)
+                received = true
+            }
+        default:
+            mt.Inject("invalid_param")
+        }
+    }
+}
+
+// Create a controller for the replay tests, which reports the frames that it receives
+func replayTestController(t lpwan.Transport, trace func(sent bool, line []byte), received chan []byte) *lpwan.Controller {
+    options := []lpwan.Option{
+        lpwan.WithTransport(t),
+        lpwan.WithReset(lpwan.NoReset()),
+        lpwan.WithTimeScale(0.05),
+        lpwan.WithLogger(func(format string, args ...interface{}) {}),
+        lpwan.OnReceive(func(frame []byte, meta lpwan.Metadata) {
+            select {
+            case received <- frame:
+            default:
+            }
+        }),
+    }
+    if trace != nil {
+        options = append(options, lpwan.WithTrace(trace))
+    }
+    return lpwan.New(options...)
+}
+
+// Write a capture file by hand
+func replayTestCapture(t *testing.T, dir string, records ...string) string {
+    filename := filepath.Join(dir, "capture")
+    err := ioutil.WriteFile(filename, []byte(strings.Join(records, "\n") + "\n"), 0644)
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    return filename
+}
+
+// A session captured from a module replays through a fresh controller exactly as it happened: every
+// command is sent when it was before, and the frame is received again
+func TestReplayRoundTrip(t *testing.T) {
+
+    dir := captureTestDir(t)
+    defer os.RemoveAll(dir)
+    filename := filepath.Join(dir, "capture")
+
+    // Capture a session in which a frame is received
+    r, capture := captureTestStart(t, filename, 10 * 1024 * 1024)
+    mt := lpwan.NewMemTransport()
+    listening := make(chan struct{}, 1)
+    go replayTestModule(mt, "48656C6C6F", listening)
+    received := make(chan []byte, 10)
+    replayTestController(mt, r.trace, received).Start()
+    select {
+    case frame := <-received:
+        if string(frame) != "Hello" {
+            t.Fatalf("captured %q, want \"Hello\"", frame)
+        }
+    case <-time.After(20 * time.Second):
+        t.Fatalf("nothing received while capturing")
+    }
+    select {
+    case <-listening:
+    case <-time.After(20 * time.Second):
+        t.Fatalf("never listened again while capturing")
+    }
+    captureTestStop(capture)
+    mt.Close()
+
+    records, err := captureLoad(filename)
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    receives := 0
+    for _, rec := range records {
+        if rec.Direction == captureReceived {
+            receives++
+        }
+    }
+    span := records[len(records)-1].At.Sub(records[0].At)
+
+    // Replay it
+    speed := 2.0
+    rt, err := newReplayTransport(filename, speed)
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    defer rt.Close()
+    received = make(chan []byte, 10)
+    start := time.Now()
+    replayTestController(rt, nil, received).Start()
+    select {
+    case frame := <-received:
+        if string(frame) != "Hello" {
+            t.Fatalf("replayed %q, want \"Hello\"", frame)
+        }
+    case <-time.After(20 * time.Second):
+        t.Fatalf("nothing received while replaying")
+    }
+    select {
+    case <-rt.Done():
+    case <-time.After(20 * time.Second):
+        t.Fatalf("replay never completed: %s", rt.Summary())
+    }
+    elapsed := time.Since(start)
+
+    rt.mu.Lock()
+    defer rt.mu.Unlock()
+    if rt.delivered != receives || len(rt.sendTimes) < len(rt.sends) || rt.mismatches != 0 || rt.syncTimeouts != 0 {
+        t.Fatalf("%d of %d lines played back, %d of %d commands sent, %d mismatched, %d sync timeouts",
+            rt.delivered, receives, len(rt.sendTimes), len(rt.sends), rt.mismatches, rt.syncTimeouts)
+    }
+
+    // Which takes as long as the capture did, at the speed of the replay
+    if elapsed < time.Duration(float64(span) / speed) - 100 * time.Millisecond {
+        t.Fatalf("replayed %s of capture in %s at %.0fx", span, elapsed, speed)
+    }
+
+}
+
+// A replay that diverges from its capture is reported as such, and waits only so long for a command
+// that is never sent.  Each line is played back once it's due relative to the command before it.
+func TestReplayDivergence(t *testing.T) {
+
+    defer func(timeout time.Duration) {
+        replaySyncTimeout = timeout
+    }(replaySyncTimeout)
+    replaySyncTimeout = 100 * time.Millisecond
+
+    dir := captureTestDir(t)
+    defer os.RemoveAll(dir)
+    filename := replayTestCapture(t, dir,
+        "# TTGate capture opened 2017-03-31T16:21:17.000000000Z",
+        "2017-03-31T16:21:17.000000000Z > sys get ver",
+        "2017-03-31T16:21:17.100000000Z < RN2483 1.0.1 Dec 15 2015 09:38:09",
+        "2017-03-31T16:21:17.200000000Z > sys get hweui",
+        "2017-03-31T16:21:17.300000000Z < 0004A30B001C4D12",
+        "2017-03-31T16:21:17.400000000Z > radio set mod lora",
+        "2017-03-31T16:21:17.800000000Z < ok")
+    rt, err := newReplayTransport(filename, 2)
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+
+    type read struct {
+        line string
+        err error
+        at time.Time
+    }
+    reads := make(chan read)
+    readLine := func() {
+        line, err := rt.ReadLine()
+        reads <- read{string(line), err, time.Now()}
+    }
+    expect := func(want string, after time.Time, earliest time.Duration) {
+        t.Helper()
+        select {
+        case r := <-reads:
+            if r.err != nil || r.line != want {
+                t.Fatalf("read %q with %v, want %q", r.line, r.err, want)
+            }
+            if r.at.Sub(after) < earliest - 10 * time.Millisecond || r.at.Sub(after) > earliest + time.Second {
+                t.Fatalf("read %q %s after, want %s", r.line, r.at.Sub(after), earliest)
+            }
+        case <-time.After(5 * time.Second):
+            t.Fatalf("never read %q", want)
+        }
+    }
+
+    // Nothing is played back until something is sent, and what's sent isn't what was captured
+    go readLine()
+    select {
+    case r := <-reads:
+        t.Fatalf("read %q before anything was sent", r.line)
+    case <-time.After(50 * time.Millisecond):
+    }
+    sent := time.Now()
+    rt.WriteCommand([]byte("sys reset"))
+    expect("RN2483 1.0.1 Dec 15 2015 09:38:09", sent, 50 * time.Millisecond)
+
+    // The next command is never sent, so the capture is only waited on for so long
+    go readLine()
+    expect("0004A30B001C4D12", time.Now(), replaySyncTimeout + 50 * time.Millisecond)
+
+    // And now we're back in step, and the reply is as late as it was in the capture
+    sent = time.Now()
+    rt.WriteCommand([]byte("radio set mod lora"))
+    go readLine()
+    expect("ok", sent, 200 * time.Millisecond)
+
+    // Once everything has been played back, the replay is done, and reads wait for it to be closed
+    go readLine()
+    select {
+    case <-rt.Done():
+    case <-time.After(5 * time.Second):
+        t.Fatalf("replay never completed")
+    }
+    rt.Close()
+    select {
+    case r := <-reads:
+        if r.err != lpwan.ErrTransportClosed {
+            t.Fatalf("read %q with %v after the replay was closed", r.line, r.err)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatalf("read not ended by closing")
+    }
+
+    summary := "3 lines played back, 3 of 3 commands sent, 1 mismatched, 1 sync timeouts"
+    if rt.Summary() != summary {
+        t.Fatalf("%s, want %s", rt.Summary(), summary)
+    }
+
+}
+
+// The replay is complete only once the stub service has finished with what it was sent, and then
+// heard nothing more for a while
+func TestReplayStubIdle(t *testing.T) {
+
+    defer func(address string, ip string, stats string) {
+        ttUploadAddress, ttUploadIP, ttStatsURL = address, ip, stats
+    }(ttUploadAddress, ttUploadIP, ttStatsURL)
+
+    stub, err := replayStubService()
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    if !strings.HasPrefix(ttStatsURL, "http://127.0.0.1:") || ttUploadIP != ttUploadAddress {
+        t.Fatalf("sending to %s and %s", ttUploadAddress, ttStatsURL)
+    }
+
+    // An upload whose body is still arriving keeps the stub busy
+    body, writer := io.Pipe()
+    done := make(chan error)
+    go func() {
+        resp, err := http.Post(ttStatsURL, "application/json", body)
+        if err == nil {
+            resp.Body.Close()
+        }
+        done <- err
+    }()
+    writer.Write([]byte("{"))
+    if stub.waitIdle(50 * time.Millisecond, 500 * time.Millisecond) {
+        t.Fatalf("idle during an upload")
+    }
+
+    // Until it has been handled, and the stub has then been left alone
+    writer.Write([]byte("}"))
+    writer.Close()
+    err = <-done
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    finished := time.Now()
+    if !stub.waitIdle(200 * time.Millisecond, 5 * time.Second) {
+        t.Fatalf("never idle")
+    }
+    if time.Since(finished) < 190 * time.Millisecond {
+        t.Fatalf("idle %s after the upload", time.Since(finished))
+    }
+
+}
@@ -0,0 +1,106 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Selection of the strategies for resetting and recovering each LPWAN module
+package main
+
+import (
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+    "github.com/Safecast/TTGate/lpwan"
+)
+
+// Get an integer-valued environment variable
+func getenvInt(name string, defaultValue int) int {
+    s := os.Getenv(name)
+    if s == "" {
+        return defaultValue
+    }
+    i, err := strconv.Atoi(s)
+    if err != nil {
+        go fmt.Printf("Ignoring %s=%s: %v\n", name, s, err)
+        return defaultValue
+    }
+    return i
+}
+
+// Get the index'th entry of a comma-separated integer-valued environment variable
+func getenvListInt(name string, index int, defaultValue int) int {
+    s := getenvList(name, index)
+    if s == "" {
+        return defaultValue
+    }
+    i, err := strconv.Atoi(s)
+    if err != nil {
+        go fmt.Printf("Ignoring %s=%s: %v\n", name, s, err)
+        return defaultValue
+    }
+    return i
+}
+
+// Get a millisecond duration-valued environment variable
+func getenvMs(name string, defaultValue time.Duration) time.Duration {
+    return time.Duration(getenvInt(name, int(defaultValue / time.Millisecond))) * time.Millisecond
+}
+
+// Select the reset strategy for a radio as configured by the environment.  RESET, RESET_PIN,
+// RESET_GPIOCHIP and RESET_LINE may be comma-separated lists, with one entry per radio.
+func ioGetResetStrategy(r *loraRadio) lpwan.ResetStrategy {
+
+    // Emulated and replayed modules are never physically reset
+    if r.emulator != nil {
+        return lpwan.EmulatorReset(r.emulator)
+    }
+    if r.replay != nil {
+        return lpwan.NoReset()
+    }
+
+    pin := getenvListInt("RESET_PIN", r.index, 24)
+    activeHigh := strings.ToLower(os.Getenv("RESET_ACTIVE")) == "high"
+    pulse := getenvMs("RESET_PULSE_MS", lpwan.DefaultResetPulse)
+    settle := getenvMs("RESET_SETTLE_MS", lpwan.DefaultResetSettle)
+
+    method := getenvList("RESET", r.index)
+    switch strings.ToLower(method) {
+
+    case "", "gpio":
+        return lpwan.GPIOReset(pin, activeHigh, pulse, settle)
+
+    case "gpiochip":
+        chip := getenvList("RESET_GPIOCHIP", r.index)
+        if chip == "" {
+            chip = "/dev/gpiochip0"
+        }
+        line := getenvListInt("RESET_LINE", r.index, pin)
+        return lpwan.GPIOChipReset(chip, line, activeHigh, pulse, settle)
+
+    case "soft", "software":
+        return lpwan.SoftwareReset(settle)
+
+    case "none":
+        return lpwan.NoReset()
+
+    }
+
+    r.logf("Unknown RESET=%s; not resetting the module\n", method)
+    return lpwan.NoReset()
+
+}
+
+// Get the policy for recovering a radio's module when it misbehaves.  The number of attempts
+// at each level may be a comma-separated list, with one entry per radio, and zero skips the level.
+func ioGetRecoveryPolicy(r *loraRadio) lpwan.RecoveryPolicy {
+    p := lpwan.DefaultRecoveryPolicy()
+    for level, name := range []string{"RECOVERY_RECEIVE", "RECOVERY_SOFT", "RECOVERY_HARD", "RECOVERY_REOPEN"} {
+        p.Attempts[level] = getenvListInt(name, r.index, p.Attempts[level])
+    }
+    p.Backoff = getenvMs("RECOVERY_BACKOFF_MS", p.Backoff)
+    p.MaxBackoff = getenvMs("RECOVERY_MAX_BACKOFF_MS", p.MaxBackoff)
+    p.BusyLimit = getenvInt("RECOVERY_BUSY_LIMIT", p.BusyLimit)
+    p.StuckMinutes = getenvInt("RECOVERY_STUCK_MINUTES", p.StuckMinutes)
+    return p
+}
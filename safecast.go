@@ -10,6 +10,7 @@ import (
     "sort"
     "time"
     "strconv"
+    "sync"
     "encoding/json"
     "github.com/safecast/ttproto/golang"
 )
@@ -35,6 +36,17 @@ type seenDevice struct {
     EnvPress           string    `json:"env_press"`
     SNR                string    `json:"snr"`
     snr                float32   `json:"-"`
+    RSSI               string    `json:"rssi"`
+    Packets            uint32    `json:"packets"`
+    snrSum             float32   `json:"-"`
+    snrCount           uint32    `json:"-"`
+    rssiSum            int64     `json:"-"`
+    rssiCount          uint32    `json:"-"`
+    rssiMin            int32     `json:"-"`
+    AvgSNR             string    `json:"avg_snr"`
+    AvgRSSI            string    `json:"avg_rssi"`
+    MinRSSI            string    `json:"min_rssi"`
+    Radio              string    `json:"radio"`
     DeviceType         string    `json:"device_type"`
     Latitude           string    `json:"lat"`
     Longitude          string    `json:"lon"`
@@ -45,8 +57,10 @@ type seenDevice struct {
     OpcPm01_0          string    `json:"opc_pm01_0"`
     OpcPm02_5          string    `json:"opc_pm02_5"`
     OpcPm10_0          string    `json:"opc_pm10_0"`
+    Readings           map[string]string `json:"readings,omitempty"`
 }
 var seenDevices []seenDevice
+var seenDevicesMutex sync.Mutex
 
 // Class used to sort this data in a way that makes visual sense,
 // trying to stabilize the first entry as what might be the "closest" one
@@ -84,10 +98,41 @@ func (a byKey) Less(i, j int) bool {
     return false
 }
 
+// Accumulate statistics about the quality of the link to a device
+func (dev *seenDevice) updateLinkStats(meta rxMetadata) {
+
+    dev.Packets++
+
+    if meta.Snr != invalidSNR {
+        dev.snrSum += meta.Snr
+        dev.snrCount++
+    }
+    if meta.Rssi != 0 {
+        dev.rssiSum += int64(meta.Rssi)
+        if dev.rssiCount == 0 || meta.Rssi < dev.rssiMin {
+            dev.rssiMin = meta.Rssi
+        }
+        dev.rssiCount++
+    }
+
+    if dev.snrCount != 0 {
+        dev.AvgSNR = fmt.Sprintf("%.1fdB", dev.snrSum / float32(dev.snrCount))
+    }
+    if dev.rssiCount != 0 {
+        dev.AvgRSSI = fmt.Sprintf("%ddBm", dev.rssiSum / int64(dev.rssiCount))
+        dev.MinRSSI = fmt.Sprintf("%ddBm", dev.rssiMin)
+    }
+
+}
+
 // Record this safecast message for display on local HDMI via embedded browser
-func cmdLocallyDisplaySafecastMessage(msg ttproto.Telecast, snr float32) {
+func cmdLocallyDisplaySafecastMessage(msg ttproto.Telecast, meta rxMetadata) {
     var dev seenDevice
 
+    // Messages from different radios may be displayed at the same time
+    seenDevicesMutex.Lock()
+    defer seenDevicesMutex.Unlock()
+
     // Bump stats
     totalMessagesReceived = totalMessagesReceived + 1
 
@@ -146,28 +191,8 @@ func cmdLocallyDisplaySafecastMessage(msg ttproto.Telecast, snr float32) {
         dev.BatCurrent = ""
     }
 
-    // Note that we make a valiant attempt to localize the temp to C or F
     if msg.EnvTemp != nil {
-        switch OurCountryCode {
-        case "BS": // Bahamas
-            fallthrough
-        case "BZ": // Belize
-            fallthrough
-        case "GU": // Guam
-            fallthrough
-        case "KY": // Cayman Islands
-            fallthrough
-        case "PW": // Palau
-            fallthrough
-        case "PR": // Puerto Rico
-            fallthrough
-        case "US": // United States
-            fallthrough
-        case "VI": // US Virgin Islands
-            dev.EnvTemp = fmt.Sprintf("%.1fF", ((msg.GetEnvTemp()*9.0)/5.0)+32)
-        default:
-            dev.EnvTemp = fmt.Sprintf("%.1fC", msg.GetEnvTemp())
-        }
+        dev.EnvTemp = localizedTemp(msg.GetEnvTemp())
     } else {
         dev.EnvTemp = ""
     }
@@ -184,15 +209,26 @@ func cmdLocallyDisplaySafecastMessage(msg ttproto.Telecast, snr float32) {
         dev.EnvPress = ""
     }
 
-    if snr != invalidSNR {
-        dev.snr = snr
-        iSNR := int32(snr)
+    if meta.Snr != invalidSNR {
+        dev.snr = meta.Snr
+        iSNR := int32(meta.Snr)
         dev.SNR = fmt.Sprintf("%ddB", iSNR)
     } else {
         dev.snr = 0.0
         dev.SNR = ""
     }
 
+    if meta.Rssi != 0 {
+        dev.RSSI = fmt.Sprintf("%ddBm", meta.Rssi)
+    } else {
+        dev.RSSI = ""
+    }
+
+    // Which radio heard it, which is only interesting when there are several
+    if meta.Radio != nil && len(radios) > 1 {
+        dev.Radio = meta.Radio.id
+    }
+
     if msg.PmsPm01_0 != nil {
         dev.PmsPm01_0 = fmt.Sprintf("%dug/m3", msg.GetPmsPm01_0())
     } else {
@@ -247,6 +283,30 @@ func cmdLocallyDisplaySafecastMessage(msg ttproto.Telecast, snr float32) {
         dev.Altitude = ""
     }
 
+    // Record it, along with what we already know of the device
+    recordSeenDevice(&dev, meta)
+
+    // Display the received message on the Resin device console
+    str1 := "-"
+    str2 := "-"
+    str3 := "-"
+    if dev.Lnd7318U != "" {
+        str1 = dev.Lnd7318U
+    }
+    if dev.Lnd7318C != "" {
+        str2 = dev.Lnd7318C
+    }
+    if dev.Lnd7128Ec != "" {
+        str3 = dev.Lnd7128Ec
+    }
+    go fmt.Printf("\n%s %s: %s %s %s\n\n", dev.CapturedAtLocal, dev.DeviceID, str1, str2, str3)
+
+}
+
+// Record a device from which we received data, retaining what we already know of it that this
+// message didn't tell us.  Must be called with seenDevicesMutex held.
+func recordSeenDevice(dev *seenDevice, meta rxMetadata) {
+
     // Scan and update the list of seen devices
     var found = false
     for i := 0; i < len(seenDevices); i++ {
@@ -285,9 +345,30 @@ func cmdLocallyDisplaySafecastMessage(msg ttproto.Telecast, snr float32) {
                 dev.snr = seenDevices[i].snr
                 dev.SNR = seenDevices[i].SNR
             }
+            if dev.RSSI == "" {
+                dev.RSSI = seenDevices[i].RSSI
+            }
+            for name, value := range seenDevices[i].Readings {
+                _, present := dev.Readings[name]
+                if !present {
+                    if dev.Readings == nil {
+                        dev.Readings = map[string]string{}
+                    }
+                    dev.Readings[name] = value
+                }
+            }
+
+            // Carry forward the link stats
+            dev.Packets = seenDevices[i].Packets
+            dev.snrSum = seenDevices[i].snrSum
+            dev.snrCount = seenDevices[i].snrCount
+            dev.rssiSum = seenDevices[i].rssiSum
+            dev.rssiCount = seenDevices[i].rssiCount
+            dev.rssiMin = seenDevices[i].rssiMin
+            dev.updateLinkStats(meta)
 
             // Update the entry
-            seenDevices[i] = dev
+            seenDevices[i] = *dev
             found = true;
             break
         }
@@ -295,35 +376,51 @@ func cmdLocallyDisplaySafecastMessage(msg ttproto.Telecast, snr float32) {
     }
 
     if !found {
-        seenDevices = append(seenDevices, dev)
+        dev.updateLinkStats(meta)
+        seenDevices = append(seenDevices, *dev)
     }
 
-    // Display the received message on the Resin device console
-    str1 := "-"
-    str2 := "-"
-    str3 := "-"
-    if dev.Lnd7318U != "" {
-        str1 = dev.Lnd7318U
-    }
-    if dev.Lnd7318C != "" {
-        str2 = dev.Lnd7318C
-    }
-    if dev.Lnd7128Ec != "" {
-        str3 = dev.Lnd7128Ec
-    }
-    go fmt.Printf("\n%s %s: %s %s %s\n\n", dev.CapturedAtLocal, dev.DeviceID, str1, str2, str3)
+}
 
+// Format a temperature in degrees C, making a valiant attempt to localize it to C or F
+func localizedTemp(c float32) string {
+    switch OurCountryCode {
+    case "BS": // Bahamas
+        fallthrough
+    case "BZ": // Belize
+        fallthrough
+    case "GU": // Guam
+        fallthrough
+    case "KY": // Cayman Islands
+        fallthrough
+    case "PW": // Palau
+        fallthrough
+    case "PR": // Puerto Rico
+        fallthrough
+    case "US": // United States
+        fallthrough
+    case "VI": // US Virgin Islands
+        return fmt.Sprintf("%.1fF", ((c*9.0)/5.0)+32)
+    default:
+        return fmt.Sprintf("%.1fC", c)
+    }
 }
 
 // GetSafecastDevicesString retrieves the device data sorted and classified in a way useful in local web browser
 func GetSafecastDevicesString() string {
 
     // Duplicate the device list
-    sortedDevices := seenDevices
+    seenDevicesMutex.Lock()
+    sortedDevices := append([]seenDevice(nil), seenDevices...)
+    seenDevicesMutex.Unlock()
 
     // Zip through the list, updating how many minutes it was captured ago
     s := ""
     for i := 0; i < len(sortedDevices); i++ {
+        // Third-party devices are of no interest to the service
+        if sortedDevices[i].DeviceType == lppDeviceType {
+            continue
+        }
         if s != "" {
             s += ","
         }
@@ -337,7 +434,9 @@ func GetSafecastDevicesString() string {
 func GetSafecastDataAsJSON() []byte {
 
     // Duplicate the device list
-    sortedDevices := seenDevices
+    seenDevicesMutex.Lock()
+    sortedDevices := append([]seenDevice(nil), seenDevices...)
+    seenDevicesMutex.Unlock()
 
     // Zip through the list, updating how many minutes it was captured ago
     t := time.Now()
@@ -15,6 +15,7 @@ import (
     "net/http"
     "os"
     "strconv"
+    "sync"
     "time"
     "github.com/golang/protobuf/proto"
     "github.com/safecast/ttproto/golang"
@@ -26,14 +27,18 @@ var ipInfoData IPInfoData
 var serviceReachable = false
 var serviceEverBecameUnreachable = false
 var serviceFirstUnreachableAt time.Time
+var serviceMutex sync.Mutex
 var fetchedIPInfo = false
-var fetchedLatLon = false
+var fetchedLatLon sync.Once
+var targetIPMutex sync.Mutex
 var locLat = ""
 var locLon = ""
 var locAlt = ""
 
 // UpdateTargetIP loads network location, DNS, and IP information
 func UpdateTargetIP() {
+    targetIPMutex.Lock()
+    defer targetIPMutex.Unlock()
 
     // Only enable this if it is really proven that it is slow.  The downside
     // of having this code enabled is that it completely defeats the purpose
@@ -66,15 +71,24 @@ func UpdateTargetIP() {
 
 }
 
+// Determine whether a message is a ping asking for a pingback, rather than another gateway's pingback
+func telecastWantsPingback(msg *ttproto.Telecast) bool {
+    switch msg.GetDeviceType() {
+    case ttproto.Telecast_TTGATE, ttproto.Telecast_TTGATEPING:
+        return msg.DeviceType != nil && msg.Message == nil
+    }
+    return false
+}
+
 // Process a received Telecast message, forwarding if appropriate
-func cmdProcessReceivedTelecastMessage(msg ttproto.Telecast, pb []byte, snr float32,  replyAllowed bool) {
+func cmdProcessReceivedTelecastMessage(msg ttproto.Telecast, pb []byte, meta rxMetadata,  replyAllowed bool) {
 
     // Do various things baed upon the message type
     if msg.DeviceType == nil {
 
         // Solarcast
-        cmdForwardMessageToTeletypeService(pb, snr, replyAllowed)
-        go cmdLocallyDisplaySafecastMessage(msg, snr)
+        cmdForwardMessageToTeletypeService(pb, meta, replyAllowed)
+        go cmdLocallyDisplaySafecastMessage(msg, meta)
 
     } else {
 
@@ -84,13 +98,13 @@ func cmdProcessReceivedTelecastMessage(msg ttproto.Telecast, pb []byte, snr floa
         case ttproto.Telecast_UNKNOWN_DEVICE_TYPE:
             fallthrough
         case ttproto.Telecast_SOLARCAST:
-            cmdForwardMessageToTeletypeService(pb, snr, replyAllowed)
-            go cmdLocallyDisplaySafecastMessage(msg, snr)
+            cmdForwardMessageToTeletypeService(pb, meta, replyAllowed)
+            go cmdLocallyDisplaySafecastMessage(msg, meta)
 
             // Are we simply forwarding a message originating from a nano?
         case ttproto.Telecast_BGEIGIE_NANO:
-            cmdForwardMessageToTeletypeService(pb, snr, replyAllowed)
-            go cmdLocallyDisplaySafecastMessage(msg, snr)
+            cmdForwardMessageToTeletypeService(pb, meta, replyAllowed)
+            go cmdLocallyDisplaySafecastMessage(msg, meta)
 
             // If this is a ping request (indicated by null Message), then send that device back the same thing we received,
             // but WITH a message (so that we don't cause a ping storm among multiple ttgates with visibility to each other)
@@ -100,11 +114,18 @@ func cmdProcessReceivedTelecastMessage(msg ttproto.Telecast, pb []byte, snr floa
         case ttproto.Telecast_TTGATEPING:
             // If we're offline, short circuit this because we don't want to mislead.
             // We'd rather that they use cellular.
-            if !serviceReachable {
+            serviceMutex.Lock()
+            reachable := serviceReachable
+            serviceMutex.Unlock()
+            if !reachable {
                 return
             }
-            // Process it
-            if msg.Message == nil {
+            // Process it, unless we're already replying to something else in the same frame
+            if telecastWantsPingback(&msg) {
+                if !replyAllowed {
+                    go fmt.Printf("Not sending pingback to device %d: already replying to its frame\n", msg.GetDeviceId())
+                    return
+                }
 
                 // Format the message
                 msg.Message = proto.String("ping")
@@ -114,20 +135,25 @@ func cmdProcessReceivedTelecastMessage(msg ttproto.Telecast, pb []byte, snr floa
                 // Marshal it
                 data, err := proto.Marshal(&msg)
                 if err != nil {
-                    go fmt.Printf("marshaling error: ", err)
+                    go fmt.Printf("marshaling error: %v\n", err)
                 }
-                // Importantly, sleep for several seconds to give the (slow) receiver a chance to get into receive mode.
+                // Importantly, wait for several seconds to give the (slow) receiver a chance to get into receive mode.
                 // We randomize it in case there are several ttgate's alive within listening range, so we minimize the chance
-                // that we will step on each others' transmissions.
+                // that we will step on each others' transmissions.  We're on the radio's event loop, so don't hold it up
+                // while waiting.
                 delaySecs := random(1, 20)
-                time.Sleep(time.Duration(delaySecs) * time.Second)
-                cmdEnqueueOutboundPb(data)
-                go fmt.Printf("Sent pingback to device %d after %d seconds\n", msg.GetDeviceId(), delaySecs)
+                deviceID := msg.GetDeviceId()
+                time.AfterFunc(time.Duration(delaySecs) * time.Second, func() {
+                    if meta.Radio != nil {
+                        meta.Radio.enqueueOutboundPb(data)
+                    }
+                    go fmt.Printf("Sent pingback to device %d after %d seconds\n", deviceID, delaySecs)
+                })
                 return
             }
 
             // Forward the message to the service
-            cmdForwardMessageToTeletypeService(pb, snr, replyAllowed)
+            cmdForwardMessageToTeletypeService(pb, meta, replyAllowed)
 
             // If it's a non-Safecast device, just display what we received
         default:
@@ -176,22 +202,22 @@ func GetIPInfo() (bool, string, IPInfoData) {
 }
 
 // Forward this message to the teletype service via HTTP
-func cmdForwardMessageToTeletypeService(pb []byte, snr float32, replyAllowed bool) {
+func cmdForwardMessageToTeletypeService(pb []byte, meta rxMetadata, replyAllowed bool) {
 
     // Note that if a reply is allowed, we MUST do this synchronously, because failing
     // to do so will cause the state.go state machine to immediately go into a recv()
     // which will prevent our send() from occurring within the waiting device's allowed
     // time window.
     if replyAllowed {
-        forwardMessageToTeletypeService(pb, snr)
+        forwardMessageToTeletypeService(pb, meta)
     } else {
-        go forwardMessageToTeletypeService(pb, snr)
+        go forwardMessageToTeletypeService(pb, meta)
     }
 
 }
 
 // Forward this message to the teletype service via HTTP
-func forwardMessageToTeletypeService(pb []byte, snr float32) {
+func forwardMessageToTeletypeService(pb []byte, meta rxMetadata) {
 
     _, ipinfo, _ := GetIPInfo()
 
@@ -204,12 +230,11 @@ func forwardMessageToTeletypeService(pb []byte, snr float32) {
     msg.GatewayID, _ = cmdGetGatewayInfo()
 
     // Some devices don't have LAT/LON, and in this case the gateway will supply it (if configured)
-    if !fetchedLatLon {
-        fetchedLatLon = true
+    fetchedLatLon.Do(func() {
         locLat = os.Getenv("LAT")
         locLon = os.Getenv("LON")
         locAlt = os.Getenv("ALT")
-    }
+    })
 
     if locLat != "" {
         f64, err := strconv.ParseFloat(locLat, 64)
@@ -230,9 +255,15 @@ func forwardMessageToTeletypeService(pb []byte, snr float32) {
         }
     }
 
-    // The service might find it handy to see the SNR of the last message received from the gateway
-    if snr != invalidSNR {
-        msg.Snr = float32(snr)
+    // The service might find it handy to see the SNR and RSSI of the last message received from the gateway
+    if meta.Snr != invalidSNR {
+        msg.Snr = meta.Snr
+    }
+    msg.Rssi = meta.Rssi
+
+    // When there are several radios, note which one heard it
+    if meta.Radio != nil && len(radios) > 1 {
+        msg.Radio = meta.Radio.id
     }
 
     // Augment the outbound metadata with ip info
@@ -240,7 +271,9 @@ func forwardMessageToTeletypeService(pb []byte, snr float32) {
 
     // Send it to the teletype service via HTTP
     msgJSON, _ := json.Marshal(msg)
+    targetIPMutex.Lock()
     UploadURL := fmt.Sprintf(ttUploadURLPattern, ttUploadIP)
+    targetIPMutex.Unlock()
     req, err := http.NewRequest("POST", UploadURL, bytes.NewBuffer(msgJSON))
     req.Header.Set("User-Agent", "TTGATE")
     req.Header.Set("Content-Type", "application/json")
@@ -262,7 +295,10 @@ func forwardMessageToTeletypeService(pb []byte, snr float32) {
             if payloadstr != "" {
                 payload, err := hex.DecodeString(payloadstr)
                 if err == nil {
-                    cmdEnqueueOutboundPayload(payload)
+                    // Reply through the radio that heard the device, since that's where it's listening
+                    if meta.Radio != nil {
+                        meta.Radio.enqueueOutboundPayload(payload)
+                    }
                     go fmt.Printf("Sent reply: %s\n", payloadstr)
                 } else {
                     go fmt.Printf("Error %v: %s\n", err, payloadstr)
@@ -302,6 +338,8 @@ func forwardMessageToTeletypeService(pb []byte, snr float32) {
 
 // Set the teletype service as known-reachable or known-unreachable
 func setTeletypeServiceReachability(isReachable bool) {
+    serviceMutex.Lock()
+    defer serviceMutex.Unlock()
     if (!serviceReachable && isReachable) {
         go fmt.Printf("*** TTSERVE is now reachable\n");
     } else if (serviceReachable && !isReachable) {
@@ -327,6 +365,8 @@ func setTeletypeServiceReachability(isReachable bool) {
 // We use a significant amount of debounce time because this will cause devices to
 // resort to using Cellular until their next reboot cycle.
 func isTeletypeServiceReachable() bool {
+    serviceMutex.Lock()
+    defer serviceMutex.Unlock()
     // Useful (saves an hour) when debugging ttrelay behavior upon receiving "down" message
     if DebugFailover {
         return false
@@ -349,6 +389,8 @@ func isTeletypeServiceReachable() bool {
 // in which case we should assume that the device is in a really bad state.  If this
 // is the case, we reboot.
 func isOfflineForExtendedPeriod() bool {
+    serviceMutex.Lock()
+    defer serviceMutex.Unlock()
     // Exit immediately if the service is known to be reachable
     if serviceReachable {
         return false
@@ -385,7 +427,13 @@ func cmdSendStatsToTeletypeService() {
 
     // Stats
     msg.MessagesReceived = cmdGetStats()
+    msg.CrcErrors = cmdGetCrcErrors()
     msg.DevicesSeen = GetSafecastDevicesString()
+    msg.ChannelsHeard = cmdGetChannelStats()
+    msg.DutyCycleRemaining = cmdGetDutyCycleStats()
+    msg.Recoveries = cmdGetRecoveryStats()
+    msg.FrameErrors = cmdGetFrameErrorStats()
+    msg.Firmware = cmdGetFirmware()
 
     // Send it
     msgJSON, _ := json.Marshal(msg)
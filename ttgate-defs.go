@@ -12,6 +12,8 @@ type TTGateReq struct {
 
 	// Message-related info generated by the gateway
 	Snr					float32		`json:"gateway_lora_snr,omitempty"`
+	Rssi				int32		`json:"gateway_lora_rssi,omitempty"`
+	Radio				string		`json:"gateway_radio,omitempty"`
 	ReceivedAt			string		`json:"gateway_received,omitempty"`
 
 	// Gateway info
@@ -23,10 +25,23 @@ type TTGateReq struct {
 	GatewayName			string		`json:"gateway_name,omitempty"`
 	GatewayRegion		string		`json:"gateway_region,omitempty"`
 	MessagesReceived	uint32		`json:"gateway_msgs_received,omitempty"`
+	CrcErrors			uint32		`json:"gateway_crc_errors,omitempty"`
 	DevicesSeen			string		`json:"gateway_devices,omitempty"`
+	ChannelsHeard		string		`json:"gateway_channels,omitempty"`
+	DutyCycleRemaining	string		`json:"gateway_duty_remaining,omitempty"`
+	Recoveries			string		`json:"gateway_recoveries,omitempty"`
+	FrameErrors			string		`json:"gateway_frame_errors,omitempty"`
+	Firmware			[]ModuleFirmware	`json:"gateway_firmware,omitempty"`
 	IPInfo				IPInfoData	`json:"gateway_ipinfo,omitempty"`
 
 	// Service Info, when this message is being routed service-to-service
 	Transport			string		`json:"service_transport,omitempty"`
 
 }
+
+// ModuleFirmware identifies the firmware of an LPWAN module
+type ModuleFirmware struct {
+	Model				string		`json:"model,omitempty"`
+	Version				string		`json:"version,omitempty"`
+	BuildDate			string		`json:"build_date,omitempty"`
+}